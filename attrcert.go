@@ -0,0 +1,115 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// DecodeAttributeCertificates extracts the attribute certificates (RFC 5755)
+// from the cert bags of pfxData whose certificate type is certType, in the
+// order in which they appear.  They are returned DER-encoded and are not
+// parsed.  Other bags are ignored; it returns an empty slice if there are no
+// such cert bags.
+//
+// PKCS#12 assigns no certificate type to attribute certificates, so certType
+// is the one agreed upon with the producer of pfxData.  It can't be the type
+// of X.509 certificates.
+func DecodeAttributeCertificates(pfxData []byte, password string, certType asn1.ObjectIdentifier) (attrCerts [][]byte, err error) {
+	return defaultDecodeOptions.DecodeAttributeCertificates(pfxData, password, certType)
+}
+
+// DecodeAttributeCertificates is like the package-level [DecodeAttributeCertificates], but uses the options in opts.
+func (opts *DecodeOptions) DecodeAttributeCertificates(pfxData []byte, password string, certType asn1.ObjectIdentifier) (attrCerts [][]byte, err error) {
+	if err := checkAttributeCertificateType(certType); err != nil {
+		return nil, err
+	}
+
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, opts.passwordError(pfxData, err)
+	}
+
+	bags, _, err := opts.getSafeContents(pfxData, encodedPassword, opts.newKeyDeriverFor(password), 1, opts.maxContentInfos())
+	if err != nil {
+		return nil, err
+	}
+
+	attrCerts = [][]byte{}
+	for _, bag := range bags {
+		if !bag.Id.Equal(oidCertBag) {
+			continue
+		}
+		var cb certBag
+		if err := unmarshal(bag.Value.Bytes, &cb); err != nil {
+			return nil, errors.New("pkcs12: error decoding cert bag: " + err.Error())
+		}
+		if !cb.Id.Equal(certType) {
+			continue
+		}
+		if err := checkAttributeCertificate(cb.Data); err != nil {
+			return nil, err
+		}
+		attrCerts = append(attrCerts, cb.Data)
+	}
+	return attrCerts, nil
+}
+
+// EncodeAttributeCertificates produces pfxData containing the DER-encoded
+// attribute certificates (RFC 5755) attrCerts, each in a cert bag of type
+// certType; see [DecodeAttributeCertificates].  Like
+// [Encoder.EncodeTrustStore], it creates a single SafeContents that's
+// optionally encrypted and contains the cert bags.
+func (enc *Encoder) EncodeAttributeCertificates(attrCerts [][]byte, certType asn1.ObjectIdentifier, password string) (pfxData []byte, err error) {
+	if enc.macAlgorithm == nil && enc.certAlgorithm == nil && password != "" {
+		return nil, errors.New("password must be empty")
+	}
+	if err := checkAttributeCertificateType(certType); err != nil {
+		return nil, err
+	}
+
+	encodedPassword, err := enc.encodePassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	for _, attrCert := range attrCerts {
+		if err := checkAttributeCertificate(attrCert); err != nil {
+			return nil, err
+		}
+		value, err := asn1.Marshal(certBag{Id: certType, Data: attrCert})
+		if err != nil {
+			return nil, errors.New("pkcs12: error encoding cert bag: " + err.Error())
+		}
+		certBags = append(certBags, safeBag{
+			Id:    oidCertBag,
+			Value: asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: value},
+		})
+	}
+
+	return enc.encodeCertBags(certBags, encodedPassword)
+}
+
+func checkAttributeCertificateType(certType asn1.ObjectIdentifier) error {
+	if len(certType) == 0 {
+		return errors.New("pkcs12: no certificate type for the attribute certificates")
+	}
+	if certType.Equal(oidCertTypeX509Certificate) {
+		return errors.New("pkcs12: attribute certificates can't have the certificate type of X.509 certificates")
+	}
+	return nil
+}
+
+// checkAttributeCertificate checks that der is a single DER SEQUENCE, as an
+// attribute certificate is.
+func checkAttributeCertificate(der []byte) error {
+	var raw asn1.RawValue
+	if err := unmarshal(der, &raw); err != nil || raw.Class != asn1.ClassUniversal || raw.Tag != asn1.TagSequence {
+		return errors.New("pkcs12: malformed attribute certificate")
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"github.com/emmansun/gmsm/pkcs7"
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// DecodeAuto is like [DecodeChain], but data may be a DER-encoded PKCS#12
+// file, a PEM "PKCS12" block holding one, or a PKCS#12 file preceded by PEM
+// blocks, as emitted by some tools that prepend the certificate in PEM for
+// convenience.  Only the PKCS#12 file is decoded; the PEM blocks before it
+// are ignored.
+func DecodeAuto(data []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeAuto(data, password)
+}
+
+// DecodeAuto is like the package-level [DecodeAuto], but uses the options in opts.
+func (opts *DecodeOptions) DecodeAuto(data []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
+	pfxData, err := findPFX(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return opts.DecodeChain(pfxData, password)
+}
+
+// findPFX returns the DER-encoded PKCS#12 file in data, which is either
+// that file, possibly preceded by PEM blocks, or a PEM "PKCS12" block.
+func findPFX(data []byte) ([]byte, error) {
+	rest := data
+	for {
+		if len(rest) > 0 && rest[0] == 0x30 { // SEQUENCE
+			return rest, nil
+		}
+		block, next := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "PKCS12" {
+			return block.Bytes, nil
+		}
+		rest = bytes.TrimLeft(next, " \t\r\n")
+	}
+	return nil, errors.New("pkcs12: no PKCS#12 data found")
+}
+
+// DecodeEnveloped is like [DecodeChain], but pfxData is first decrypted from
+// envelope, a DER-encoded PKCS#7/CMS EnvelopedData ContentInfo encrypting it
+// for a recipient certificate, with recipientKey, the private key of that
+// certificate.  RSA and SM2 recipients are supported.  The PFX inside is
+// then decoded with password.
+func DecodeEnveloped(envelope []byte, recipientKey crypto.PrivateKey, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeEnveloped(envelope, recipientKey, password)
+}
+
+// DecodeEnveloped is like the package-level [DecodeEnveloped], but uses the options in opts.
+func (opts *DecodeOptions) DecodeEnveloped(envelope []byte, recipientKey crypto.PrivateKey, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
+	pfxData, err := openEnvelope(envelope, recipientKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return opts.DecodeChain(pfxData, password)
+}
+
+// openEnvelope decrypts the content of the EnvelopedData envelope with
+// recipientKey.  Only the private key is known, so the content key is
+// decrypted for each recipient identified by issuer and serial number until
+// one succeeds.
+func openEnvelope(envelope []byte, recipientKey crypto.PrivateKey) ([]byte, error) {
+	p7, err := pkcs7.Parse(envelope)
+	if err != nil {
+		return nil, errors.New("pkcs12: error reading envelopedData: " + err.Error())
+	}
+
+	var ci contentInfo
+	if err := unmarshal(envelope, &ci); err != nil {
+		return nil, errors.New("pkcs12: error reading envelopedData: " + err.Error())
+	}
+	var ed struct {
+		Version        int
+		RecipientInfos []asn1.RawValue `asn1:"set"`
+		Rest           asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, errors.New("pkcs12: error reading envelopedData: " + err.Error())
+	}
+
+	var lastErr error
+	for _, raw := range ed.RecipientInfos {
+		var ri struct {
+			Version int
+			Rid     struct {
+				Issuer       asn1.RawValue
+				SerialNumber *big.Int
+			}
+			KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+			EncryptedKey           []byte
+		}
+		if unmarshal(raw.FullBytes, &ri) != nil {
+			continue // not a KeyTransRecipientInfo with an IssuerAndSerialNumber
+		}
+		recipient := &smx509.Certificate{RawIssuer: ri.Rid.Issuer.FullBytes, SerialNumber: ri.Rid.SerialNumber}
+		content, err := p7.Decrypt(recipient, recipientKey)
+		if err == nil {
+			return content, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		return nil, errors.New("pkcs12: envelopedData has no recipient identified by issuer and serial number")
+	}
+	return nil, errors.New("pkcs12: error decrypting envelopedData: " + lastErr.Error())
+}
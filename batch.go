@@ -0,0 +1,60 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// An EncodeJob holds the arguments of one call to [Encoder.Encode] made by
+// [EncodeBatch].
+type EncodeJob struct {
+	PrivateKey  interface{}
+	Certificate *smx509.Certificate
+	CACerts     []*smx509.Certificate
+	Password    string
+}
+
+// EncodeBatch calls enc.Encode for each of jobs, running up to concurrency
+// of them at the same time, or [runtime.GOMAXPROCS] of them if concurrency
+// is less than 1.  pfxData[i] and errs[i] are the results of jobs[i]; a job
+// that fails doesn't stop the others.
+//
+// As Encoders are immutable, enc may be shared by the jobs; however, the
+// random number generators set with [Encoder.WithRand],
+// [Encoder.WithSaltRand] and [Encoder.WithIVRand] must then be safe for
+// concurrent use, as [crypto/rand.Reader] is.
+func EncodeBatch(enc *Encoder, jobs []EncodeJob, concurrency int) (pfxData [][]byte, errs []error) {
+	if concurrency < 1 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	if concurrency > len(jobs) {
+		concurrency = len(jobs)
+	}
+
+	pfxData = make([][]byte, len(jobs))
+	errs = make([]error, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				job := &jobs[i]
+				pfxData[i], errs[i] = enc.Encode(job.PrivateKey, job.Certificate, job.CACerts, job.Password)
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return pfxData, errs
+}
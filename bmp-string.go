@@ -5,11 +5,18 @@
 package pkcs12
 
 import (
+	"encoding/asn1"
 	"errors"
 	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // bmpStringZeroTerminated returns s encoded in UCS-2 with a zero terminator.
+// Control characters, including NUL, are encoded like any other character.
+// If s is not valid UTF-8, e.g. because it is a machine-generated password
+// made of random bytes, every invalid byte is encoded as U+FFFD, as earlier
+// releases did; OpenSSL encodes such a password byte by byte instead, which
+// decoding also tries (see [DecodeOptions.newKeyDeriverFor]).
 func bmpStringZeroTerminated(s string) ([]byte, error) {
 	// References:
 	// https://tools.ietf.org/html/rfc7292#appendix-B.1
@@ -23,26 +30,64 @@ func bmpStringZeroTerminated(s string) ([]byte, error) {
 	return append(ret, 0, 0), nil
 }
 
+// bmpStringZeroTerminatedBytes is like bmpStringZeroTerminated, but for a
+// string held in a byte slice, which it doesn't copy.
+func bmpStringZeroTerminatedBytes(b []byte) ([]byte, error) {
+	ret := make([]byte, 0, 2*len(b)+2)
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		b = b[size:]
+		var err error
+		if ret, err = appendBMPRune(ret, r); err != nil {
+			return nil, err
+		}
+	}
+	return append(ret, 0, 0), nil
+}
+
 // bmpString returns s encoded in UCS-2
 func bmpString(s string) ([]byte, error) {
 	// References:
 	// https://tools.ietf.org/html/rfc7292#appendix-B.1
-	// https://en.wikipedia.org/wiki/Plane_(Unicode)#Basic_Multilingual_Plane
-	//  - non-BMP characters are encoded in UTF 16 by using a surrogate pair of 16-bit codes
-	//	  EncodeRune returns 0xfffd if the rune does not need special encoding
 
 	ret := make([]byte, 0, 2*len(s)+2)
 
 	for _, r := range s {
-		if t, _ := utf16.EncodeRune(r); t != 0xfffd {
-			return nil, errors.New("pkcs12: string contains characters that cannot be encoded in UCS-2")
+		var err error
+		if ret, err = appendBMPRune(ret, r); err != nil {
+			return nil, err
 		}
-		ret = append(ret, byte(r/256), byte(r%256))
 	}
 
 	return ret, nil
 }
 
+// appendBMPRune appends r encoded in UCS-2 to b.
+func appendBMPRune(b []byte, r rune) ([]byte, error) {
+	// References:
+	// https://en.wikipedia.org/wiki/Plane_(Unicode)#Basic_Multilingual_Plane
+	//  - non-BMP characters are encoded in UTF 16 by using a surrogate pair of 16-bit codes
+	//	  EncodeRune returns 0xfffd if the rune does not need special encoding
+
+	if t, _ := utf16.EncodeRune(r); t != 0xfffd {
+		return nil, errors.New("pkcs12: string contains characters that cannot be encoded in UCS-2")
+	}
+	return append(b, byte(r/256), byte(r%256)), nil
+}
+
+// bytewiseBMPStringZeroTerminated returns every byte of s encoded as a
+// separate UCS-2 character, with a zero terminator.  This is how OpenSSL
+// before 1.1.0, and some other older implementations, encoded passwords:
+// a UTF-8 password was treated as Latin-1, so each UTF-8 byte of a non-ASCII
+// character became its own BMP character.
+func bytewiseBMPStringZeroTerminated(s string) []byte {
+	ret := make([]byte, 0, 2*len(s)+2)
+	for i := 0; i < len(s); i++ {
+		ret = append(ret, 0, s[i])
+	}
+	return append(ret, 0, 0)
+}
+
 func decodeBMPString(bmpString []byte) (string, error) {
 	if len(bmpString)%2 != 0 {
 		return "", errors.New("pkcs12: odd-length BMP string")
@@ -61,3 +106,30 @@ func decodeBMPString(bmpString []byte) (string, error) {
 
 	return string(utf16.Decode(s)), nil
 }
+
+// decodeAttributeString decodes the string value of an attribute such as
+// friendlyName.  It should be a BMPString, but some producers use a
+// UTF8String, an IA5String or a PrintableString instead.
+func decodeAttributeString(value asn1.RawValue) (string, error) {
+	if value.Class != asn1.ClassUniversal {
+		return "", errors.New("pkcs12: attribute value is not a string")
+	}
+	switch value.Tag {
+	case asn1.TagBMPString:
+		return decodeBMPString(value.Bytes)
+	case asn1.TagUTF8String:
+		if !utf8.Valid(value.Bytes) {
+			return "", errors.New("pkcs12: invalid UTF8String in attribute")
+		}
+		return string(value.Bytes), nil
+	case asn1.TagIA5String, asn1.TagPrintableString:
+		for _, b := range value.Bytes {
+			if b >= utf8.RuneSelf {
+				return "", errors.New("pkcs12: non-ASCII character in attribute string")
+			}
+		}
+		return string(value.Bytes), nil
+	default:
+		return "", errors.New("pkcs12: unsupported string type in attribute")
+	}
+}
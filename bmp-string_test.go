@@ -6,6 +6,7 @@ package pkcs12
 
 import (
 	"bytes"
+	"encoding/asn1"
 	"encoding/hex"
 	"testing"
 )
@@ -24,6 +25,8 @@ var bmpStringTests = []struct {
 	// Some characters from the "Letterlike Symbols Unicode block".
 	{"\u2115 - Double-struck N", "21150020002d00200044006f00750062006c0065002d00730074007200750063006b0020004e0000", true, false},
 	{"\u2115 - Double-struck N", "21150020002d00200044006f00750062006c0065002d00730074007200750063006b0020004e", false, false},
+	// Control characters, including NUL, are encoded like any other.
+	{"\x00a\x01\x1b", "000000610001001b0000", true, false},
 	// any character outside the BMP should trigger an error.
 	{"\U0001f000 East wind (Mahjong)", "", true, true},
 	{"\U0001f000 East wind (Mahjong)", "", false, true},
@@ -73,3 +76,38 @@ func TestBMPString(t *testing.T) {
 		}
 	}
 }
+
+func TestBytewiseBMPString(t *testing.T) {
+	expected, _ := hex.DecodeString("0061" + "00c3" + "00a4" + "0000")
+	if actual := bytewiseBMPStringZeroTerminated("aä"); !bytes.Equal(actual, expected) {
+		t.Errorf("expected %x, got %x", expected, actual)
+	}
+}
+
+func TestDecodeAttributeString(t *testing.T) {
+	for _, test := range []struct {
+		value      asn1.RawValue
+		expected   string
+		shouldFail bool
+	}{
+		{asn1.RawValue{Tag: asn1.TagBMPString, Bytes: []byte{0, 'a', 0, 0xe4}}, "a\u00e4", false},
+		{asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte("a\u00e4")}, "a\u00e4", false},
+		{asn1.RawValue{Tag: asn1.TagIA5String, Bytes: []byte("alias")}, "alias", false},
+		{asn1.RawValue{Tag: asn1.TagPrintableString, Bytes: []byte("alias")}, "alias", false},
+		{asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte{0xff}}, "", true},
+		{asn1.RawValue{Tag: asn1.TagIA5String, Bytes: []byte("a\u00e4")}, "", true},
+		{asn1.RawValue{Tag: asn1.TagOctetString, Bytes: []byte("alias")}, "", true},
+		{asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: asn1.TagUTF8String, Bytes: []byte("alias")}, "", true},
+	} {
+		actual, err := decodeAttributeString(test.value)
+		if test.shouldFail {
+			if err == nil {
+				t.Errorf("tag %d: expected an error, got %q", test.value.Tag, actual)
+			}
+			continue
+		}
+		if err != nil || actual != test.expected {
+			t.Errorf("tag %d: expected %q, got %q (%v)", test.value.Tag, test.expected, actual, err)
+		}
+	}
+}
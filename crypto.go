@@ -10,11 +10,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
+	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 
@@ -28,6 +30,7 @@ var (
 	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 1, 3}) // rfc7292#appendix-C PBE-SHA1-3DES
 	oidPBEWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 1, 5}) // rfc7292#appendix-C PBE-SHA1-RC2-128
 	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 1, 6}) // rfc7292#appendix-C PBE-SHA1-RC2-40
+	oidPBEWithMD5AndDESCBC           = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 5, 3})     // rfc8018#appendix-A.3 PBE-MD5-DES, decoding only
 	oidPBES2                         = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 5, 13})
 	oidPBKDF2                        = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 5, 12})
 	oidHmacWithSHA1                  = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 2, 7})
@@ -56,11 +59,11 @@ func (shaWithTripleDESCBC) create(key []byte) (cipher.Block, error) {
 }
 
 func (shaWithTripleDESCBC) deriveKey(salt, password []byte, iterations int) []byte {
-	return pbkdf(sha1Sum, 20, 64, salt, password, iterations, 1, 24)
+	return pbkdf(sha1.New, 20, 64, salt, password, iterations, 1, 24)
 }
 
 func (shaWithTripleDESCBC) deriveIV(salt, password []byte, iterations int) []byte {
-	return pbkdf(sha1Sum, 20, 64, salt, password, iterations, 2, 8)
+	return pbkdf(sha1.New, 20, 64, salt, password, iterations, 2, 8)
 }
 
 type shaWith128BitRC2CBC struct{}
@@ -70,11 +73,11 @@ func (shaWith128BitRC2CBC) create(key []byte) (cipher.Block, error) {
 }
 
 func (shaWith128BitRC2CBC) deriveKey(salt, password []byte, iterations int) []byte {
-	return pbkdf(sha1Sum, 20, 64, salt, password, iterations, 1, 16)
+	return pbkdf(sha1.New, 20, 64, salt, password, iterations, 1, 16)
 }
 
 func (shaWith128BitRC2CBC) deriveIV(salt, password []byte, iterations int) []byte {
-	return pbkdf(sha1Sum, 20, 64, salt, password, iterations, 2, 8)
+	return pbkdf(sha1.New, 20, 64, salt, password, iterations, 2, 8)
 }
 
 type shaWith40BitRC2CBC struct{}
@@ -84,11 +87,40 @@ func (shaWith40BitRC2CBC) create(key []byte) (cipher.Block, error) {
 }
 
 func (shaWith40BitRC2CBC) deriveKey(salt, password []byte, iterations int) []byte {
-	return pbkdf(sha1Sum, 20, 64, salt, password, iterations, 1, 5)
+	return pbkdf(sha1.New, 20, 64, salt, password, iterations, 1, 5)
 }
 
 func (shaWith40BitRC2CBC) deriveIV(salt, password []byte, iterations int) []byte {
-	return pbkdf(sha1Sum, 20, 64, salt, password, iterations, 2, 8)
+	return pbkdf(sha1.New, 20, 64, salt, password, iterations, 2, 8)
+}
+
+// md5WithDESCBC is the PBES1 scheme pbeWithMD5AndDES-CBC (rfc8018#section-6.1),
+// found in files exported before PKCS#12 defined its own PBE algorithms.
+//
+// It is INSECURE: its 56-bit DES key can be recovered by brute force
+// regardless of the password, and it is only supported to read historical
+// data.  It is never used for encoding.
+type md5WithDESCBC struct{}
+
+func (md5WithDESCBC) create(key []byte) (cipher.Block, error) {
+	return des.NewCipher(key)
+}
+
+func (md5WithDESCBC) deriveKey(salt, password []byte, iterations int) []byte {
+	return pbkdf1MD5(salt, password, iterations)[:8]
+}
+
+func (md5WithDESCBC) deriveIV(salt, password []byte, iterations int) []byte {
+	return pbkdf1MD5(salt, password, iterations)[8:]
+}
+
+// pbkdf1MD5 implements PBKDF1 (rfc8018#section-5.1) with MD5.
+func pbkdf1MD5(salt, password []byte, iterations int) []byte {
+	dk := md5.Sum(append(append([]byte(nil), password...), salt...))
+	for i := 1; i < iterations; i++ {
+		dk = md5.Sum(dk[:])
+	}
+	return dk[:]
 }
 
 type pbeParams struct {
@@ -96,7 +128,9 @@ type pbeParams struct {
 	Iterations int
 }
 
-func pbeCipherFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher.Block, []byte, error) {
+// pbeCipherFor returns a cipher.Block and IV for the given algorithm and
+// password.  Keys are derived through kd, which may be nil.
+func pbeCipherFor(algorithm pkix.AlgorithmIdentifier, password []byte, kd *keyDeriver) (cipher.Block, []byte, error) {
 	var cipherType pbeCipher
 
 	switch {
@@ -106,28 +140,48 @@ func pbeCipherFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher.B
 		cipherType = shaWith128BitRC2CBC{}
 	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
 		cipherType = shaWith40BitRC2CBC{}
+	case algorithm.Algorithm.Equal(oidPBEWithMD5AndDESCBC):
+		// Like PBES2, PBES1 takes the password as an octet string rather
+		// than as a BMPString.
+		octetStringPassword, err := kd.octetStringPassword(password)
+		if err != nil {
+			return nil, nil, err
+		}
+		password = octetStringPassword
+		cipherType = md5WithDESCBC{}
 	case algorithm.Algorithm.Equal(oidPBES2):
 		// rfc7292#appendix-B.1 (the original PKCS#12 PBE) requires passwords formatted as BMPStrings.
 		// However, rfc8018#section-3 recommends that the password for PBES2 follow ASCII or UTF-8.
 		// This is also what Windows expects.
 		// Therefore, we convert the password to UTF-8.
-		originalPassword, err := decodeBMPString(password)
+		utf8Password, err := kd.octetStringPassword(password)
 		if err != nil {
 			return nil, nil, err
 		}
-		utf8Password := []byte(originalPassword)
-		return pbes2CipherFor(algorithm, utf8Password)
+		return pbes2CipherFor(algorithm, utf8Password, kd)
 	default:
 		return nil, nil, NotImplementedError("algorithm " + algorithm.Algorithm.String() + " is not supported")
 	}
+	kd.warn(WarningLegacyPBES1, "contents are encrypted with legacy algorithm "+algorithm.Algorithm.String())
 
 	var params pbeParams
 	if err := unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
 		return nil, nil, err
 	}
+	kd.describeEncryption(oidName(algorithm.Algorithm) + ", " + pluralize(params.Iterations, "iteration"))
 
-	key := cipherType.deriveKey(params.Salt, password, params.Iterations)
-	iv := cipherType.deriveIV(params.Salt, password, params.Iterations)
+	key, err := kd.derive(fmt.Sprintf("%v key %x %d", algorithm.Algorithm, params.Salt, params.Iterations), password, func() []byte {
+		return cipherType.deriveKey(params.Salt, password, params.Iterations)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	iv, err := kd.derive(fmt.Sprintf("%v iv %x %d", algorithm.Algorithm, params.Salt, params.Iterations), password, func() []byte {
+		return cipherType.deriveIV(params.Salt, password, params.Iterations)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
 	block, err := cipherType.create(key)
 	if err != nil {
@@ -137,8 +191,8 @@ func pbeCipherFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher.B
 	return block, iv, nil
 }
 
-func pbDecrypterFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher.BlockMode, int, error) {
-	block, iv, err := pbeCipherFor(algorithm, password)
+func pbDecrypterFor(algorithm pkix.AlgorithmIdentifier, password []byte, kd *keyDeriver) (cipher.BlockMode, int, error) {
+	block, iv, err := pbeCipherFor(algorithm, password, kd)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -146,8 +200,10 @@ func pbDecrypterFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher
 	return cipher.NewCBCDecrypter(block, iv), block.BlockSize(), nil
 }
 
-func pbDecrypt(info decryptable, password []byte) (decrypted []byte, err error) {
-	cbc, blockSize, err := pbDecrypterFor(info.Algorithm(), password)
+// pbDecrypt decrypts info with a key derived from password through kd, which
+// may be nil.
+func pbDecrypt(info decryptable, password []byte, kd *keyDeriver) (decrypted []byte, err error) {
+	cbc, blockSize, err := pbDecrypterFor(info.Algorithm(), password, kd)
 	if err != nil {
 		return nil, err
 	}
@@ -201,14 +257,30 @@ type pbes2Params struct {
 type pbkdf2Params struct {
 	Salt       asn1.RawValue
 	Iterations int
-	KeyLength  int `asn1:"optional"`
-	Prf        pkix.AlgorithmIdentifier
+	KeyLength  int                      `asn1:"optional"`
+	Prf        pkix.AlgorithmIdentifier `asn1:"optional"` // absent for the default, hmacWithSHA1
+}
+
+// prfFor returns the hash function of the HMAC-based PBKDF2 PRF identified by
+// oid.  An empty oid denotes the default PRF, HMAC-SHA-1.
+func prfFor(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case oid.Equal(oidHmacWithSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidHmacWithSM3):
+		return sm3.New, nil
+	case oid.Equal(oidHmacWithSHA1):
+		return sha1.New, nil
+	case len(oid) == 0:
+		return sha1.New, nil
+	}
+	return nil, NotImplementedError("prf " + oid.String() + " is not supported")
 }
 
 // pbes2CipherFor returns a cipher.Block for the given PBES2-params and password.
 // It only supports PBKDF2 with HMAC-SHA1, HMAC-SHA256, and HMAC-SM3.
 // EncryptionScheme only supports AES-128-CBC, AES-192-CBC, AES-256-CBC, and SM4-CBC.
-func pbes2CipherFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher.Block, []byte, error) {
+func pbes2CipherFor(algorithm pkix.AlgorithmIdentifier, password []byte, kd *keyDeriver) (cipher.Block, []byte, error) {
 	var params pbes2Params
 	if err := unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
 		return nil, nil, err
@@ -226,17 +298,8 @@ func pbes2CipherFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher
 		return nil, nil, errors.New("pkcs12: only octet string salts are supported for pbkdf2")
 	}
 
-	var prf func() hash.Hash
-	switch {
-	case kdfParams.Prf.Algorithm.Equal(oidHmacWithSHA256):
-		prf = sha256.New
-	case kdfParams.Prf.Algorithm.Equal(oidHmacWithSM3):
-		prf = sm3.New
-	case kdfParams.Prf.Algorithm.Equal(oidHmacWithSHA1):
-		prf = sha1.New
-	case kdfParams.Prf.Algorithm.Equal(asn1.ObjectIdentifier([]int{})):
-		prf = sha1.New
-	default:
+	prf, err := prfFor(kdfParams.Prf.Algorithm)
+	if err != nil {
 		return nil, nil, NotImplementedError("pbes2 prf " + kdfParams.Prf.Algorithm.String() + " is not supported")
 	}
 
@@ -251,8 +314,25 @@ func pbes2CipherFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher
 	default:
 		return nil, nil, NotImplementedError("pbes2 algorithm " + params.EncryptionScheme.Algorithm.String() + " is not supported")
 	}
+	// Like for PBMAC1, an explicit key length takes precedence: some
+	// writers pair e.g. AES-256-CBC with a 16-byte key.
+	if kdfParams.KeyLength < 0 || kdfParams.KeyLength > 32 {
+		return nil, nil, errors.New("pkcs12: invalid pbkdf2 key length")
+	} else if kdfParams.KeyLength != 0 {
+		keyLen = kdfParams.KeyLength
+	}
 
-	key := pbkdf2.Key(password, kdfParams.Salt.Bytes, kdfParams.Iterations, keyLen, prf)
+	key, err := kd.derive(fmt.Sprintf("pbkdf2 %v %x %d %d", kdfParams.Prf.Algorithm, kdfParams.Salt.Bytes, kdfParams.Iterations, keyLen), password, func() []byte {
+		return pbkdf2.Key(password, kdfParams.Salt.Bytes, kdfParams.Iterations, keyLen, prf)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	prfOID := kdfParams.Prf.Algorithm
+	if len(prfOID) == 0 {
+		prfOID = oidHmacWithSHA1
+	}
+	kd.describeEncryption("PBES2/PBKDF2-" + oidName(prfOID) + "/" + oidName(params.EncryptionScheme.Algorithm) + ", " + pluralize(kdfParams.Iterations, "iteration"))
 	iv := params.EncryptionScheme.Parameters.Bytes
 
 	var block cipher.Block
@@ -272,9 +352,144 @@ func pbes2CipherFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher
 	default:
 		return nil, nil, NotImplementedError("pbes2 algorithm " + params.EncryptionScheme.Algorithm.String() + " is not supported")
 	}
+	// cipher.NewCBCDecrypter panics on an IV of the wrong length
+	if len(iv) != block.BlockSize() {
+		return nil, nil, errors.New("pkcs12: pbes2 IV length does not match the cipher block size")
+	}
 	return block, iv, nil
 }
 
+// pbes2BlockSize returns the block size, and thus the IV length, of the
+// PBES2 encryption scheme encryptionScheme.
+func pbes2BlockSize(encryptionScheme asn1.ObjectIdentifier) (int, error) {
+	switch {
+	case encryptionScheme.Equal(oidAES256CBC) || encryptionScheme.Equal(oidAES192CBC) || encryptionScheme.Equal(oidAES128CBC):
+		return aes.BlockSize, nil
+	case encryptionScheme.Equal(oidSM4CBC):
+		return sm4.BlockSize, nil
+	default:
+		return 0, NotImplementedError("pbes2 algorithm " + encryptionScheme.String() + " is not supported")
+	}
+}
+
+// defaultMaxKeyDerivations is the default of
+// [DecodeOptions.MaxKeyDerivations].
+const defaultMaxKeyDerivations = 128
+
+// keyDeriver derives the decryption keys of a single PFX.  It remembers the
+// keys it derived, so that contents sharing the same KDF parameters don't
+// cost another derivation, and fails once it has derived its maximum number
+// of keys, to bound the cost of decoding a file made of many small encrypted
+// blocks.  A nil *keyDeriver derives every key, without limit.
+type keyDeriver struct {
+	maxDerivations int // negative for no limit
+	derivations    int
+	keys           map[string][]derivedKey // by KDF parameters
+	warnings       []Warning               // about the algorithms that keys are derived for
+	encryptions    []string                // descriptions of the encryptions that keys are derived for
+	integrity      string                  // description of the MAC or signature
+
+	// bytewisePassword is the byte-by-byte BMPString encoding of a
+	// password that isn't valid UTF-8, which can't be recovered from its
+	// BMPString encoding; see fallbackPasswordsFor.
+	bytewisePassword []byte
+
+	// fallbackPassword is the encoding other than the BMPString encoding
+	// bmpPassword that the MAC was computed with, if any; see
+	// matchedPassword.
+	fallbackPassword, bmpPassword []byte
+}
+
+// matchedPassword records that the MAC was computed with matched, an
+// encoding of the BMPString password bmpPassword, and returns matched.
+// Keys of the PKCS#12 PBE algorithms are derived from matched, but PBES1
+// and PBES2 take the password as an octet string, which can only be
+// recovered from bmpPassword; see octetStringPassword.
+func (kd *keyDeriver) matchedPassword(matched, bmpPassword []byte) []byte {
+	if !bytes.Equal(matched, bmpPassword) {
+		kd.fallbackPassword, kd.bmpPassword = matched, bmpPassword
+	}
+	return matched
+}
+
+// octetStringPassword returns the octet string password used by PBES1 and
+// PBES2 for the encoded password.
+func (kd *keyDeriver) octetStringPassword(password []byte) ([]byte, error) {
+	if kd != nil && kd.fallbackPassword != nil && bytes.Equal(password, kd.fallbackPassword) {
+		password = kd.bmpPassword
+	}
+	originalPassword, err := decodeBMPString(password)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(originalPassword), nil
+}
+
+// describeEncryption records the description of an encryption, unless an
+// identical one was already recorded.
+func (kd *keyDeriver) describeEncryption(description string) {
+	if kd == nil {
+		return
+	}
+	for _, d := range kd.encryptions {
+		if d == description {
+			return
+		}
+	}
+	kd.encryptions = append(kd.encryptions, description)
+}
+
+// describeIntegrity records the description of the MAC or signature.
+func (kd *keyDeriver) describeIntegrity(description string) {
+	if kd != nil {
+		kd.integrity = description
+	}
+}
+
+// warn records a warning, unless an identical one was already recorded.
+func (kd *keyDeriver) warn(kind WarningKind, message string) {
+	if kd == nil {
+		return
+	}
+	for _, w := range kd.warnings {
+		if w.Kind == kind && w.Message == message {
+			return
+		}
+	}
+	kd.warnings = append(kd.warnings, Warning{Kind: kind, Message: message})
+}
+
+// A derivedKey is a key that a keyDeriver derived from password.
+type derivedKey struct {
+	password []byte
+	key      []byte
+}
+
+func newKeyDeriver(maxDerivations int) *keyDeriver {
+	return &keyDeriver{maxDerivations: maxDerivations, keys: make(map[string][]derivedKey)}
+}
+
+// derive returns the key derived from password with the KDF parameters
+// identified by id, calling f to derive it if it hasn't been derived before.
+// The password isn't part of id, so that it doesn't end up in the map keys.
+func (kd *keyDeriver) derive(id string, password []byte, f func() []byte) ([]byte, error) {
+	if kd == nil {
+		return f(), nil
+	}
+	for _, k := range kd.keys[id] {
+		if bytes.Equal(k.password, password) {
+			return k.key, nil
+		}
+	}
+	if kd.maxDerivations >= 0 && kd.derivations >= kd.maxDerivations {
+		return nil, errors.New("pkcs12: too many key derivations")
+	}
+	kd.derivations++
+	key := f()
+	kd.keys[id] = append(kd.keys[id], derivedKey{password: append([]byte(nil), password...), key: key})
+	return key, nil
+}
+
 // decryptable abstracts an object that contains ciphertext.
 type decryptable interface {
 	Algorithm() pkix.AlgorithmIdentifier
@@ -282,7 +497,11 @@ type decryptable interface {
 }
 
 func pbEncrypterFor(algorithm pkix.AlgorithmIdentifier, password []byte) (cipher.BlockMode, int, error) {
-	block, iv, err := pbeCipherFor(algorithm, password)
+	if algorithm.Algorithm.Equal(oidPBEWithMD5AndDESCBC) {
+		return nil, 0, NotImplementedError("algorithm " + algorithm.Algorithm.String() + " is only supported for decoding")
+	}
+
+	block, iv, err := pbeCipherFor(algorithm, password, nil)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -313,12 +532,17 @@ type encryptable interface {
 	SetData([]byte)
 }
 
-// makePBES2Parameters creates a PBES2-params structure.
-func makePBES2Parameters(prf, encryptionScheme asn1.ObjectIdentifier, rand io.Reader, salt []byte, iterations int) ([]byte, error) {
+// makePBES2Parameters creates a PBES2-params structure.  If nullParams is
+// true, the PRF has explicit NULL parameters rather than none.
+func makePBES2Parameters(prf, encryptionScheme asn1.ObjectIdentifier, rand io.Reader, salt []byte, iterations int, nullParams bool) ([]byte, error) {
 	var err error
 
-	randomIV := make([]byte, 16) // AES/SM4 block size
-	if _, err := rand.Read(randomIV); err != nil {
+	blockSize, err := pbes2BlockSize(encryptionScheme)
+	if err != nil {
+		return nil, err
+	}
+	randomIV := make([]byte, blockSize)
+	if _, err := io.ReadFull(rand, randomIV); err != nil {
 		return nil, err
 	}
 
@@ -327,7 +551,14 @@ func makePBES2Parameters(prf, encryptionScheme asn1.ObjectIdentifier, rand io.Re
 		return nil, err
 	}
 	kdfparams.Iterations = iterations
-	kdfparams.Prf.Algorithm = prf
+	// DER requires the DEFAULT hmacWithSHA1 to be omitted, and strict
+	// readers reject it when it is present.
+	if !prf.Equal(oidHmacWithSHA1) {
+		kdfparams.Prf.Algorithm = prf
+		if nullParams {
+			kdfparams.Prf.Parameters = asn1.NullRawValue
+		}
+	}
 
 	var params pbes2Params
 	params.Kdf.Algorithm = oidPBKDF2
@@ -7,6 +7,7 @@ package pkcs12
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"testing"
@@ -28,13 +29,13 @@ func TestPbDecrypterFor(t *testing.T) {
 
 	pass, _ := bmpStringZeroTerminated("Sesame open")
 
-	_, _, err := pbDecrypterFor(alg, pass)
+	_, _, err := pbDecrypterFor(alg, pass, nil)
 	if _, ok := err.(NotImplementedError); !ok {
 		t.Errorf("expected not implemented error, got: %T %s", err, err)
 	}
 
 	alg.Algorithm = sha1WithTripleDES
-	cbc, blockSize, err := pbDecrypterFor(alg, pass)
+	cbc, blockSize, err := pbDecrypterFor(alg, pass, nil)
 	if err != nil {
 		t.Errorf("unexpected error from pbDecrypterFor %v", err)
 	}
@@ -127,7 +128,7 @@ func TestPbDecrypt(t *testing.T) {
 		}
 		password, _ := bmpStringZeroTerminated("sesame")
 
-		plaintext, err := pbDecrypt(decryptable, password)
+		plaintext, err := pbDecrypt(decryptable, password, nil)
 		if err != test.expectedError {
 			t.Errorf("#%d: got error %q, but wanted %q", i, err, test.expectedError)
 			continue
@@ -172,6 +173,75 @@ func TestPbEncrypt(t *testing.T) {
 	}
 }
 
+func TestPBES2DefaultPRFOmitted(t *testing.T) {
+	for _, prf := range []asn1.ObjectIdentifier{oidHmacWithSHA1, oidHmacWithSHA256, oidHmacWithSM3} {
+		der, err := makePBES2Parameters(prf, oidAES256CBC, bytes.NewReader(make([]byte, 16)), []byte("saltsalt"), 2048, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var params pbes2Params
+		if err := unmarshal(der, &params); err != nil {
+			t.Fatal(err)
+		}
+		var kdfParams pbkdf2Params
+		if err := unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams); err != nil {
+			t.Fatal(err)
+		}
+		if prf.Equal(oidHmacWithSHA1) {
+			if kdfParams.Prf.Algorithm != nil {
+				t.Errorf("default PRF %v was written explicitly", prf)
+			}
+		} else if !kdfParams.Prf.Algorithm.Equal(prf) {
+			t.Errorf("got PRF %v, want %v", kdfParams.Prf.Algorithm, prf)
+		}
+
+		// the parameters still decrypt with the right PRF
+		alg := pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: der}}
+		p, _ := bmpStringZeroTerminated("sesame")
+		td := testDecryptable{algorithm: alg}
+		if err := pbEncrypt(&td, []byte("A secret!"), p); err != nil {
+			t.Fatal(err)
+		}
+		if decrypted, err := pbDecrypt(td, p, nil); err != nil || string(decrypted) != "A secret!" {
+			t.Errorf("%v: got %q, %v", prf, decrypted, err)
+		}
+	}
+}
+
+func TestPBES2IVLength(t *testing.T) {
+	p, _ := bmpStringZeroTerminated("sesame")
+	for _, scheme := range []asn1.ObjectIdentifier{oidAES128CBC, oidAES192CBC, oidAES256CBC, oidSM4CBC} {
+		der, err := makePBES2Parameters(oidHmacWithSHA256, scheme, rand.Reader, []byte("saltsalt"), 2048, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alg := pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: der}}
+		block, iv, err := pbes2CipherFor(alg, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(iv) != block.BlockSize() {
+			t.Errorf("%v: got a %d-byte IV, want %d bytes", scheme, len(iv), block.BlockSize())
+		}
+
+		// an IV of the wrong length is an error rather than a panic
+		var params pbes2Params
+		if err := unmarshal(der, &params); err != nil {
+			t.Fatal(err)
+		}
+		if params.EncryptionScheme.Parameters.FullBytes, err = asn1.Marshal(iv[:8]); err != nil {
+			t.Fatal(err)
+		}
+		if alg.Parameters.FullBytes, err = asn1.Marshal(params); err != nil {
+			t.Fatal(err)
+		}
+		td := testDecryptable{algorithm: alg, data: make([]byte, 32)}
+		if _, err := pbDecrypt(td, p, nil); err == nil {
+			t.Errorf("%v: expected an error for an 8-byte IV", scheme)
+		}
+	}
+}
+
 type testDecryptable struct {
 	data      []byte
 	algorithm pkix.AlgorithmIdentifier
@@ -192,3 +262,31 @@ func (params pbeParams) RawASN1() (raw asn1.RawValue) {
 	}
 	return
 }
+
+func TestKeyDeriverCache(t *testing.T) {
+	kd := newKeyDeriver(2)
+	calls := 0
+	derive := func(password string) []byte {
+		key, err := kd.derive("params", []byte(password), func() []byte {
+			calls++
+			return []byte("key for " + password)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	if key := derive("a"); string(key) != "key for a" || calls != 1 {
+		t.Fatalf("got %q after %d derivations", key, calls)
+	}
+	if key := derive("a"); string(key) != "key for a" || calls != 1 {
+		t.Fatalf("cached key: got %q after %d derivations", key, calls)
+	}
+	// the same parameters with another password are another key
+	if key := derive("b"); string(key) != "key for b" || calls != 2 {
+		t.Fatalf("other password: got %q after %d derivations", key, calls)
+	}
+	if _, err := kd.derive("params", []byte("c"), func() []byte { return nil }); err == nil {
+		t.Error("expected an error past the maximum number of derivations")
+	}
+}
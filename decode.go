@@ -0,0 +1,139 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// DecodeSigner is like [Decode], but returns the private key as a
+// [crypto.Signer].  All the private key types that this package decodes
+// implement crypto.Signer.
+func DecodeSigner(pfxData []byte, password string) (signer crypto.Signer, certificate *smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeSigner(pfxData, password)
+}
+
+// DecodeSigner is like the package-level [DecodeSigner], but uses the options in opts.
+func (opts *DecodeOptions) DecodeSigner(pfxData []byte, password string) (signer crypto.Signer, certificate *smx509.Certificate, err error) {
+	privateKey, certificate, err := opts.Decode(pfxData, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, NotImplementedError(fmt.Sprintf("private key of type %T is not a crypto.Signer", privateKey))
+	}
+	return signer, certificate, nil
+}
+
+// DecodeDecrypter is like [Decode], but returns the private key as a
+// [crypto.Decrypter].  Only RSA and SM2 private keys implement
+// crypto.Decrypter; for other keys, DecodeDecrypter returns an error.
+func DecodeDecrypter(pfxData []byte, password string) (decrypter crypto.Decrypter, certificate *smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeDecrypter(pfxData, password)
+}
+
+// DecodeDecrypter is like the package-level [DecodeDecrypter], but uses the options in opts.
+func (opts *DecodeOptions) DecodeDecrypter(pfxData []byte, password string) (decrypter crypto.Decrypter, certificate *smx509.Certificate, err error) {
+	privateKey, certificate, err := opts.Decode(pfxData, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypter, ok := privateKey.(crypto.Decrypter)
+	if !ok {
+		return nil, nil, NotImplementedError(fmt.Sprintf("private key of type %T is not a crypto.Decrypter", privateKey))
+	}
+	return decrypter, certificate, nil
+}
+
+// DecodeChainDER is like [DecodeChain], but returns the private key as its
+// PKCS#8 encoding and the certificates as the concatenation of their DER
+// encodings, the end-entity certificate first and then the CA certificates,
+// for APIs that take a chain in this form.  Both are the bytes found in
+// pfxData, after decryption, rather than re-encodings; the certificates
+// can be parsed back with [smx509.ParseCertificates].
+func DecodeChainDER(pfxData []byte, password string) (keyDER []byte, chainDER []byte, err error) {
+	return defaultDecodeOptions.DecodeChainDER(pfxData, password)
+}
+
+// DecodeChainDER is like the package-level [DecodeChainDER], but uses the options in opts.
+func (opts *DecodeOptions) DecodeChainDER(pfxData []byte, password string) (keyDER []byte, chainDER []byte, err error) {
+	_, certificate, caCerts, info, err := opts.DecodeChainWithInfo(pfxData, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	chainDER = append(chainDER, certificate.Raw...)
+	for _, cert := range caCerts {
+		chainDER = append(chainDER, cert.Raw...)
+	}
+	return info.keyDER, chainDER, nil
+}
+
+// DecodeCertificate returns the end-entity certificate in pfxData, that is
+// the certificate associated with the private key by their localKeyId
+// attributes, or the first certificate if there is no such association.
+// The MAC is verified with password and the certificates are decrypted, but
+// the private key is neither decrypted nor parsed, and neither are the other
+// certificates.  It is meant for showing e.g. the subject and expiry of the
+// certificate without handling key material.
+func DecodeCertificate(pfxData []byte, password string) (certificate *smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeCertificate(pfxData, password)
+}
+
+// DecodeCertificate is like the package-level [DecodeCertificate], but uses the options in opts.
+func (opts *DecodeOptions) DecodeCertificate(pfxData []byte, password string) (certificate *smx509.Certificate, err error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, opts.passwordError(pfxData, err)
+	}
+
+	bags, _, err := opts.getSafeContents(pfxData, encodedPassword, opts.newKeyDeriverFor(password), 1, opts.maxContentInfos())
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []*safeBag
+	var keyID []byte
+	for i := range bags {
+		bag := &bags[i]
+		switch {
+		case bag.Id.Equal(oidCertBag):
+			certBags = append(certBags, bag)
+		case bag.Id.Equal(oidKeyBag), bag.Id.Equal(oidPKCS8ShroundedKeyBag):
+			keyID = bag.localKeyID()
+		}
+	}
+	if len(certBags) == 0 {
+		return nil, errors.New("pkcs12: certificate missing")
+	}
+
+	leaf := certBags[0]
+	if len(keyID) != 0 {
+		for _, bag := range certBags {
+			if bytes.Equal(bag.localKeyID(), keyID) {
+				leaf = bag
+				break
+			}
+		}
+	}
+
+	certsData, err := decodeCertBag(leaf.Value.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	parsedCerts, err := smx509.ParseCertificates(certsData)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsedCerts) != 1 {
+		return nil, errors.New("pkcs12: expected exactly one certificate in the certBag")
+	}
+	return parsedCerts[0], nil
+}
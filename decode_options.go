@@ -0,0 +1,200 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"encoding/asn1"
+	"math"
+	"unicode/utf8"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// DecodeOptions contains options for decoding PKCS#12 files.  The zero value
+// decodes with the same behavior as the package-level functions such as
+// [DecodeChain].
+type DecodeOptions struct {
+	// StrictDER rejects input that is not a canonical DER encoding, such as
+	// indefinite or non-minimal lengths, non-minimal integers, constructed
+	// OCTET STRINGs or unsorted SET OF elements.  The check covers the PFX
+	// PDU, the AuthenticatedSafe and every SafeContents, including those
+	// that are encrypted.  It is intended for ingesting files from untrusted
+	// sources.
+	StrictDER bool
+
+	// OuterEncryption expects pfxData to be wrapped in an additional
+	// PBES2-encrypted EncryptedData, as produced by
+	// [Encoder.EncodeWithOuterEncryption], and removes that layer before
+	// decoding.  The outer layer is decrypted with the same password as the
+	// PFX itself.  This is an extension to PKCS#12.
+	OuterEncryption bool
+
+	// Lenient tolerates some deviations from PKCS#12 found in files produced
+	// by other software.  Currently, a data ContentInfo in the
+	// AuthenticatedSafe that holds a DER-encoded certificate instead of a
+	// SafeContents is treated as a single certificate bag.
+	Lenient bool
+
+	// SignerCertificate is used to verify the signature of a PFX in
+	// public-key integrity mode, as produced by [Encoder.EncodeSigned].  The
+	// PFX must have been signed by exactly this certificate.  If it is nil,
+	// such a PFX is rejected with [ErrInvalidSignature], unless
+	// IgnoreSignature is set.
+	SignerCertificate *smx509.Certificate
+
+	// IgnoreSignature accepts a PFX in public-key integrity mode without
+	// verifying its signature when SignerCertificate is nil.  Like
+	// IgnoreMAC, this gives up the integrity protection of the file.
+	IgnoreSignature bool
+
+	// ConstantTimeDecode hardens password verification against timing
+	// attacks.  Every candidate encoding of the password, such as the
+	// UTF-8 encoding of a non-ASCII password, is checked against the MAC,
+	// even after one has matched, and a password that can't be encoded as a
+	// BMPString still costs a MAC key derivation.  All password failures,
+	// including malformed MAC parameters, are reported as
+	// [ErrIncorrectPassword].
+	//
+	// This makes decoding slower: an empty password always costs two MAC key
+	// derivations instead of one, and a non-ASCII password three unless the
+	// MAC is PBMAC1.
+	ConstantTimeDecode bool
+
+	// VerifyKeyPair makes [DecodeOptions.DecodeChain] check that the
+	// private key belongs to the end-entity certificate, e.g. that an SM2
+	// private key isn't paired with an RSA certificate, and return
+	// [ErrKeyCertMismatch] if it doesn't.
+	VerifyKeyPair bool
+
+	// MaxKeyDerivations limits the number of keys derived to decrypt the
+	// contents of a file, which bounds the cost of decoding a file made of
+	// many small encrypted blocks.  Blocks that share the same KDF
+	// parameters cost a single derivation.  If it is zero, a default of 128
+	// is used; if it is negative, there is no limit.
+	MaxKeyDerivations int
+
+	// MaxContentInfos is the maximum number of ContentInfos in the
+	// AuthenticatedSafe of a file decoded by [DecodeOptions.DecodeChain] and
+	// the other functions that return every bag of the file.  If it is
+	// zero, a default of 3 is used, which is enough for OpenSSL, Windows and
+	// Java files, and for every [Layout] that [Encoder.WithLayout] accepts;
+	// if it is negative, there is no limit, and the contents may be split
+	// into any number of blocks, whose decryption is bounded by
+	// MaxKeyDerivations.
+	MaxContentInfos int
+
+	// MaxNestingDepth is the maximum nesting depth of safeContentsBags,
+	// which hold another SafeContents, to bound the work spent on
+	// maliciously nested input.  Bags directly in a SafeContents of the
+	// AuthenticatedSafe are at depth 0.  If it is zero, a default of 8 is
+	// used; if it is negative, there is no limit.
+	MaxNestingDepth int
+
+	// BagPassword, if set, is an advanced hook for files whose encrypted
+	// contents are protected with other passwords than the one that the MAC
+	// is computed with, such as exports that derive the password of every
+	// block from a master password.  It is called to get the password of
+	// every encrypted block: bagType is "encryptedData" for an encrypted
+	// SafeContents, and localKeyID is then nil, or "pkcs8ShroudedKeyBag"
+	// for a shrouded private key, and localKeyID is then the localKeyId
+	// attribute of the bag, if any.  It returns the password as UTF-8.
+	// The password passed to the decoding function is still used to verify
+	// the MAC.
+	BagPassword func(bagType string, localKeyID []byte) ([]byte, error)
+
+	// IgnoreMAC skips the verification of the MAC, for files whose MAC was
+	// computed with another password than their contents, which is lost.
+	// The password passed to the decoding function is then only used to
+	// decrypt the contents.  This gives up the integrity protection of the
+	// file: the contents may have been tampered with, and a wrong password
+	// is only detected if the decrypted contents are malformed, in which
+	// case [ErrDecryption] is returned rather than [ErrIncorrectPassword].
+	IgnoreMAC bool
+
+	// ContentTypeOID, if set, is a content type that ContentInfos of the
+	// AuthenticatedSafe may have instead of data, as written by
+	// [Encoder.WithContentTypeOID] for a proprietary variant of PKCS#12.
+	// They are read like ContentInfos of type data.
+	ContentTypeOID asn1.ObjectIdentifier
+
+	// ParallelKDFThreshold is the number of MAC iterations from which, on
+	// machines with several CPUs, the keys of the encrypted contents are
+	// derived while the MAC is verified.  Only the algorithms of the
+	// encrypted contents are read before the MAC has been verified: they
+	// are decrypted and parsed afterwards.  If it is zero, a default of
+	// 10000 is used; if it is negative, keys are never derived
+	// concurrently.
+	ParallelKDFThreshold int
+
+	// DecompressContent gunzips the AuthenticatedSafe if it starts with the
+	// gzip magic number, for files written by a non-standard tool that
+	// compressed it.  The MAC is verified over the compressed bytes, as
+	// they are stored in the file, before they are decompressed.  The
+	// decompressed AuthenticatedSafe may be at most 4 MiB long, or 32 times
+	// as long as the compressed one if that is more.
+	DecompressContent bool
+}
+
+var defaultDecodeOptions = &DecodeOptions{}
+
+func (opts *DecodeOptions) newKeyDeriver() *keyDeriver {
+	maxDerivations := opts.MaxKeyDerivations
+	if maxDerivations == 0 {
+		maxDerivations = defaultMaxKeyDerivations
+	}
+	return newKeyDeriver(maxDerivations)
+}
+
+// defaultMaxContentInfos is the default of [DecodeOptions.MaxContentInfos].
+const defaultMaxContentInfos = 3
+
+func (opts *DecodeOptions) maxContentInfos() int {
+	switch {
+	case opts.MaxContentInfos == 0:
+		return defaultMaxContentInfos
+	case opts.MaxContentInfos < 0:
+		return math.MaxInt
+	}
+	return opts.MaxContentInfos
+}
+
+// newKeyDeriverFor is like newKeyDeriver, but for decoding with password,
+// which may not be valid UTF-8.
+func (opts *DecodeOptions) newKeyDeriverFor(password string) *keyDeriver {
+	kd := opts.newKeyDeriver()
+	if !utf8.ValidString(password) {
+		kd.bytewisePassword = bytewiseBMPStringZeroTerminated(password)
+	}
+	return kd
+}
+
+// bagPassword returns the password given by opts.BagPassword, encoded as a
+// BMPString.
+func (opts *DecodeOptions) bagPassword(bagType string, localKeyID []byte) ([]byte, error) {
+	password, err := opts.BagPassword(bagType, localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return bmpStringZeroTerminated(string(password))
+}
+
+// keyBagPassword returns the password of the shrouded key bag, which is
+// password unless opts.BagPassword is set.
+func (opts *DecodeOptions) keyBagPassword(bag *safeBag, password []byte) ([]byte, error) {
+	if opts.BagPassword == nil {
+		return password, nil
+	}
+	return opts.bagPassword("pkcs8ShroudedKeyBag", bag.localKeyID())
+}
+
+// defaultMaxNestingDepth is the default of [DecodeOptions.MaxNestingDepth].
+const defaultMaxNestingDepth = 8
+
+func (opts *DecodeOptions) maxNestingDepth() int {
+	if opts.MaxNestingDepth == 0 {
+		return defaultMaxNestingDepth
+	}
+	return opts.MaxNestingDepth
+}
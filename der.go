@@ -0,0 +1,363 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// checkDER walks the TLV structure of der and returns an error if it is not
+// a canonical DER encoding.  It rejects indefinite and non-minimal lengths,
+// non-minimal tag and INTEGER encodings, constructed encodings of primitive
+// universal types (e.g. constructed OCTET STRINGs) and unsorted SET OF
+// elements.  Primitive contents are not descended into; callers check nested
+// encodings (e.g. an OCTET STRING wrapping a SafeContents) separately.
+func checkDER(der []byte) error {
+	for len(der) > 0 {
+		rest, err := checkDERElement(der)
+		if err != nil {
+			return err
+		}
+		der = rest
+	}
+	return nil
+}
+
+func checkDERElement(der []byte) ([]byte, error) {
+	class, tag, compound, content, rest, err := parseDERHeader(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if class == asn1.ClassUniversal {
+		switch tag {
+		case asn1.TagSequence, asn1.TagSet:
+			if !compound {
+				return nil, errors.New("pkcs12: DER: primitive SEQUENCE or SET")
+			}
+		default:
+			if compound {
+				return nil, errors.New("pkcs12: DER: constructed encoding of a primitive type")
+			}
+		}
+		switch tag {
+		case asn1.TagInteger, asn1.TagEnum:
+			if len(content) == 0 {
+				return nil, errors.New("pkcs12: DER: empty integer")
+			}
+			if len(content) > 1 && ((content[0] == 0 && content[1]&0x80 == 0) || (content[0] == 0xff && content[1]&0x80 == 0x80)) {
+				return nil, errors.New("pkcs12: DER: integer not minimally-encoded")
+			}
+		case asn1.TagBoolean:
+			if len(content) != 1 || (content[0] != 0 && content[0] != 0xff) {
+				return nil, errors.New("pkcs12: DER: invalid boolean")
+			}
+		case asn1.TagSet:
+			if err := checkDERSetOrder(content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if compound {
+		if err := checkDER(content); err != nil {
+			return nil, err
+		}
+	}
+	return rest, nil
+}
+
+// parseDERHeader splits the first element of der into its identifier and
+// contents, rejecting non-minimal and indefinite-length encodings.
+func parseDERHeader(der []byte) (class, tag int, compound bool, content, rest []byte, err error) {
+	if len(der) < 2 {
+		return 0, 0, false, nil, nil, errors.New("pkcs12: DER: truncated element")
+	}
+	class = int(der[0] >> 6)
+	compound = der[0]&0x20 != 0
+	tag = int(der[0] & 0x1f)
+	offset := 1
+	if tag == 0x1f {
+		// high tag number form
+		tag = 0
+		for {
+			if offset >= len(der) {
+				return 0, 0, false, nil, nil, errors.New("pkcs12: DER: truncated tag")
+			}
+			b := der[offset]
+			if tag == 0 && b == 0x80 {
+				return 0, 0, false, nil, nil, errors.New("pkcs12: DER: non-minimal tag")
+			}
+			offset++
+			if tag > 1<<23 {
+				return 0, 0, false, nil, nil, errors.New("pkcs12: DER: tag too large")
+			}
+			tag = tag<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		if tag < 0x1f {
+			return 0, 0, false, nil, nil, errors.New("pkcs12: DER: non-minimal tag")
+		}
+	}
+
+	if offset >= len(der) {
+		return 0, 0, false, nil, nil, errors.New("pkcs12: DER: truncated length")
+	}
+	length := int(der[offset])
+	offset++
+	if length == 0x80 {
+		return 0, 0, false, nil, nil, errors.New("pkcs12: DER: indefinite length")
+	}
+	if length > 0x80 {
+		numBytes := length & 0x7f
+		if numBytes > 4 {
+			return 0, 0, false, nil, nil, errors.New("pkcs12: DER: length too large")
+		}
+		if offset+numBytes > len(der) {
+			return 0, 0, false, nil, nil, errors.New("pkcs12: DER: truncated length")
+		}
+		if der[offset] == 0 {
+			return 0, 0, false, nil, nil, errors.New("pkcs12: DER: non-minimal length")
+		}
+		length = 0
+		for i := 0; i < numBytes; i++ {
+			length = length<<8 | int(der[offset])
+			offset++
+		}
+		if length < 0x80 {
+			return 0, 0, false, nil, nil, errors.New("pkcs12: DER: non-minimal length")
+		}
+	}
+	if length > len(der)-offset {
+		return 0, 0, false, nil, nil, errors.New("pkcs12: DER: truncated element")
+	}
+	content = der[offset : offset+length]
+	rest = der[offset+length:]
+	return
+}
+
+// checkTruncated returns an error wrapping [ErrTruncated] if der is empty,
+// or starts with a SEQUENCE, as a PFX does, that is longer than der.  Other
+// input is left to the parser.
+func checkTruncated(der []byte) error {
+	if len(der) == 0 {
+		return fmt.Errorf("%w: the input is empty", ErrTruncated)
+	}
+	if der[0] != 0x30 {
+		return nil
+	}
+	if len(der) < 2 {
+		return fmt.Errorf("%w: the input ends in the header of the PFX", ErrTruncated)
+	}
+	length, offset := int(der[1]), 2
+	if length == 0x80 {
+		return nil
+	}
+	if length > 0x80 {
+		numBytes := length & 0x7f
+		if numBytes > 4 {
+			return nil
+		}
+		if len(der) < offset+numBytes {
+			return fmt.Errorf("%w: the input ends in the header of the PFX", ErrTruncated)
+		}
+		length = 0
+		for _, b := range der[offset : offset+numBytes] {
+			length = length<<8 | int(b)
+		}
+		offset += numBytes
+	}
+	if length > len(der)-offset {
+		return fmt.Errorf("%w: got %d bytes of a %d-byte PFX", ErrTruncated, len(der), offset+length)
+	}
+	return nil
+}
+
+// checkDERSetOrder verifies that the elements of a SET OF are sorted by their
+// encodings, as required by X.690 section 11.6.
+func checkDERSetOrder(content []byte) error {
+	var prev []byte
+	for len(content) > 0 {
+		_, _, _, _, rest, err := parseDERHeader(content)
+		if err != nil {
+			return err
+		}
+		elem := content[:len(content)-len(rest)]
+		if prev != nil && bytes.Compare(prev, elem) > 0 {
+			return errors.New("pkcs12: DER: SET OF elements are not sorted")
+		}
+		prev = elem
+		content = rest
+	}
+	return nil
+}
+
+// appendDERHeader appends the DER identifier and length octets of a
+// universal element with the given tag and content length to b.
+func appendDERHeader(b []byte, tag int, compound bool, length int) []byte {
+	identifier := byte(tag)
+	if compound {
+		identifier |= 0x20
+	}
+	b = append(b, identifier)
+	if length < 0x80 {
+		return append(b, byte(length))
+	}
+	n := 0
+	for l := length; l > 0; l >>= 8 {
+		n++
+	}
+	b = append(b, 0x80|byte(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(length>>(8*i)))
+	}
+	return b
+}
+
+// derHeaderLength returns the length of the header written by
+// appendDERHeader for an element whose contents are length bytes long.
+func derHeaderLength(length int) int {
+	if length < 0x80 {
+		return 2
+	}
+	n := 2
+	for l := length; l > 0; l >>= 8 {
+		n++
+	}
+	return n
+}
+
+// maxASN1Length is the size above which elements are parsed with
+// parseDERHeader rather than encoding/asn1, which rejects lengths of 2 GiB
+// or more even on 64-bit platforms.  parseDERHeader accepts lengths of up
+// to 4 bytes, so that the containers of a PFX (the PFX itself, the
+// ContentInfos, the AuthenticatedSafe and the SafeContents) can be up to
+// 4 GiB long.  It is a variable so that tests can exercise the large
+// element path with small files.
+var maxASN1Length = 1<<31 - 1
+
+// unmarshalRawValue parses der, a single element, into raw, like
+// unmarshal, but without the length limit of encoding/asn1.
+func unmarshalRawValue(der []byte, raw *asn1.RawValue) error {
+	if len(der) <= maxASN1Length {
+		return unmarshal(der, raw)
+	}
+	class, tag, compound, content, rest, err := parseDERHeader(der)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New("pkcs12: trailing data found")
+	}
+	*raw = asn1.RawValue{Class: class, Tag: tag, IsCompound: compound, Bytes: content, FullBytes: der}
+	return nil
+}
+
+// unmarshalSequenceOf splits der, a SEQUENCE, into its elements.
+func unmarshalSequenceOf(der []byte) ([]asn1.RawValue, error) {
+	var elements []asn1.RawValue
+	if len(der) <= maxASN1Length {
+		err := unmarshal(der, &elements)
+		return elements, err
+	}
+	var seq asn1.RawValue
+	if err := unmarshalRawValue(der, &seq); err != nil {
+		return nil, err
+	}
+	if seq.Class != asn1.ClassUniversal || seq.Tag != asn1.TagSequence || !seq.IsCompound {
+		return nil, errors.New("pkcs12: expected a SEQUENCE")
+	}
+	for rest := seq.Bytes; len(rest) > 0; {
+		class, tag, compound, content, next, err := parseDERHeader(rest)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, asn1.RawValue{Class: class, Tag: tag, IsCompound: compound, Bytes: content, FullBytes: rest[:len(rest)-len(next)]})
+		rest = next
+	}
+	return elements, nil
+}
+
+// unmarshalOctetString returns the contents of der, an OCTET STRING.
+func unmarshalOctetString(der []byte) ([]byte, error) {
+	var octets []byte
+	if len(der) <= maxASN1Length {
+		err := unmarshal(der, &octets)
+		return octets, err
+	}
+	var raw asn1.RawValue
+	if err := unmarshalRawValue(der, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Class != asn1.ClassUniversal || raw.Tag != asn1.TagOctetString || raw.IsCompound {
+		return nil, errors.New("pkcs12: expected an OCTET STRING")
+	}
+	return raw.Bytes, nil
+}
+
+// unmarshalContentInfo parses der into ci, like unmarshal.
+func unmarshalContentInfo(der []byte, ci *contentInfo) error {
+	if len(der) <= maxASN1Length {
+		return unmarshal(der, ci)
+	}
+	elements, err := unmarshalSequenceOf(der)
+	if err != nil {
+		return err
+	}
+	if len(elements) != 2 {
+		return errors.New("pkcs12: malformed ContentInfo")
+	}
+	if err := unmarshal(elements[0].FullBytes, &ci.ContentType); err != nil {
+		return err
+	}
+	if content := elements[1]; content.Class != asn1.ClassContextSpecific || content.Tag != 0 || !content.IsCompound {
+		return errors.New("pkcs12: malformed ContentInfo")
+	}
+	ci.Content = elements[1]
+	return nil
+}
+
+// unmarshalEncryptedData parses der into ed, like unmarshal.
+func unmarshalEncryptedData(der []byte, ed *encryptedData) error {
+	if len(der) <= maxASN1Length {
+		return unmarshal(der, ed)
+	}
+	elements, err := unmarshalSequenceOf(der)
+	if err != nil {
+		return err
+	}
+	if len(elements) < 2 || len(elements) > 3 {
+		return errors.New("pkcs12: malformed EncryptedData")
+	}
+	if err := unmarshal(elements[0].FullBytes, &ed.Version); err != nil {
+		return err
+	}
+	eci, err := unmarshalSequenceOf(elements[1].FullBytes)
+	if err != nil {
+		return err
+	}
+	if len(eci) != 3 {
+		return errors.New("pkcs12: malformed EncryptedContentInfo")
+	}
+	if err := unmarshal(eci[0].FullBytes, &ed.EncryptedContentInfo.ContentType); err != nil {
+		return err
+	}
+	if err := unmarshal(eci[1].FullBytes, &ed.EncryptedContentInfo.ContentEncryptionAlgorithm); err != nil {
+		return err
+	}
+	if content := eci[2]; content.Class != asn1.ClassContextSpecific || content.Tag != 0 || content.IsCompound {
+		return errors.New("pkcs12: malformed EncryptedContentInfo")
+	}
+	ed.EncryptedContentInfo.EncryptedContent = eci[2].Bytes
+	if len(elements) == 3 {
+		ed.UnprotectedAttrs = elements[2]
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+var checkDERTests = []struct {
+	name       string
+	in         string
+	shouldFail bool
+}{
+	{"sequence of integers", "3006020100020101", false},
+	{"high tag number", "9f2000", false},
+	{"sorted set", "3106020101020102", false},
+	{"indefinite length", "30800201000000", true},
+	{"non-minimal length", "3081020201000000", true},
+	{"non-minimal integer", "02020001", true},
+	{"non-minimal negative integer", "0202ff80", true},
+	{"constructed octet string", "2406040161040162", true},
+	{"primitive sequence", "1000", true},
+	{"invalid boolean", "010101", true},
+	{"unsorted set", "3106020102020101", true},
+	{"non-minimal high tag number", "9f1e00", true},
+	{"truncated", "300602010002", true},
+}
+
+func TestCheckDER(t *testing.T) {
+	for _, test := range checkDERTests {
+		in, _ := hex.DecodeString(test.in)
+		err := checkDER(in)
+		if test.shouldFail && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !test.shouldFail && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestStrictDERDecode(t *testing.T) {
+	strict := &DecodeOptions{StrictDER: true}
+
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	_, cert, err := Decode(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file produced by this package is canonical DER.
+	pfxData, err := Modern2023.EncodeTrustStore([]*smx509.Certificate{cert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.DecodeTrustStore(pfxData, "password"); err != nil {
+		t.Fatalf("canonical file: unexpected error: %v", err)
+	}
+
+	// Build a passwordless trust store whose bag attributes are not sorted.
+	pfxData, err = Passwordless.EncodeTrustStore([]*smx509.Certificate{cert}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData = unsortBagAttributes(t, pfxData)
+
+	if _, err := DecodeTrustStore(pfxData, ""); err != nil {
+		t.Fatalf("non-canonical file: lenient decode failed: %v", err)
+	}
+	if _, err := strict.DecodeTrustStore(pfxData, ""); err == nil {
+		t.Fatal("non-canonical file: expected strict decode to fail")
+	}
+}
+
+// unsortBagAttributes rewrites the plaintext SafeContents of pfxData so that
+// the attributes of every bag are encoded in reverse order.
+func unsortBagAttributes(t *testing.T, pfxData []byte) []byte {
+	type rawBag struct {
+		Id         asn1.ObjectIdentifier
+		Value      asn1.RawValue `asn1:"tag:0,explicit"`
+		Attributes asn1.RawValue
+	}
+
+	var pfx pfxPdu
+	if err := unmarshal(pfxData, &pfx); err != nil {
+		t.Fatal(err)
+	}
+	var authSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafe []contentInfo
+	if err := unmarshal(authSafeBytes, &authenticatedSafe); err != nil {
+		t.Fatal(err)
+	}
+	for i, ci := range authenticatedSafe {
+		var data []byte
+		if err := unmarshal(ci.Content.Bytes, &data); err != nil {
+			t.Fatal(err)
+		}
+		var bags []safeBag
+		if err := unmarshal(data, &bags); err != nil {
+			t.Fatal(err)
+		}
+		rawBags := make([]rawBag, len(bags))
+		for j, bag := range bags {
+			rawBags[j].Id = bag.Id
+			rawBags[j].Value = bag.Value
+			rawBags[j].Attributes = asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+			for k := len(bag.Attributes) - 1; k >= 0; k-- {
+				attr, err := asn1.Marshal(bag.Attributes[k])
+				if err != nil {
+					t.Fatal(err)
+				}
+				rawBags[j].Attributes.Bytes = append(rawBags[j].Attributes.Bytes, attr...)
+			}
+		}
+		data, err := asn1.Marshal(rawBags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticatedSafe[i].Content.FullBytes = nil
+		if authenticatedSafe[i].Content.Bytes, err = asn1.Marshal(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var err error
+	if authSafeBytes, err = asn1.Marshal(authenticatedSafe); err != nil {
+		t.Fatal(err)
+	}
+	pfx.AuthSafe.Content.FullBytes = nil
+	if pfx.AuthSafe.Content.Bytes, err = asn1.Marshal(authSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	if pfxData, err = asn1.Marshal(pfx); err != nil {
+		t.Fatal(err)
+	}
+	return pfxData
+}
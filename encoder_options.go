@@ -0,0 +1,573 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// WithIterations creates a new Encoder identical to enc except that
+// it will use the given number of KDF iterations for deriving the MAC
+// and encryption keys.
+//
+// Note that even with a large number of iterations, a weak
+// password can still be brute-forced in much less time than it would
+// take to brute-force a high-entropy encrytion key.  For the best
+// security, don't worry about the number of iterations and just
+// use a high-entropy password (e.g. one generated with `openssl rand -hex 16`).
+// See https://neilmadden.blog/2023/01/09/on-pbkdf2-iterations/ for more detail.
+//
+// Panics if iterations is less than 1.
+func (enc Encoder) WithIterations(iterations int) *Encoder {
+	if iterations < 1 {
+		panic("pkcs12: number of iterations is less than 1")
+	}
+	enc.macIterations = iterations
+	enc.encryptionIterations = iterations
+	enc.keyIterations = 0
+	return &enc
+}
+
+// WithComponentIterations creates a new Encoder identical to enc except that
+// it will use key KDF iterations for encrypting the private key, cert
+// iterations for encrypting the certificates and mac iterations for deriving
+// the MAC key.  Since the certificates are public, this allows spending the
+// time on protecting the private key rather than on a large chain.
+//
+// Panics if any of the iteration counts is less than 1.
+func (enc Encoder) WithComponentIterations(key, cert, mac int) *Encoder {
+	if key < 1 || cert < 1 || mac < 1 {
+		panic("pkcs12: number of iterations is less than 1")
+	}
+	enc.keyIterations = key
+	enc.encryptionIterations = cert
+	enc.macIterations = mac
+	return &enc
+}
+
+// keyEncryptionIterations returns the number of KDF iterations for
+// encrypting private keys.
+func (enc *Encoder) keyEncryptionIterations() int {
+	if enc.keyIterations != 0 {
+		return enc.keyIterations
+	}
+	return enc.encryptionIterations
+}
+
+// WithRand creates a new Encoder identical to enc except that
+// it will use the given io.Reader for its random number generator
+// instead of [crypto/rand.Reader].
+func (enc Encoder) WithRand(rand io.Reader) *Encoder {
+	enc.rand = rand
+	return &enc
+}
+
+// WithSaltRand creates a new Encoder identical to enc except that it reads
+// the salts of the MAC and of every encryption from rand, instead of the
+// random number generator set with [Encoder.WithRand].
+func (enc Encoder) WithSaltRand(rand io.Reader) *Encoder {
+	enc.saltRand = rand
+	return &enc
+}
+
+// WithIVRand creates a new Encoder identical to enc except that it reads
+// the IVs of PBES2 encryptions from rand, instead of the random number
+// generator set with [Encoder.WithRand].  PKCS#12 PBE algorithms derive
+// their IV from the password and don't use it.
+func (enc Encoder) WithIVRand(rand io.Reader) *Encoder {
+	enc.ivRand = rand
+	return &enc
+}
+
+// WithoutAttributes creates a new Encoder identical to enc except that
+// [Encoder.Encode] will not add any attributes, such as localKeyId, to the
+// bags of the private key and the certificates, for software that can't
+// parse them.  [Decode] pairs the private key with its certificate by public
+// key instead.
+//
+// Trust stores are not affected, since their attributes are what marks a
+// certificate as trusted.
+func (enc Encoder) WithoutAttributes() *Encoder {
+	enc.omitAttributes = true
+	return &enc
+}
+
+// WithMatchedNames creates a new Encoder identical to enc except that, if
+// matched is true, [Encoder.Encode] writes a friendlyName attribute with the
+// same value on the bags of the private key and of the end-entity
+// certificate.  Windows may not associate the key with the certificate
+// otherwise.  The name is the common name of the certificate subject, or the
+// whole subject if it has no common name.
+//
+// It has no effect if attributes are omitted with [Encoder.WithoutAttributes].
+func (enc Encoder) WithMatchedNames(matched bool) *Encoder {
+	enc.matchedNames = matched
+	return &enc
+}
+
+// A ChainOrder is an order of the CA certificates written by
+// [Encoder.Encode].  See [Encoder.WithChainOrder].
+type ChainOrder int
+
+const (
+	// ChainAsGiven writes the CA certificates in the order they are given.
+	ChainAsGiven ChainOrder = iota
+	// ChainLeafToRoot writes the issuer of the end-entity certificate
+	// first, then its issuer, and so on up to the root.
+	ChainLeafToRoot
+	// ChainRootToLeaf writes the root first, and the issuer of the
+	// end-entity certificate last.
+	ChainRootToLeaf
+)
+
+// WithChainOrder creates a new Encoder identical to enc except that
+// [Encoder.Encode] writes the CA certificates in the given order, for
+// importers that expect a particular one.  The chain is built by matching
+// the issuer of each certificate with the subject (and key identifier, if
+// any) of the next one; CA certificates that are not part of the chain of
+// the end-entity certificate are written last, in the order they are given.
+// The end-entity certificate is always written first.
+//
+// Panics if order is unknown.
+func (enc Encoder) WithChainOrder(order ChainOrder) *Encoder {
+	if order < ChainAsGiven || order > ChainRootToLeaf {
+		panic(fmt.Sprintf("pkcs12: unknown chain order %d", order))
+	}
+	enc.chainOrder = order
+	return &enc
+}
+
+// WithVerifyChain creates a new Encoder identical to enc except that
+// [Encoder.Encode] first verifies that the CA certificates chain the
+// end-entity certificate up to one of roots, for any extended key usage, and
+// returns an error if they don't, or if one of them is not part of any such
+// chain.  This catches incomplete chains and unrelated certificates before
+// the PKCS#12 file is distributed.  If roots is nil, the chain is not
+// verified, which is the default.
+func (enc Encoder) WithVerifyChain(roots *smx509.CertPool) *Encoder {
+	enc.verifyRoots = roots
+	return &enc
+}
+
+// verifyChain verifies that caCerts chain certificate to enc.verifyRoots,
+// if set.
+func (enc *Encoder) verifyChain(certificate *smx509.Certificate, caCerts []*smx509.Certificate) error {
+	if enc.verifyRoots == nil {
+		return nil
+	}
+	intermediates := smx509.NewCertPool()
+	for _, cert := range caCerts {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certificate.Verify(smx509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         enc.verifyRoots,
+		KeyUsages:     []smx509.ExtKeyUsage{smx509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errors.New("pkcs12: error verifying the certificate chain: " + err.Error())
+	}
+	for _, cert := range caCerts {
+		if !inChains(cert, chains) {
+			return errors.New("pkcs12: CA certificate " + cert.Subject.String() + " is not part of the certificate chain")
+		}
+	}
+	return nil
+}
+
+// inChains reports whether cert is in one of chains.
+func inChains(cert *smx509.Certificate, chains [][]*smx509.Certificate) bool {
+	for _, chain := range chains {
+		for _, c := range chain {
+			if c.Equal(cert) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithExplicitNullParams creates a new Encoder identical to enc except that
+// it chooses whether the AlgorithmIdentifiers of the MAC digest algorithm
+// and of the PBES2 PRF have explicit NULL parameters, as OpenSSL writes
+// them, or no parameters.  By default, and if null is false, the parameters
+// are absent, as this package has always written them, which OpenSSL
+// accepts.  Set null to true for parsers that require the NULL.
+// The default hmacWithSHA1 PRF is omitted in either case, as DER requires.
+func (enc Encoder) WithExplicitNullParams(null bool) *Encoder {
+	enc.explicitNullParams = null
+	return &enc
+}
+
+// WithParallelKDFThreshold creates a new Encoder identical to enc except
+// that, on machines with several CPUs, the MAC key is derived concurrently
+// with the encryption of the contents if the MAC is computed with at least
+// threshold iterations.  By default, the threshold is 10000 iterations; if
+// threshold is negative, the MAC key is never derived concurrently.
+//
+// Panics if threshold is zero.
+func (enc Encoder) WithParallelKDFThreshold(threshold int) *Encoder {
+	if threshold == 0 {
+		panic("pkcs12: zero parallel KDF threshold")
+	}
+	enc.parallelKDFThreshold = threshold
+	return &enc
+}
+
+// WithMACParamsNull creates a new Encoder identical to enc except that the
+// digest AlgorithmIdentifier of the MacData has explicit NULL parameters if
+// null is true, or no parameters if null is false, whatever
+// [Encoder.WithExplicitNullParams] chose; the PBES2 PRF is not affected.
+// It has no effect with PBMAC1, whose parameters are never NULL.
+//
+// By default the parameters are absent, as RFC 5754 specifies for SHA-2
+// and which the widest set of readers accept, including OpenSSL, Java and
+// this package.  OpenSSL and keytool write the NULL, though, and readers
+// that only accept what they write, such as some older Java releases,
+// require null to be true.
+func (enc Encoder) WithMACParamsNull(null bool) *Encoder {
+	enc.macParamsNull = &null
+	return &enc
+}
+
+// macNullParams reports whether the MAC digest algorithm has explicit NULL
+// parameters.
+func (enc *Encoder) macNullParams() bool {
+	if enc.macParamsNull != nil {
+		return *enc.macParamsNull
+	}
+	return enc.explicitNullParams
+}
+
+// WithContentTypeOID creates a new Encoder identical to enc except that
+// the ContentInfos of the AuthenticatedSafe that hold a plaintext
+// SafeContents have the content type oid rather than data, for a
+// proprietary variant of PKCS#12.  Encrypted SafeContents are unaffected.
+// Such files can only be decoded with [DecodeOptions.ContentTypeOID] set to
+// oid.
+//
+// Panics if oid is empty.
+func (enc Encoder) WithContentTypeOID(oid asn1.ObjectIdentifier) *Encoder {
+	if len(oid) == 0 {
+		panic("pkcs12: empty content type")
+	}
+	enc.contentType = append(asn1.ObjectIdentifier(nil), oid...)
+	return &enc
+}
+
+// WithLocalKeyID creates a new Encoder identical to enc except that
+// [Encoder.Encode] sets the localKeyId attribute of the private key and of
+// the end-entity certificate to id, such as the identifier of the identity
+// in an external inventory, rather than to the SHA-1 fingerprint of the
+// certificate.  It is returned by [DecodeEntries] as [Entry.LocalKeyID].
+// It has no effect with [Encoder.WithoutAttributes].
+//
+// Panics if id is empty.
+func (enc Encoder) WithLocalKeyID(id []byte) *Encoder {
+	if len(id) == 0 {
+		panic("pkcs12: empty localKeyId")
+	}
+	enc.localKeyID = append([]byte(nil), id...)
+	return &enc
+}
+
+// WithMaxOutputSize creates a new Encoder identical to enc except that
+// encoding fails if the PKCS#12 file would be longer than n bytes, e.g.
+// for a transport with a hard size limit.  The error tells by how much the
+// limit is exceeded, so that the caller can retry e.g. with a shorter chain
+// or another Encoder.  If n is 0, the size is not limited, which is the
+// default.
+//
+// Panics if n is negative.
+func (enc Encoder) WithMaxOutputSize(n int) *Encoder {
+	if n < 0 {
+		panic("pkcs12: maximum output size must not be negative")
+	}
+	enc.maxOutputSize = n
+	return &enc
+}
+
+// checkOutputSize returns an error if pfxData is longer than the maximum
+// output size of enc.
+func (enc *Encoder) checkOutputSize(pfxData []byte) error {
+	if enc.maxOutputSize == 0 || len(pfxData) <= enc.maxOutputSize {
+		return nil
+	}
+	return fmt.Errorf("pkcs12: encoded PKCS#12 file is %d bytes long, %d bytes over the maximum of %d", len(pfxData), len(pfxData)-enc.maxOutputSize, enc.maxOutputSize)
+}
+
+// orderChain returns caCerts in the given order.
+func orderChain(leaf *smx509.Certificate, caCerts []*smx509.Certificate, order ChainOrder) []*smx509.Certificate {
+	if order == ChainAsGiven {
+		return caCerts
+	}
+
+	used := make([]bool, len(caCerts))
+	var chain []*smx509.Certificate
+	for cert := leaf; ; {
+		next := -1
+		for i, ca := range caCerts {
+			if !used[i] && issuedBy(cert, ca) {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			break
+		}
+		used[next] = true
+		chain = append(chain, caCerts[next])
+		cert = caCerts[next]
+	}
+	if order == ChainRootToLeaf {
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+	}
+	for i, ca := range caCerts {
+		if !used[i] {
+			chain = append(chain, ca)
+		}
+	}
+	return chain
+}
+
+// issuedBy reports whether cert names issuer as its issuer.  The signature
+// is not checked.
+func issuedBy(cert, issuer *smx509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+		return false
+	}
+	if len(cert.AuthorityKeyId) != 0 && len(issuer.SubjectKeyId) != 0 {
+		return bytes.Equal(cert.AuthorityKeyId, issuer.SubjectKeyId)
+	}
+	return true
+}
+
+// WithFixedSalt creates a new Encoder identical to enc except that it
+// uses the given salts and IV instead of random ones, so that its output
+// is byte-for-byte reproducible.  contentSalt is used for every encryption
+// of certificates and private keys, macSalt for the MAC, and iv, which must
+// be 16 bytes long, as the IV of every PBES2 encryption.  A nil argument
+// leaves the corresponding value random.
+//
+// WithFixedSalt is meant for generating and reproducing test vectors.
+// Reusing salts and IVs is INSECURE; never use it to protect real keys.
+//
+// Panics if iv is neither nil nor 16 bytes long.
+func (enc Encoder) WithFixedSalt(contentSalt, macSalt, iv []byte) *Encoder {
+	if iv != nil && len(iv) != 16 {
+		panic("pkcs12: IV must be 16 bytes long")
+	}
+	enc.fixedContentSalt = contentSalt
+	enc.fixedMacSalt = macSalt
+	enc.fixedIV = iv
+	return &enc
+}
+
+// GenerateSalt returns a salt of length bytes read from rand.  The encoders
+// generate the salt of the MAC and of every encryption with it, reading from
+// the source set with [Encoder.WithSaltRand] or [Encoder.WithRand].
+//
+// A salt is passed as is to the KDF: the PKCS#12 KDF (rfc7292#appendix-B.2)
+// for the MAC and the PKCS#12 PBE algorithms, and PBKDF2
+// (rfc8018#section-5.2) for PBES2 and PBMAC1.  Keys precomputed from salts
+// generated with GenerateSalt, e.g. in an HSM, therefore match those of an
+// Encoder given the same salts with [Encoder.WithFixedSalt].
+func GenerateSalt(rand io.Reader, length int) ([]byte, error) {
+	if length < 0 {
+		return nil, errors.New("pkcs12: salt length must not be negative")
+	}
+	salt := make([]byte, length)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// newSalt returns the salt for a new encryption, read from rand unless enc
+// has a fixed salt or a source of salts.
+func (enc *Encoder) newSalt(rand io.Reader) ([]byte, error) {
+	if enc.fixedContentSalt != nil {
+		return enc.fixedContentSalt, nil
+	}
+	return GenerateSalt(enc.saltSource(rand), enc.saltLen)
+}
+
+// saltSource returns the reader to read salts from.
+func (enc *Encoder) saltSource(rand io.Reader) io.Reader {
+	if enc.saltRand != nil {
+		return enc.saltRand
+	}
+	return rand
+}
+
+// ivSource returns the reader to read PBES2 IVs from.
+func (enc *Encoder) ivSource(rand io.Reader) io.Reader {
+	if enc.fixedIV != nil {
+		return bytes.NewReader(enc.fixedIV)
+	}
+	if enc.ivRand != nil {
+		return enc.ivRand
+	}
+	return rand
+}
+
+// WithNullEmptyPassword creates a new Encoder identical to enc except that
+// it chooses how an empty password is encoded when deriving the MAC and
+// encryption keys.  By default, and if null is false, the empty password is
+// encoded as an empty BMPString with its terminating NUL ("\x00\x00"), as
+// OpenSSL does.  If null is true, it is encoded as zero bytes, as some
+// versions of Windows do.  Non-empty passwords are not affected.
+//
+// Decode accepts both conventions for an empty password.
+func (enc Encoder) WithNullEmptyPassword(null bool) *Encoder {
+	enc.nullEmptyPassword = null
+	return &enc
+}
+
+// WithMACAlgorithm creates a new Encoder identical to enc except that
+// it will use the given MAC algorithm, which must be one of [OIDMACSHA1],
+// [OIDMACSHA256], [OIDMACSM3] or [OIDMACPBMAC1].  PBMAC1 uses
+// PBKDF2-HMAC-SHA-256 and HMAC-SHA-256.  A nil algorithm omits the MAC.
+//
+// Panics if algorithm is not supported.
+func (enc Encoder) WithMACAlgorithm(algorithm asn1.ObjectIdentifier) *Encoder {
+	switch {
+	case algorithm == nil:
+	case algorithm.Equal(oidSHA1), algorithm.Equal(oidSHA256), algorithm.Equal(oidSM3), algorithm.Equal(oidPBMAC1):
+		enc.setDefaultParameters()
+	default:
+		panic("pkcs12: unsupported MAC algorithm " + algorithm.String())
+	}
+	enc.macAlgorithm = algorithm
+	return &enc
+}
+
+// WithKeyBagCipher creates a new Encoder identical to enc except that
+// it will encrypt private keys with the given algorithm.  The algorithm is
+// either a PKCS#12 PBE algorithm such as [OIDPBEWithSHAAnd3KeyTripleDESCBC],
+// or a PBES2 encryption scheme such as [OIDCipherAES256CBC] or
+// [OIDCipherSM4CBC].  A nil algorithm stores private keys unencrypted.
+//
+// Panics if algorithm is not supported.
+func (enc Encoder) WithKeyBagCipher(algorithm asn1.ObjectIdentifier) *Encoder {
+	enc.keyAlgorithm, enc.keyEncryptionScheme = enc.cipherFor(algorithm)
+	return &enc
+}
+
+// WithCertBagCipher creates a new Encoder identical to enc except that
+// it will encrypt certificates with the given algorithm.  See
+// [Encoder.WithKeyBagCipher] for the supported algorithms.  A nil algorithm
+// stores certificates unencrypted.
+//
+// Panics if algorithm is not supported.
+func (enc Encoder) WithCertBagCipher(algorithm asn1.ObjectIdentifier) *Encoder {
+	enc.certAlgorithm, enc.certEncryptionScheme = enc.cipherFor(algorithm)
+	return &enc
+}
+
+// WithPRF creates a new Encoder identical to enc except that PBES2 will use
+// PBKDF2 with the given PRF, which must be one of [OIDPRFHmacSHA1],
+// [OIDPRFHmacSHA256] or [OIDPRFHmacSM3].
+//
+// Panics if prf is not supported.
+func (enc Encoder) WithPRF(prf asn1.ObjectIdentifier) *Encoder {
+	if _, err := prfFor(prf); err != nil || len(prf) == 0 {
+		panic("pkcs12: unsupported PRF " + prf.String())
+	}
+	enc.kdfPrf = prf
+	return &enc
+}
+
+// cipherFor returns the PBE algorithm and PBES2 encryption scheme for
+// algorithm, and sets the parameters it needs if enc doesn't have them yet.
+func (enc *Encoder) cipherFor(algorithm asn1.ObjectIdentifier) (pbeAlgorithm, encryptionScheme asn1.ObjectIdentifier) {
+	switch {
+	case algorithm == nil:
+		return nil, nil
+	case algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC), algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC), algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		enc.setDefaultParameters()
+		return algorithm, nil
+	case algorithm.Equal(oidAES128CBC), algorithm.Equal(oidAES192CBC), algorithm.Equal(oidAES256CBC), algorithm.Equal(oidSM4CBC):
+		enc.setDefaultParameters()
+		if enc.kdfPrf == nil {
+			enc.kdfPrf = oidHmacWithSHA256
+		}
+		return oidPBES2, algorithm
+	}
+	panic("pkcs12: unsupported cipher " + algorithm.String())
+}
+
+// setDefaultParameters fills in the salt length and iteration counts of an
+// encoder, such as [Passwordless], that doesn't encrypt or MAC its contents.
+func (enc *Encoder) setDefaultParameters() {
+	if enc.saltLen == 0 {
+		enc.saltLen = 16
+	}
+	if enc.macIterations == 0 {
+		enc.macIterations = 2048
+	}
+	if enc.encryptionIterations == 0 {
+		enc.encryptionIterations = 2048
+	}
+}
+
+// A CompatTarget identifies software that PKCS#12 files are produced for.
+// See [Encoder.WithCompatibility].
+type CompatTarget int
+
+const (
+	// CompatJava8 targets Java 8 before 8u301, which can't read PBES2:
+	// certificates are encrypted using PBE with RC2, keys using PBE with
+	// 3DES and MACs use HMAC-SHA-1, with the 1024 iterations and 20-byte
+	// salts used by these releases.
+	CompatJava8 CompatTarget = iota + 1
+	// CompatWindows targets Windows 10 and Windows Server before 2019:
+	// certificates and keys are encrypted using PBE with 3DES and MACs use
+	// HMAC-SHA-1, with the iteration counts used by Windows.
+	CompatWindows
+	// CompatOpenSSL1 targets OpenSSL 1.x, using the same parameters as its
+	// PKCS12_create defaults.  This is the same as [LegacyRC2].
+	CompatOpenSSL1
+	// CompatGM targets ShangMi (GM/T) tools.  This is the same as [ShangMi2024].
+	CompatGM
+)
+
+// WithCompatibility creates a new Encoder identical to enc except that its
+// algorithms and iteration counts are replaced by a combination known to
+// work with target.  The random number generator of enc is kept.
+//
+// Panics if target is unknown.
+func (enc Encoder) WithCompatibility(target CompatTarget) *Encoder {
+	var preset Encoder
+	switch target {
+	case CompatJava8:
+		preset = *LegacyRC2
+		preset.macIterations = 1024
+		preset.encryptionIterations = 1024
+		preset.saltLen = 20
+	case CompatWindows:
+		preset = *LegacyDES
+		preset.macIterations = 2000
+		preset.encryptionIterations = 2000
+	case CompatOpenSSL1:
+		preset = *LegacyRC2
+	case CompatGM:
+		preset = *ShangMi2024
+	default:
+		panic(fmt.Sprintf("pkcs12: unknown compatibility target %d", target))
+	}
+	preset.rand = enc.rand
+	preset.saltRand = enc.saltRand
+	preset.ivRand = enc.ivRand
+	return &preset
+}
@@ -0,0 +1,302 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"unicode/utf16"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// Entry is an entry of a PKCS#12 file holding several private keys or
+// certificates, each named by its Friendly Name (Alias), such as a Java
+// KeyStore.
+type Entry struct {
+	FriendlyName string
+	// PrivateKey is nil for an entry that only holds a certificate.
+	PrivateKey  interface{}
+	Certificate *smx509.Certificate
+	// Attributes holds the bag attributes of the entry, keyed by their OIDs
+	// in dotted form, such as "1.2.840.113549.1.9.20" for friendlyName.
+	// Each value is the DER encoding of the attribute values.  Attributes of
+	// the private key take precedence over those of its certificate.
+	Attributes map[string][]byte
+	// LocalKeyID is the localKeyId attribute of the private key, or of the
+	// certificate if the key has none or for an entry that only holds a
+	// certificate, if any.  See [Encoder.WithLocalKeyID].
+	LocalKeyID []byte
+}
+
+// DisplayName returns a name for e suitable for display.  It is the first
+// non-empty one of, in order: the PKCS#9 Friendly Name, which Java also uses
+// for its aliases; the friendly name certificate property exported by
+// Windows; and the common name of the certificate subject.
+func (e Entry) DisplayName() string {
+	if e.FriendlyName != "" {
+		return e.FriendlyName
+	}
+	if value, ok := e.Attributes[oidMicrosoftFriendlyName.String()]; ok {
+		if name := decodeMicrosoftFriendlyName(value); name != "" {
+			return name
+		}
+	}
+	if e.Certificate != nil {
+		return e.Certificate.Subject.CommonName
+	}
+	return ""
+}
+
+// decodeMicrosoftFriendlyName decodes the value of the Windows friendly name
+// property: an OCTET STRING holding a NUL-terminated UTF-16LE string.  It
+// returns "" if value is malformed.
+func decodeMicrosoftFriendlyName(value []byte) string {
+	var utf16le []byte
+	if err := unmarshal(value, &utf16le); err != nil || len(utf16le)%2 != 0 {
+		return ""
+	}
+	s := make([]uint16, 0, len(utf16le)/2)
+	for i := 0; i < len(utf16le); i += 2 {
+		c := uint16(utf16le[i]) | uint16(utf16le[i+1])<<8
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+	}
+	return string(utf16.Decode(s))
+}
+
+// DecodeEntryByName extracts the entry whose Friendly Name is name from
+// pfxData.  It returns ErrEntryNotFound if there is no such entry, and
+// ErrAmbiguousName if there are several of them, as happens in files that
+// bundle several renewals of a certificate under the same alias; use
+// [DecodeEntriesByName] to get all of them.
+//
+// Every private key is paired with the certificate whose localKeyId matches
+// that of the key or, failing that, whose public key matches the key.  The
+// Friendly Name of a key entry is that of its key, or of its certificate if
+// the key has none, so that a key bag without attributes is found by the
+// name of its certificate, as some tools only name the certificate.
+// Certificates that are not paired with a key are entries of their own.
+func DecodeEntryByName(pfxData []byte, password, name string) (entry Entry, err error) {
+	return defaultDecodeOptions.DecodeEntryByName(pfxData, password, name)
+}
+
+// DecodeEntryByName is like the package-level [DecodeEntryByName], but uses the options in opts.
+func (opts *DecodeOptions) DecodeEntryByName(pfxData []byte, password, name string) (entry Entry, err error) {
+	entries, err := opts.DecodeEntriesByName(pfxData, password, name)
+	if err != nil {
+		return Entry{}, err
+	}
+	if len(entries) > 1 {
+		return Entry{}, ErrAmbiguousName
+	}
+	return entries[0], nil
+}
+
+// DecodeEntriesByName is like [DecodeEntryByName], but returns every entry
+// whose Friendly Name is name, in the order in which they appear in pfxData.
+func DecodeEntriesByName(pfxData []byte, password, name string) (entries []Entry, err error) {
+	return defaultDecodeOptions.DecodeEntriesByName(pfxData, password, name)
+}
+
+// DecodeEntriesByName is like the package-level [DecodeEntriesByName], but uses the options in opts.
+func (opts *DecodeOptions) DecodeEntriesByName(pfxData []byte, password, name string) (entries []Entry, err error) {
+	all, err := opts.decodeEntries(pfxData, password)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range all {
+		if entry.FriendlyName == name {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, ErrEntryNotFound
+	}
+	return entries, nil
+}
+
+// DecodeEntries extracts every entry from pfxData: first the private keys,
+// each with its certificate, then the certificates that don't belong to any
+// of them.  Use [Entry.DisplayName] to name entries that may lack a Friendly
+// Name.
+func DecodeEntries(pfxData []byte, password string) (entries []Entry, err error) {
+	return defaultDecodeOptions.DecodeEntries(pfxData, password)
+}
+
+// DecodeEntries is like the package-level [DecodeEntries], but uses the options in opts.
+func (opts *DecodeOptions) DecodeEntries(pfxData []byte, password string) (entries []Entry, err error) {
+	return opts.decodeEntries(pfxData, password)
+}
+
+// decodeEntries decodes all the entries of pfxData, key entries first.
+func (opts *DecodeOptions) decodeEntries(pfxData []byte, password string) (entries []Entry, err error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, opts.passwordError(pfxData, err)
+	}
+
+	kd := opts.newKeyDeriverFor(password)
+	bags, encodedPassword, err := opts.getSafeContents(pfxData, encodedPassword, kd, 1, opts.maxContentInfos())
+	if err != nil {
+		return nil, err
+	}
+
+	var keys, certs []Entry
+	for _, bag := range bags {
+		var e Entry
+		switch {
+		case bag.Id.Equal(oidCertBag):
+			certsData, err := decodeCertBag(bag.Value.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			parsedCerts, err := smx509.ParseCertificates(certsData)
+			if err != nil {
+				return nil, err
+			}
+			if len(parsedCerts) != 1 {
+				return nil, errors.New("pkcs12: expected exactly one certificate in the certBag")
+			}
+			e.Certificate = parsedCerts[0]
+		case bag.Id.Equal(oidKeyBag):
+			if e.PrivateKey, err = parsePkcs8PrivateKey(bag.Value.Bytes); err != nil {
+				return nil, err
+			}
+		case bag.Id.Equal(oidPKCS8ShroundedKeyBag):
+			keyPassword, err := opts.keyBagPassword(&bag, encodedPassword)
+			if err != nil {
+				return nil, err
+			}
+			if e.PrivateKey, err = decodePkcs8ShroudedKeyBag(bag.Value.Bytes, keyPassword, kd); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		if e.FriendlyName, err = bag.friendlyName(); err != nil {
+			return nil, err
+		}
+		e.LocalKeyID = bag.localKeyID()
+		e.Attributes = bag.attributeMap()
+		if e.PrivateKey != nil {
+			keys = append(keys, e)
+		} else {
+			certs = append(certs, e)
+		}
+	}
+
+	// pair keys with certificates by localKeyId first, then by public key
+	keyCerts := make([]int, len(keys))
+	paired := make([]bool, len(certs))
+	for i, key := range keys {
+		keyCerts[i] = -1
+		if len(key.LocalKeyID) == 0 {
+			continue
+		}
+		for j, cert := range certs {
+			if !paired[j] && bytes.Equal(cert.LocalKeyID, key.LocalKeyID) && publicKeyMatches(key.PrivateKey, cert.Certificate) != ErrKeyCertMismatch {
+				keyCerts[i], paired[j] = j, true
+				break
+			}
+		}
+	}
+	for i, key := range keys {
+		for j, cert := range certs {
+			if keyCerts[i] != -1 {
+				break
+			}
+			if !paired[j] && publicKeyMatches(key.PrivateKey, cert.Certificate) == nil {
+				keyCerts[i], paired[j] = j, true
+			}
+		}
+		if keyCerts[i] == -1 {
+			return nil, errors.New("pkcs12: certificate missing for private key")
+		}
+	}
+
+	for i, key := range keys {
+		cert := certs[keyCerts[i]]
+		key.Certificate = cert.Certificate
+		if key.FriendlyName == "" {
+			key.FriendlyName = cert.FriendlyName
+		}
+		if len(key.LocalKeyID) == 0 {
+			key.LocalKeyID = cert.LocalKeyID
+		}
+		for id, value := range cert.Attributes {
+			if _, ok := key.Attributes[id]; !ok {
+				if key.Attributes == nil {
+					key.Attributes = make(map[string][]byte)
+				}
+				key.Attributes[id] = value
+			}
+		}
+		entries = append(entries, key)
+	}
+	for j, cert := range certs {
+		if !paired[j] {
+			entries = append(entries, cert)
+		}
+	}
+
+	return entries, nil
+}
+
+// Secret is a secret bag of a PKCS#12 file, such as a secret key stored by
+// a Java KeyStore.
+type Secret struct {
+	// TypeOID is the type of the secret.  For a secret key stored as a
+	// PKCS#8 EncryptedPrivateKeyInfo, as Java does, it is the algorithm of
+	// the key, such as AES.
+	TypeOID asn1.ObjectIdentifier
+	// Value is the decrypted secret.
+	Value        []byte
+	FriendlyName string
+}
+
+// DecodeAllSecrets extracts every secret bag from pfxData, in the order in
+// which they appear, with its type, decrypted value and Friendly Name.  Other
+// bags are ignored.  It returns an empty slice if there are no secret bags.
+func DecodeAllSecrets(pfxData []byte, password string) (secrets []Secret, err error) {
+	return defaultDecodeOptions.DecodeAllSecrets(pfxData, password)
+}
+
+// DecodeAllSecrets is like the package-level [DecodeAllSecrets], but uses the options in opts.
+func (opts *DecodeOptions) DecodeAllSecrets(pfxData []byte, password string) (secrets []Secret, err error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, opts.passwordError(pfxData, err)
+	}
+
+	kd := opts.newKeyDeriverFor(password)
+	bags, encodedPassword, err := opts.getSafeContents(pfxData, encodedPassword, kd, 1, opts.maxContentInfos())
+	if err != nil {
+		return nil, err
+	}
+
+	secrets = []Secret{}
+	for _, bag := range bags {
+		if !bag.Id.Equal(oidSecretBag) {
+			continue
+		}
+		keyPassword, err := opts.keyBagPassword(&bag, encodedPassword)
+		if err != nil {
+			return nil, err
+		}
+		var secret Secret
+		if secret.TypeOID, secret.Value, err = decodeSecretBag(bag.Value.Bytes, keyPassword, kd); err != nil {
+			return nil, err
+		}
+		if secret.FriendlyName, err = bag.friendlyName(); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
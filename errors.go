@@ -4,15 +4,45 @@
 
 package pkcs12
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 var (
-	// ErrDecryption represents a failure to decrypt the input.
+	// ErrDecryption represents a failure to decrypt the input: its padding
+	// or the decrypted plaintext is malformed.  This is usually caused by a
+	// wrong password or corrupted ciphertext.
 	ErrDecryption = errors.New("pkcs12: decryption error, incorrect padding")
 
+	// ErrDecryptionFailed is another name for [ErrDecryption].
+	ErrDecryptionFailed = ErrDecryption
+
 	// ErrIncorrectPassword is returned when an incorrect password is detected.
 	// Usually, P12/PFX data is signed to be able to verify the password.
 	ErrIncorrectPassword = errors.New("pkcs12: decryption password incorrect")
+
+	// ErrInvalidSignature is returned when the signature of a PFX in
+	// public-key integrity mode doesn't verify against the expected signer,
+	// or when no signer is expected; see [DecodeOptions.SignerCertificate].
+	ErrInvalidSignature = errors.New("pkcs12: invalid signature")
+
+	// ErrKeyCertMismatch is returned when the private key doesn't belong to
+	// the certificate it is paired with.
+	ErrKeyCertMismatch = errors.New("pkcs12: private key does not match the certificate")
+
+	// ErrEntryNotFound is returned when no entry has the requested friendly
+	// name.
+	ErrEntryNotFound = errors.New("pkcs12: no entry with this friendly name")
+
+	// ErrAmbiguousName is returned when a single entry is requested by its
+	// friendly name, but several entries have this name.
+	ErrAmbiguousName = errors.New("pkcs12: several entries have this friendly name")
+
+	// ErrTruncated is returned, wrapped in an error that gives the details,
+	// when the input is shorter than the PFX it starts with declares, such
+	// as an incomplete download.
+	ErrTruncated = errors.New("pkcs12: truncated input")
 )
 
 // NotImplementedError indicates that the input is not currently supported.
@@ -21,3 +51,28 @@ type NotImplementedError string
 func (e NotImplementedError) Error() string {
 	return "pkcs12: " + string(e)
 }
+
+// A parseError is an error in the ASN.1 structure of the input.  where
+// describes the structure that failed to parse, such as "safe bag #3 in
+// encrypted content #1".
+type parseError struct {
+	where string
+	err   error
+}
+
+func (e *parseError) Error() string {
+	return "pkcs12: failed to parse " + e.where + ": " + strings.TrimPrefix(e.err.Error(), "pkcs12: ")
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// inParseContext returns err, if it is a parseError, with where added to
+// the structures that it occurred in.  Other errors are returned unchanged.
+func inParseContext(err error, where string) error {
+	if e, ok := err.(*parseError); ok {
+		return &parseError{where: e.where + " in " + where, err: e.err}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExtractEncryptedKey returns the PKCS#8 EncryptedPrivateKeyInfo of the
+// private key in pfxData, DER-encoded, without decrypting it.  The result is
+// ciphertext: it can be decrypted later with the password of pfxData, e.g. by
+// a component that holds the password but not pfxData.
+//
+// No password is needed because the shrouded key bag is usually stored in an
+// unencrypted SafeContents, but for the same reason the MAC of pfxData is not
+// verified.  An error is returned if pfxData doesn't contain exactly one
+// shrouded key bag outside of its encrypted contents.
+func ExtractEncryptedKey(pfxData []byte) (encPKCS8DER []byte, err error) {
+	bags, err := plaintextSafeBags(pfxData, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, bag := range bags {
+		if !bag.Id.Equal(oidPKCS8ShroundedKeyBag) {
+			continue
+		}
+		if encPKCS8DER != nil {
+			return nil, errors.New("pkcs12: expected exactly one key bag")
+		}
+		encPKCS8DER = bag.Value.Bytes
+	}
+	if encPKCS8DER == nil {
+		return nil, errors.New("pkcs12: no shrouded key bag in the unencrypted contents")
+	}
+	return encPKCS8DER, nil
+}
+
+// plaintextSafeBags returns the bags in the unencrypted SafeContents of
+// pfxData, without verifying its MAC.  If skipUnparseable is true, the
+// SafeContents that can't be parsed are skipped instead of returning an
+// error.
+func plaintextSafeBags(pfxData []byte, skipUnparseable bool) (bags []safeBag, err error) {
+	if err := checkTruncated(pfxData); err != nil {
+		return nil, err
+	}
+	pfx, err := parsePFX(pfxData)
+	if err != nil {
+		return nil, errors.New("pkcs12: error reading P12 data: " + err.Error())
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, NotImplementedError("only password-protected PFX are implemented")
+	}
+	var authenticatedSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+		return nil, &parseError{where: "authSafe", err: err}
+	}
+	authenticatedSafe, err := parseAuthenticatedSafe(authenticatedSafeBytes)
+	if err != nil {
+		return nil, err
+	}
+	for i, ci := range authenticatedSafe {
+		if !ci.ContentType.Equal(oidDataContentType) {
+			continue
+		}
+		where := fmt.Sprintf("content #%d", i+1)
+		var data []byte
+		if err := unmarshal(ci.Content.Bytes, &data); err != nil {
+			if skipUnparseable {
+				continue
+			}
+			return nil, &parseError{where: where, err: err}
+		}
+		safeContents, err := parseSafeContents(data)
+		if err == nil {
+			safeContents, err = flattenSafeContents(safeContents, 0, defaultMaxNestingDepth)
+		}
+		if err != nil {
+			if skipUnparseable {
+				continue
+			}
+			return nil, inParseContext(err, where)
+		}
+		bags = append(bags, safeContents...)
+	}
+	return bags, nil
+}
+
+// DecryptContentInfo returns the SafeContents held by der, a DER-encoded
+// ContentInfo of an AuthenticatedSafe, for callers that parse PKCS#12 files
+// themselves.  A ContentInfo of type encryptedData is decrypted with
+// password, using any of the PBES1, PKCS#12 PBE or PBES2 algorithms
+// supported by this package; the contents of a ContentInfo of type data are
+// returned as they are.  The result is the DER encoding of the SafeContents.
+//
+// As the MAC of the PFX is not verified, a wrong password is only detected
+// if the decrypted plaintext is malformed, in which case ErrDecryption is
+// returned.
+func DecryptContentInfo(der []byte, password string) (safeContents []byte, err error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, err
+	}
+	var ci contentInfo
+	if err := unmarshal(der, &ci); err != nil {
+		return nil, errors.New("pkcs12: error reading ContentInfo: " + err.Error())
+	}
+	if safeContents, err = decryptContentInfo(ci, encodedPassword, nil); err != nil {
+		return nil, err
+	}
+	if ci.ContentType.Equal(oidEncryptedDataContentType) {
+		var raw asn1.RawValue
+		if err := unmarshal(safeContents, &raw); err != nil {
+			return nil, ErrDecryption
+		}
+	}
+	return safeContents, nil
+}
+
+// StripPrivateKey returns a copy of pfxData, protected with password,
+// without its private keys, e.g. to share a certificate and its chain.  The
+// certificates are kept in their order with their attributes, such as their
+// Friendly Names, except for localKeyId, which referred to a private key;
+// they are encrypted again with newPassword, using the certificate
+// encryption algorithm and parameters of enc, and the copy is MACed as
+// configured by enc.  The private keys are not decrypted.
+//
+// To produce a Java trust store instead, decode the certificates and encode
+// them with [Encoder.EncodeTrustStoreEntries].
+func StripPrivateKey(rand io.Reader, pfxData []byte, password, newPassword string, enc *Encoder) ([]byte, error) {
+	if enc.macAlgorithm == nil && enc.certAlgorithm == nil && newPassword != "" {
+		return nil, errors.New("password must be empty")
+	}
+
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, defaultDecodeOptions.passwordError(pfxData, err)
+	}
+	bags, _, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, defaultDecodeOptions.newKeyDeriverFor(password), 1, defaultDecodeOptions.maxContentInfos())
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	for _, bag := range bags {
+		if !bag.Id.Equal(oidCertBag) {
+			continue
+		}
+		var attributes []pkcs12Attribute
+		if !enc.omitAttributes {
+			for _, attr := range bag.Attributes {
+				if !attr.Id.Equal(oidLocalKeyID) {
+					attributes = append(attributes, attr)
+				}
+			}
+		}
+		bag.Attributes = attributes
+		certBags = append(certBags, bag)
+	}
+	if len(certBags) == 0 {
+		return nil, errors.New("pkcs12: certificate missing")
+	}
+
+	encodedNewPassword, err := enc.encodePassword(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	return enc.WithRand(rand).encodeCertBags(certBags, encodedNewPassword)
+}
@@ -0,0 +1,104 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// DecodeInfo holds information about a PKCS#12 file that is found while
+// decoding it.
+type DecodeInfo struct {
+	// KeyCurve is the named curve of an EC or SM2 private key, as found in
+	// its PKCS#8 encoding.  It is nil for other keys.
+	KeyCurve asn1.ObjectIdentifier
+
+	// KeyBits is the size in bits of the modulus of an RSA private key.  It
+	// is zero for other keys.
+	KeyBits int
+
+	// KeyAlgorithm is the algorithm of the private key, as found in its
+	// PKCS#8 encoding.  For an RSA key restricted to RSASSA-PSS, it is
+	// id-RSASSA-PSS, with the RSASSA-PSS-params restrictions if any.
+	KeyAlgorithm pkix.AlgorithmIdentifier
+
+	// Warnings reports weak protection of the file, such as a low number
+	// of MAC iterations or legacy encryption algorithms.
+	Warnings []Warning
+
+	bagDigests  map[string][]byte // of the shrouded key bags, by localKeyId
+	encryptions []string          // descriptions of the encryptions of the contents and the key
+	integrity   string            // description of the MAC or signature
+	keyDER      []byte            // PKCS#8 encoding of the private key, as found in the file
+}
+
+// String returns a one-line summary of the protection of the file and of
+// its private key, for logging, such as
+//
+//	PBES2/PBKDF2-HMAC-SHA256/AES-256-CBC, 2048 iterations; SHA256 MAC, 2048 iterations; EC P-256 key
+//
+// Algorithms without a name are given as numeric object identifiers.  The
+// format is stable, but new algorithms may be named in the future.
+func (info *DecodeInfo) String() string {
+	parts := append([]string(nil), info.encryptions...)
+	if info.integrity != "" {
+		parts = append(parts, info.integrity)
+	}
+	if len(info.KeyAlgorithm.Algorithm) != 0 {
+		key := oidName(info.KeyAlgorithm.Algorithm)
+		switch {
+		case info.KeyCurve != nil:
+			key += " " + oidName(info.KeyCurve)
+		case info.KeyBits != 0:
+			key += fmt.Sprintf(" %d-bit", info.KeyBits)
+		}
+		parts = append(parts, key+" key")
+	}
+	if len(info.Warnings) != 0 {
+		parts = append(parts, pluralize(len(info.Warnings), "warning"))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// pluralize returns n followed by noun, in the plural unless n is 1.
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// KeyBagDigest returns the SHA-256 digest of the shrouded private key bag
+// (its EncryptedPrivateKeyInfo, before decryption) whose localKeyId
+// attribute is localKeyID, or nil if there is no such bag.  It can be
+// logged to correlate the distributions of a file without revealing the
+// key: since the encryption uses a random salt, the digest is the same for
+// copies of a file, but differs between two encodings of the same key.
+//
+// Only shrouded key bags have a digest: certificate bags are not encrypted
+// one by one, and share their localKeyId with the key bag.
+func (info *DecodeInfo) KeyBagDigest(localKeyID []byte) []byte {
+	return info.bagDigests[string(localKeyID)]
+}
+
+// DecodeChainWithInfo is like [DecodeChain], but also returns information
+// about pfxData, e.g. to enforce a policy on the private key.
+func DecodeChainWithInfo(pfxData []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, info *DecodeInfo, err error) {
+	return defaultDecodeOptions.DecodeChainWithInfo(pfxData, password)
+}
+
+// DecodeChainWithInfo is like the package-level [DecodeChainWithInfo], but uses the options in opts.
+func (opts *DecodeOptions) DecodeChainWithInfo(pfxData []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, info *DecodeInfo, err error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, nil, nil, nil, opts.passwordError(pfxData, err)
+	}
+	return opts.decodeChainWithInfo(pfxData, encodedPassword, opts.newKeyDeriverFor(password))
+}
@@ -0,0 +1,126 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import "fmt"
+
+// LayoutContents is a set of the bags written by [Encoder.Encode].
+type LayoutContents int
+
+const (
+	// LayoutKey is the bag of the private key.
+	LayoutKey LayoutContents = 1 << iota
+	// LayoutLeafCert is the bag of the end-entity certificate.
+	LayoutLeafCert
+	// LayoutCACerts are the bags of the CA certificates.
+	LayoutCACerts
+)
+
+// A LayoutBlock is a SafeContents of the AuthenticatedSafe written by
+// [Encoder.Encode].
+type LayoutBlock struct {
+	// Contents are the bags that the SafeContents holds.
+	Contents LayoutContents
+	// Encrypted reports whether the SafeContents is wrapped in an
+	// EncryptedData, using the certificate encryption algorithm of the
+	// Encoder, rather than in a plaintext Data.  The private key is
+	// shrouded with the key encryption algorithm of the Encoder either way.
+	Encrypted bool
+}
+
+// A Layout is the list of the SafeContents written by [Encoder.Encode], in
+// order.  Each of the private key, the end-entity certificate and the CA
+// certificates must be in exactly one of them.  SafeContents that would be
+// empty, such as one holding only the CA certificates when there are none,
+// are not written.  See [Encoder.WithLayout].
+type Layout []LayoutBlock
+
+var (
+	// OpenSSLLayout is the layout of the files written by OpenSSL, and
+	// the default: an encrypted SafeContents with the certificates,
+	// followed by a plaintext one with the private key.
+	OpenSSLLayout = Layout{
+		{Contents: LayoutLeafCert | LayoutCACerts, Encrypted: true},
+		{Contents: LayoutKey},
+	}
+
+	// WindowsLayout is the layout of the files exported by Windows: a
+	// plaintext SafeContents with the private key, followed by an
+	// encrypted one with the certificates.
+	WindowsLayout = Layout{
+		{Contents: LayoutKey},
+		{Contents: LayoutLeafCert | LayoutCACerts, Encrypted: true},
+	}
+
+	// JavaLayout is the layout of the files written by Java's keytool.  It
+	// is the same as [WindowsLayout], a plaintext SafeContents with the
+	// private key followed by an encrypted one with the certificates, and
+	// is only a separate name so that callers can state which software
+	// they target.
+	JavaLayout = WindowsLayout
+)
+
+// validate returns an error if layout doesn't hold each of the private key,
+// the end-entity certificate and the CA certificates exactly once.
+func (layout Layout) validate() error {
+	var seen LayoutContents
+	for _, block := range layout {
+		if block.Contents&^(LayoutKey|LayoutLeafCert|LayoutCACerts) != 0 {
+			return fmt.Errorf("pkcs12: unknown layout contents %#x", int(block.Contents))
+		}
+		if seen&block.Contents != 0 {
+			return fmt.Errorf("pkcs12: layout contents %#x are in more than one block", int(seen&block.Contents))
+		}
+		seen |= block.Contents
+	}
+	if seen != LayoutKey|LayoutLeafCert|LayoutCACerts {
+		return fmt.Errorf("pkcs12: layout contents %#x are in no block", int((LayoutKey|LayoutLeafCert|LayoutCACerts)&^seen))
+	}
+	return nil
+}
+
+// WithLayout creates a new Encoder identical to enc except that
+// [Encoder.Encode] arranges the bags of the private key and of the
+// certificates in the SafeContents given by layout, for importers that
+// expect a particular layout.  The default is [OpenSSLLayout].
+//
+// Panics if layout doesn't hold each of the private key, the end-entity
+// certificate and the CA certificates exactly once.
+func (enc Encoder) WithLayout(layout Layout) *Encoder {
+	if err := layout.validate(); err != nil {
+		panic(err.Error())
+	}
+	enc.layout = append(Layout(nil), layout...)
+	return &enc
+}
+
+// A BagOrder is the order of the bags within a SafeContents written by
+// [Encoder.Encode].  See [Encoder.WithBagOrder].
+type BagOrder int
+
+const (
+	// CertFirst writes the end-entity certificate, then the CA
+	// certificates, then the private key.
+	CertFirst BagOrder = iota
+	// KeyFirst writes the private key, then the end-entity certificate,
+	// then the CA certificates.
+	KeyFirst
+)
+
+// WithBagOrder creates a new Encoder identical to enc except that
+// [Encoder.Encode] writes the bags of a SafeContents that holds both the
+// private key and certificates in the given order, for importers that
+// expect a particular one.  The default is [CertFirst].  The order only
+// matters with a layout that puts the private key and certificates in the
+// same SafeContents, such as the one of [DotNet]; see [Encoder.WithLayout].
+//
+// Panics if order is unknown.
+func (enc Encoder) WithBagOrder(order BagOrder) *Encoder {
+	if order < CertFirst || order > KeyFirst {
+		panic(fmt.Sprintf("pkcs12: unknown bag order %d", order))
+	}
+	enc.bagOrder = order
+	return &enc
+}
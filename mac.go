@@ -11,9 +11,12 @@ import (
 	"crypto/sha256"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"errors"
 	"hash"
+	"runtime"
 
 	"github.com/emmansun/gmsm/sm3"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 type macData struct {
@@ -28,34 +31,82 @@ type digestInfo struct {
 	Digest    []byte
 }
 
+//	PBMAC1-params ::= SEQUENCE {
+//		keyDerivationFunc AlgorithmIdentifier {{PBMAC1-KDFs}},
+//		messageAuthScheme AlgorithmIdentifier {{PBMAC1-MACs}}
+//	}
+type pbmac1Params struct {
+	Kdf               pkix.AlgorithmIdentifier
+	MessageAuthScheme pkix.AlgorithmIdentifier
+}
+
 var (
 	oidSHA1   = asn1.ObjectIdentifier([]int{1, 3, 14, 3, 2, 26})
 	oidSHA256 = asn1.ObjectIdentifier([]int{2, 16, 840, 1, 101, 3, 4, 2, 1})
 	oidSM3    = asn1.ObjectIdentifier([]int{1, 2, 156, 10197, 1, 401})
+	oidPBMAC1 = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 5, 14}) // rfc9579
 )
 
-func doMac(macData *macData, message, password []byte) ([]byte, error) {
-	var hFn func() hash.Hash
-	var key []byte
-	switch {
-	case macData.Mac.Algorithm.Algorithm.Equal(oidSHA1):
-		hFn = sha1.New
-		key = pbkdf(sha1Sum, 20, 64, macData.MacSalt, password, macData.Iterations, 3, 20)
-	case macData.Mac.Algorithm.Algorithm.Equal(oidSHA256):
-		hFn = sha256.New
-		key = pbkdf(sha256Sum, 32, 64, macData.MacSalt, password, macData.Iterations, 3, 32)
-	case macData.Mac.Algorithm.Algorithm.Equal(oidSM3):
-		hFn = sm3.New
-		key = pbkdf(sm3Sum, 32, 64, macData.MacSalt, password, macData.Iterations, 3, 32)
-	default:
-		return nil, NotImplementedError("unknown digest algorithm: " + macData.Mac.Algorithm.Algorithm.String())
+// defaultParallelKDFThreshold is the default number of MAC iterations from
+// which the MAC key is derived concurrently with the other keys.  Below it,
+// the cost of a goroutine outweighs the gain.
+const defaultParallelKDFThreshold = 10000
+
+// useParallelKDF reports whether a MAC key derived with the given number of
+// iterations should be derived concurrently with the other key derivations.
+// threshold is that of [DecodeOptions.ParallelKDFThreshold] or
+// [Encoder.WithParallelKDFThreshold]: zero for the default, or negative to
+// never derive keys concurrently.
+func useParallelKDF(threshold, iterations int) bool {
+	if threshold == 0 {
+		threshold = defaultParallelKDFThreshold
+	}
+	return threshold > 0 && iterations >= threshold && runtime.GOMAXPROCS(0) > 1
+}
+
+// ComputeMAC computes the MAC of message as it is stored in the MacData of a
+// PKCS#12 file.  password is the plain (UTF-8) password; it is encoded as
+// required by algorithm.
+//
+// algorithm is either a digest algorithm (SHA-1, SHA-256 or SM3), in which
+// case the HMAC key is derived with the PKCS#12 KDF from salt and iterations,
+// or PBMAC1, in which case the HMAC-SHA-256 key is derived with
+// PBKDF2-HMAC-SHA-256 from salt and iterations.
+func ComputeMAC(algorithm asn1.ObjectIdentifier, message, password, salt []byte, iterations int) ([]byte, error) {
+	md := &macData{MacSalt: salt, Iterations: iterations}
+	md.Mac.Algorithm.Algorithm = algorithm
+	if algorithm.Equal(oidPBMAC1) {
+		var err error
+		if md.Mac.Algorithm.Parameters.FullBytes, err = makePBMAC1Parameters(oidHmacWithSHA256, oidHmacWithSHA256, salt, iterations, 32); err != nil {
+			return nil, err
+		}
+	}
+	encodedPassword, err := bmpStringZeroTerminated(string(password))
+	if err != nil {
+		return nil, err
 	}
+	return doMac(md, message, encodedPassword)
+}
 
-	mac := hmac.New(hFn, key)
+func doMac(macData *macData, message, password []byte) ([]byte, error) {
+	mac, err := newMacHash(macData, password)
+	if err != nil {
+		return nil, err
+	}
 	mac.Write(message)
 	return mac.Sum(nil), nil
 }
 
+// newMacHash returns the MAC of macData keyed with password, to which the
+// message may be written incrementally.
+func newMacHash(macData *macData, password []byte) (hash.Hash, error) {
+	hFn, key, err := deriveMacKey(macData, password)
+	if err != nil {
+		return nil, err
+	}
+	return hmac.New(hFn, key), nil
+}
+
 func verifyMac(macData *macData, message, password []byte) error {
 	expectedMAC, err := doMac(macData, message, password)
 	if err != nil {
@@ -75,3 +126,159 @@ func computeMac(macData *macData, message, password []byte) error {
 	macData.Mac.Digest = digest
 	return nil
 }
+
+// deriveMacKey derives the MAC key of macData from password.  It is the
+// expensive part of computing a MAC, and doesn't depend on the message.
+//
+// Some producers identify the MAC by its HMAC algorithm (e.g. hmacWithSHA256)
+// rather than by its digest algorithm; it is the same PKCS#12 MAC.
+func deriveMacKey(macData *macData, password []byte) (hFn func() hash.Hash, key []byte, err error) {
+	var size int
+	switch {
+	case macData.Mac.Algorithm.Algorithm.Equal(oidSHA1) || macData.Mac.Algorithm.Algorithm.Equal(oidHmacWithSHA1):
+		hFn, size = sha1.New, 20
+	case macData.Mac.Algorithm.Algorithm.Equal(oidSHA256) || macData.Mac.Algorithm.Algorithm.Equal(oidHmacWithSHA256):
+		hFn, size = sha256.New, 32
+	case macData.Mac.Algorithm.Algorithm.Equal(oidSM3) || macData.Mac.Algorithm.Algorithm.Equal(oidHmacWithSM3):
+		hFn, size = sm3.New, 32
+	case macData.Mac.Algorithm.Algorithm.Equal(oidPBMAC1):
+		return derivePBMAC1Key(macData.Mac.Algorithm, password)
+	default:
+		return nil, nil, NotImplementedError("unknown digest algorithm: " + macData.Mac.Algorithm.Algorithm.String())
+	}
+	keyLength, err := macKeyLength(macData.Mac.Algorithm, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = pbkdf(hFn, size, 64, macData.MacSalt, password, macData.Iterations, 3, keyLength)
+	return hFn, key, nil
+}
+
+// macKeyLength returns the length of the key of a PKCS#12 MAC with the
+// given digest algorithm, whose digest is size bytes long.  The key is as
+// long as the digest, unless, as in files from some ShangMi tools, the
+// parameters of an SM3 MAC are an INTEGER overriding the key length, like
+// the keyLength of the PBKDF2 parameters of PBMAC1.  Other parameters are
+// ignored.
+func macKeyLength(algorithm pkix.AlgorithmIdentifier, size int) (int, error) {
+	params := algorithm.Parameters
+	if !algorithm.Algorithm.Equal(oidSM3) || params.Class != asn1.ClassUniversal || params.Tag != asn1.TagInteger {
+		return size, nil
+	}
+	var keyLength int
+	if err := unmarshal(params.FullBytes, &keyLength); err != nil || keyLength <= 0 || keyLength > 64 {
+		return 0, errors.New("pkcs12: invalid MAC key length")
+	}
+	return keyLength, nil
+}
+
+// macIterations returns the number of KDF iterations used to derive the MAC
+// key of macData, or 0 if it can't be determined.
+func macIterations(macData *macData) int {
+	_, iterations := macKDFParameters(macData)
+	return iterations
+}
+
+// macDescription describes the MAC algorithm of macData for
+// [DecodeInfo.String].
+func macDescription(macData *macData) string {
+	_, iterations := macKDFParameters(macData)
+	algorithm := macData.Mac.Algorithm
+	if !algorithm.Algorithm.Equal(oidPBMAC1) {
+		return oidName(algorithm.Algorithm) + " MAC, " + pluralize(iterations, "iteration")
+	}
+	var params pbmac1Params
+	var kdfParams pbkdf2Params
+	if unmarshal(algorithm.Parameters.FullBytes, &params) != nil || unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams) != nil {
+		return "PBMAC1 MAC"
+	}
+	prf := kdfParams.Prf.Algorithm
+	if len(prf) == 0 {
+		prf = oidHmacWithSHA1
+	}
+	return "PBMAC1/" + oidName(params.Kdf.Algorithm) + "-" + oidName(prf) + "/" + oidName(params.MessageAuthScheme.Algorithm) + " MAC, " + pluralize(iterations, "iteration")
+}
+
+// macKDFParameters returns the salt and number of iterations used to derive
+// the MAC key of macData, which PBMAC1 carries in its PBKDF2 parameters, or
+// nil and 0 if they can't be determined.
+func macKDFParameters(macData *macData) (salt []byte, iterations int) {
+	if !macData.Mac.Algorithm.Algorithm.Equal(oidPBMAC1) {
+		return macData.MacSalt, macData.Iterations
+	}
+	var params pbmac1Params
+	if err := unmarshal(macData.Mac.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, 0
+	}
+	var kdfParams pbkdf2Params
+	if err := unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, 0
+	}
+	return kdfParams.Salt.Bytes, kdfParams.Iterations
+}
+
+// derivePBMAC1Key derives the key of a PBMAC1 (RFC 9579) MAC.  Like PBES2,
+// PBMAC1 uses the password encoded as UTF-8 rather than as a BMPString.
+func derivePBMAC1Key(algorithm pkix.AlgorithmIdentifier, password []byte) (hFn func() hash.Hash, key []byte, err error) {
+	var params pbmac1Params
+	if err := unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, nil, err
+	}
+	if !params.Kdf.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, NotImplementedError("pbmac1 kdf algorithm " + params.Kdf.Algorithm.String() + " is not supported")
+	}
+	var kdfParams pbkdf2Params
+	if err := unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, nil, err
+	}
+	if kdfParams.Salt.Tag != asn1.TagOctetString {
+		return nil, nil, errors.New("pkcs12: only octet string salts are supported for pbkdf2")
+	}
+	if kdfParams.KeyLength <= 0 {
+		return nil, nil, errors.New("pkcs12: pbmac1 requires a pbkdf2 key length")
+	}
+	// pbkdf2.Key treats 0 or fewer iterations like 1, but RFC 8018 requires
+	// a positive iteration count.
+	if kdfParams.Iterations < 1 {
+		return nil, nil, errors.New("pkcs12: pbmac1 requires at least one pbkdf2 iteration")
+	}
+	prf, err := prfFor(kdfParams.Prf.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	hFn, err = prfFor(params.MessageAuthScheme.Algorithm)
+	if err != nil || len(params.MessageAuthScheme.Algorithm) == 0 {
+		return nil, nil, NotImplementedError("pbmac1 message authentication scheme " + params.MessageAuthScheme.Algorithm.String() + " is not supported")
+	}
+
+	originalPassword, err := decodeBMPString(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = pbkdf2.Key([]byte(originalPassword), kdfParams.Salt.Bytes, kdfParams.Iterations, kdfParams.KeyLength, prf)
+	return hFn, key, nil
+}
+
+// makePBMAC1Parameters creates a PBMAC1-params structure.
+func makePBMAC1Parameters(prf, messageAuthScheme asn1.ObjectIdentifier, salt []byte, iterations, keyLength int) ([]byte, error) {
+	var err error
+
+	var kdfparams pbkdf2Params
+	if kdfparams.Salt.FullBytes, err = asn1.Marshal(salt); err != nil {
+		return nil, err
+	}
+	kdfparams.Iterations = iterations
+	kdfparams.KeyLength = keyLength
+	if !prf.Equal(oidHmacWithSHA1) { // DEFAULT, omitted in DER
+		kdfparams.Prf.Algorithm = prf
+	}
+
+	var params pbmac1Params
+	params.Kdf.Algorithm = oidPBKDF2
+	if params.Kdf.Parameters.FullBytes, err = asn1.Marshal(kdfparams); err != nil {
+		return nil, err
+	}
+	params.MessageAuthScheme.Algorithm = messageAuthScheme
+
+	return asn1.Marshal(params)
+}
@@ -7,8 +7,13 @@ package pkcs12
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func TestVerifyMac(t *testing.T) {
@@ -71,3 +76,161 @@ func TestComputeMac(t *testing.T) {
 	}
 
 }
+
+func TestComputeMACExported(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	message := []byte{11, 12, 13, 14, 15}
+
+	digest, err := ComputeMAC(oidSHA1, message, []byte("Sesame open"), salt, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDigest := []byte{0x18, 0x20, 0x3d, 0xff, 0x1e, 0x16, 0xf4, 0x92, 0xf2, 0xaf, 0xc8, 0x91, 0xa9, 0xba, 0xd6, 0xca, 0x9d, 0xee, 0x51, 0x93}
+	if !bytes.Equal(digest, expectedDigest) {
+		t.Errorf("Computed incorrect MAC; expected MAC to be '%x' but got '%x'", expectedDigest, digest)
+	}
+
+	if _, err := ComputeMAC(asn1.ObjectIdentifier([]int{1, 2, 3}), message, nil, salt, 2048); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+
+	// SM3 must agree with the MAC verified on decode.
+	digest, err = ComputeMAC(oidSM3, message, []byte("Sesame open"), salt, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := macData{Mac: digestInfo{Digest: digest}, MacSalt: salt, Iterations: 2048}
+	td.Mac.Algorithm.Algorithm = oidSM3
+	password, _ := bmpStringZeroTerminated("Sesame open")
+	if err := verifyMac(&td, message, password); err != nil {
+		t.Errorf("SM3: %v", err)
+	}
+}
+
+func TestPBMAC1(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	message := []byte{11, 12, 13, 14, 15}
+
+	digest, err := ComputeMAC(oidPBMAC1, message, []byte("Sesame open"), salt, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pbkdf2.Key([]byte("Sesame open"), salt, 2048, 32, sha256.New)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	if expected := mac.Sum(nil); !bytes.Equal(digest, expected) {
+		t.Errorf("Computed incorrect MAC; expected MAC to be '%x' but got '%x'", expected, digest)
+	}
+
+	params, err := makePBMAC1Parameters(oidHmacWithSHA256, oidHmacWithSHA256, salt, 2048, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := macData{Mac: digestInfo{Digest: digest}, MacSalt: []byte{0}, Iterations: 1}
+	td.Mac.Algorithm.Algorithm = oidPBMAC1
+	td.Mac.Algorithm.Parameters.FullBytes = params
+	password, _ := bmpStringZeroTerminated("Sesame open")
+	if err := verifyMac(&td, message, password); err != nil {
+		t.Errorf("err: %v", err)
+	}
+	password, _ = bmpStringZeroTerminated("wrong")
+	if err := verifyMac(&td, message, password); err != ErrIncorrectPassword {
+		t.Errorf("Expected incorrect password, got err: %v", err)
+	}
+
+	// PBMAC1 requires an explicit key length.
+	if td.Mac.Algorithm.Parameters.FullBytes, err = makePBMAC1Parameters(oidHmacWithSHA256, oidHmacWithSHA256, salt, 2048, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyMac(&td, message, password); err == nil {
+		t.Error("expected error for missing key length")
+	}
+
+	// A single iteration is valid, but 0 or a negative count is not.
+	password, _ = bmpStringZeroTerminated("Sesame open")
+	if td.Mac.Digest, err = ComputeMAC(oidPBMAC1, message, []byte("Sesame open"), salt, 1); err != nil {
+		t.Fatal(err)
+	}
+	if td.Mac.Algorithm.Parameters.FullBytes, err = makePBMAC1Parameters(oidHmacWithSHA256, oidHmacWithSHA256, salt, 1, 32); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyMac(&td, message, password); err != nil {
+		t.Errorf("1 iteration: %v", err)
+	}
+	for _, iterations := range []int{0, -1} {
+		if td.Mac.Algorithm.Parameters.FullBytes, err = makePBMAC1Parameters(oidHmacWithSHA256, oidHmacWithSHA256, salt, iterations, 32); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyMac(&td, message, password); err == nil || err == ErrIncorrectPassword {
+			t.Errorf("%d iterations: got %v, want an error about the iteration count", iterations, err)
+		}
+	}
+}
+
+func BenchmarkDoMac(b *testing.B) {
+	message := make([]byte, 4096)
+	password, _ := bmpStringZeroTerminated("password")
+	for _, test := range []struct {
+		name      string
+		algorithm asn1.ObjectIdentifier
+	}{
+		{"SHA1", oidSHA1},
+		{"SHA256", oidSHA256},
+		{"SM3", oidSM3},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			md := &macData{MacSalt: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Iterations: 2048}
+			md.Mac.Algorithm.Algorithm = test.algorithm
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := doMac(md, message, password); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMacKeyLength(t *testing.T) {
+	for _, test := range []struct {
+		algorithm  asn1.ObjectIdentifier
+		params     []byte
+		expected   int
+		shouldFail bool
+	}{
+		{oidSM3, nil, 32, false},
+		{oidSM3, []byte{5, 0}, 32, false},
+		{oidSM3, []byte{2, 1, 16}, 16, false},
+		{oidSM3, []byte{2, 1, 0}, 0, true},
+		{oidSM3, []byte{2, 1, 65}, 0, true},
+		// other parameters are ignored, as they always were
+		{oidSM3, []byte{4, 1, 16}, 32, false},
+		{oidSHA256, []byte{4, 1, 16}, 32, false},
+		{oidSHA1, []byte{0x30, 0}, 20, false},
+		// the key length is only overridden for SM3
+		{oidSHA256, []byte{2, 1, 16}, 32, false},
+	} {
+		var alg pkix.AlgorithmIdentifier
+		alg.Algorithm = test.algorithm
+		alg.Parameters.FullBytes = test.params
+		if len(test.params) > 0 {
+			if _, err := asn1.Unmarshal(test.params, &alg.Parameters); err != nil {
+				t.Fatal(err)
+			}
+		}
+		size := 32
+		if test.algorithm.Equal(oidSHA1) {
+			size = 20
+		}
+		keyLength, err := macKeyLength(alg, size)
+		if test.shouldFail {
+			if err == nil {
+				t.Errorf("%v parameters %x: expected an error, got %d", test.algorithm, test.params, keyLength)
+			}
+			continue
+		}
+		if err != nil || keyLength != test.expected {
+			t.Errorf("%v parameters %x: expected %d, got %d (%v)", test.algorithm, test.params, test.expected, keyLength, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import "encoding/asn1"
+
+// Object identifiers of the algorithms supported by this package, for use
+// with options such as [Encoder.WithMACAlgorithm] and [Encoder.WithKeyBagCipher].
+// They don't share their storage with the identifiers that this package uses
+// internally, so modifying them can't change how files are decoded.
+var (
+	// MAC algorithms.
+	OIDMACSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	OIDMACSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	OIDMACSM3    = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 401}
+	OIDMACPBMAC1 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 14}
+
+	// PKCS#12 PBE algorithms (rfc7292#appendix-C) and PBES2.
+	OIDPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	OIDPBEWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	OIDPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	OIDPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+
+	// PBES2 encryption schemes.
+	OIDCipherAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	OIDCipherAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	OIDCipherAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	OIDCipherSM4CBC    = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 104, 2}
+
+	// PBKDF2 PRFs.
+	OIDPRFHmacSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	OIDPRFHmacSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	OIDPRFHmacSM3    = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 401, 2}
+)
+
+// oidNames are the names that [DecodeInfo.String] gives to object
+// identifiers.
+var oidNames = map[string]string{
+	oidSHA1.String():   "SHA1",
+	oidSHA256.String(): "SHA256",
+	oidSM3.String():    "SM3",
+	oidPBMAC1.String(): "PBMAC1",
+
+	oidPBEWithSHAAnd3KeyTripleDESCBC.String(): "pbeWithSHAAnd3-KeyTripleDES-CBC",
+	oidPBEWithSHAAnd128BitRC2CBC.String():     "pbeWithSHAAnd128BitRC2-CBC",
+	oidPBEWithSHAAnd40BitRC2CBC.String():      "pbeWithSHAAnd40BitRC2-CBC",
+	oidPBEWithMD5AndDESCBC.String():           "pbeWithMD5AndDES-CBC",
+	oidPBES2.String():                         "PBES2",
+	oidPBKDF2.String():                        "PBKDF2",
+
+	oidHmacWithSHA1.String():   "HMAC-SHA1",
+	oidHmacWithSHA256.String(): "HMAC-SHA256",
+	oidHmacWithSM3.String():    "HMAC-SM3",
+
+	oidAES128CBC.String(): "AES-128-CBC",
+	oidAES192CBC.String(): "AES-192-CBC",
+	oidAES256CBC.String(): "AES-256-CBC",
+	oidSM4CBC.String():    "SM4-CBC",
+
+	"1.2.840.113549.1.1.1": "RSA",
+	oidRSASSAPSS.String():  "RSASSA-PSS",
+	"1.2.840.10045.2.1":    "EC",
+	"1.3.101.112":          "Ed25519",
+
+	"1.3.132.0.33":        "P-224",
+	"1.2.840.10045.3.1.7": "P-256",
+	"1.3.132.0.34":        "P-384",
+	"1.3.132.0.35":        "P-521",
+	"1.2.156.10197.1.301": "SM2",
+}
+
+// oidName returns the name of oid, or its numeric form if it has none.
+func oidName(oid asn1.ObjectIdentifier) string {
+	if name, ok := oidNames[oid.String()]; ok {
+		return name
+	}
+	return oid.String()
+}
@@ -0,0 +1,93 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"encoding/asn1"
+	"errors"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// EncodeWithOuterEncryption is like [Encoder.Encode], but additionally encrypts
+// the resulting PFX PDU as a whole, wrapping it in an EncryptedData protected
+// with PBES2.  The outer key is derived from the same password as the inner
+// PFX, using a distinct random salt.  If enc does not use PBES2, the outer
+// layer uses PBKDF2-HMAC-SHA-256 and AES-256-CBC.
+//
+// The outer layer is an extension to PKCS#12 that only provides defense in
+// depth on top of the regular encryption.  Other software can't read such
+// files, and they must be decoded with [DecodeOptions.OuterEncryption] set.
+func (enc *Encoder) EncodeWithOuterEncryption(privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, password string) (pfxData []byte, err error) {
+	if enc.certAlgorithm == nil && enc.keyAlgorithm == nil {
+		return nil, errors.New("pkcs12: outer encryption requires an encoder that encrypts its contents")
+	}
+
+	if pfxData, err = enc.Encode(privateKey, certificate, caCerts, password); err != nil {
+		return nil, err
+	}
+
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, err
+	}
+
+	kdfPrf, encryptionScheme := enc.kdfPrf, enc.keyEncryptionScheme
+	if kdfPrf == nil || encryptionScheme == nil {
+		kdfPrf, encryptionScheme = oidHmacWithSHA256, oidAES256CBC
+	}
+
+	randomSalt, err := enc.newSalt(enc.rand)
+	if err != nil {
+		return nil, err
+	}
+
+	var outer encryptedData
+	outer.Version = 0
+	outer.EncryptedContentInfo.ContentType = oidDataContentType
+	outer.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm = oidPBES2
+	if outer.EncryptedContentInfo.ContentEncryptionAlgorithm.Parameters.FullBytes, err = makePBES2Parameters(kdfPrf, encryptionScheme, enc.ivSource(enc.rand), randomSalt, enc.encryptionIterations, enc.explicitNullParams); err != nil {
+		return nil, err
+	}
+	if err = pbEncrypt(&outer.EncryptedContentInfo, pfxData, encodedPassword); err != nil {
+		return nil, err
+	}
+
+	if pfxData, err = asn1.Marshal(outer); err != nil {
+		return nil, errors.New("pkcs12: error writing outer encryption: " + err.Error())
+	}
+	if err = enc.checkOutputSize(pfxData); err != nil {
+		return nil, err
+	}
+	return pfxData, nil
+}
+
+// unwrapOuterEncryption removes the outer encryption layer added by
+// [Encoder.EncodeWithOuterEncryption].
+func unwrapOuterEncryption(data, password []byte, kd *keyDeriver) ([]byte, error) {
+	var outer encryptedData
+	if err := unmarshal(data, &outer); err != nil {
+		return nil, errors.New("pkcs12: error reading outer encryption: " + err.Error())
+	}
+	if outer.Version != 0 {
+		return nil, NotImplementedError("only version 0 of EncryptedData is supported")
+	}
+	if !outer.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, NotImplementedError("outer encryption must use PBES2")
+	}
+	decrypted, err := pbDecrypt(outer.EncryptedContentInfo, password, kd)
+	if err == ErrDecryption {
+		return nil, ErrIncorrectPassword
+	} else if err != nil {
+		return nil, err
+	}
+	// A wrong password occasionally yields valid padding, so make sure
+	// that the plaintext at least looks like a single DER element.
+	var raw asn1.RawValue
+	if err := unmarshal(decrypted, &raw); err != nil {
+		return nil, ErrIncorrectPassword
+	}
+	return decrypted, nil
+}
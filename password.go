@@ -0,0 +1,263 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// A PasswordProvider supplies a password from a source controlled by the
+// caller, such as a keyring or an HSM, so that the caller decides how long
+// the plaintext password lives in memory.
+//
+// Password returns the password as UTF-8.  The functions of this package
+// that take a PasswordProvider call Password when they need the password,
+// and Zero once they are done with the returned slice, which they don't
+// retain; Zero is called even if decoding or encoding fails, but not if
+// Password returns an error.  Zero should overwrite the slice returned by
+// Password.
+type PasswordProvider interface {
+	Password() ([]byte, error)
+	Zero()
+}
+
+// StringPassword is a [PasswordProvider] that returns a fixed password.  As
+// Go strings are immutable, Zero can't erase it; it is an adapter for
+// callers that hold the password in a string anyway.
+type StringPassword string
+
+// Password returns a copy of the password.
+func (p StringPassword) Password() ([]byte, error) {
+	return []byte(p), nil
+}
+
+// Zero does nothing.
+func (p StringPassword) Zero() {}
+
+// zeroPassword overwrites an encoded password.
+func zeroPassword(encodedPassword []byte) {
+	for i := range encodedPassword {
+		encodedPassword[i] = 0
+	}
+}
+
+// DecodeChainWithProvider is like [DecodeChainWithInfo], but obtains the
+// password from provider.  The BMPString encoding of the password is
+// overwritten before it returns; other copies derived from it, such as the
+// keys and the UTF-8 password used by PBES2 and PBMAC1, are left to the
+// garbage collector.
+func DecodeChainWithProvider(pfxData []byte, provider PasswordProvider) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, info *DecodeInfo, err error) {
+	return defaultDecodeOptions.DecodeChainWithProvider(pfxData, provider)
+}
+
+// DecodeChainWithProvider is like the package-level [DecodeChainWithProvider], but uses the options in opts.
+func (opts *DecodeOptions) DecodeChainWithProvider(pfxData []byte, provider PasswordProvider) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, info *DecodeInfo, err error) {
+	password, err := provider.Password()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	kd := opts.newKeyDeriver()
+	if !utf8.Valid(password) {
+		kd.bytewisePassword = bytewiseBMPStringZeroTerminated(string(password))
+		defer zeroPassword(kd.bytewisePassword)
+	}
+	encodedPassword, err := bmpStringZeroTerminatedBytes(password)
+	provider.Zero()
+	if err != nil {
+		return nil, nil, nil, nil, opts.passwordError(pfxData, err)
+	}
+	defer zeroPassword(encodedPassword)
+	return opts.decodeChainWithInfo(pfxData, encodedPassword, kd)
+}
+
+// EncodeWithProvider is like [Encoder.Encode], but obtains the password
+// from provider.  As with [DecodeChainWithProvider], the BMPString encoding
+// of the password is overwritten before it returns.
+func (enc *Encoder) EncodeWithProvider(privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, provider PasswordProvider) (pfxData []byte, err error) {
+	password, err := provider.Password()
+	if err != nil {
+		return nil, err
+	}
+	encodedPassword, err := bmpStringZeroTerminatedBytes(password)
+	provider.Zero()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroPassword(encodedPassword)
+	if err := enc.checkEncodeArgs(privateKey, len(encodedPassword) == 2); err != nil {
+		return nil, err
+	}
+	return enc.encode(privateKey, certificate, caCerts, enc.keyDerivationPassword(encodedPassword), nil)
+}
+
+// EncodeDualPassword is like [Encoder.Encode], but produces pfxData whose
+// private key can be decrypted with either newPassword or oldPassword, to
+// rotate the password of a file without making it unreadable to software
+// that still has the old one.
+//
+// The private key is shrouded twice, first with newPassword and then with
+// oldPassword, in key bags with the same attributes.  A MAC only has one
+// password, so the MAC is computed with newPassword; and as the
+// certificates can't be encrypted for two passwords, they are not
+// encrypted.  [DecodeChain] opens the result with newPassword, while
+// oldPassword requires a [DecodeOptions] with IgnoreMAC set.  Other
+// software may not accept the result: for example, the openssl pkcs12
+// command fails on the key bag that it can't decrypt.
+//
+// enc must encrypt private keys.
+func (enc *Encoder) EncodeDualPassword(privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, newPassword, oldPassword string) (pfxData []byte, err error) {
+	if enc.keyAlgorithm == nil {
+		return nil, errors.New("pkcs12: EncodeDualPassword requires an encoder that encrypts private keys")
+	}
+	if err := checkPrivateKeyType(privateKey); err != nil {
+		return nil, err
+	}
+
+	encodedNewPassword, err := enc.encodePassword(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	encodedOldPassword, err := enc.encodePassword(oldPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	dual := *enc
+	dual.certAlgorithm = nil
+	return dual.encode(privateKey, certificate, caCerts, encodedNewPassword, [][]byte{encodedOldPassword})
+}
+
+// commonPasswords are frequently used passwords, including the defaults of
+// keystore tools such as [DefaultPassword].
+var commonPasswords = []string{
+	"123456", "12345678", "123456789", "1234567890", "111111", "000000",
+	"password", "password1", "passw0rd", "p@ssw0rd", "qwerty", "qwertyuiop",
+	"abc123", "letmein", "welcome", "iloveyou", "admin", "administrator",
+	"secret", "changeme", "changeit", "default", "pkcs12", "keystore",
+	"truststore", "test", "test123", "root", "toor", "master",
+}
+
+// EstimatePasswordStrength roughly estimates the entropy of password, in
+// bits, e.g. to reject weak user-chosen passwords before calling
+// [Encoder.Encode].  The estimate assumes that every character is drawn at
+// random from the classes of characters used in password (lowercase and
+// uppercase letters, digits, ASCII symbols and other characters), which
+// overestimates the strength of passwords made of words.  warnings lists
+// the weaknesses found, such as a short or common password; a common
+// password is estimated at a few bits.
+//
+// This is a simple heuristic, not a replacement for a dedicated estimator
+// that knows dictionaries and keyboard patterns.
+func EstimatePasswordStrength(password string) (bits float64, warnings []string) {
+	if password == "" {
+		return 0, []string{"the password is empty"}
+	}
+
+	var lower, upper, digit, symbol, other bool
+	length := 0
+	distinct := make(map[rune]bool)
+	for _, r := range password {
+		length++
+		distinct[r] = true
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r >= ' ' && r <= '~':
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool, classes := 0, 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+			classes++
+		}
+	}
+	bits = float64(length) * math.Log2(float64(pool))
+
+	if length < 12 {
+		warnings = append(warnings, fmt.Sprintf("the password is only %d characters long", length))
+	}
+	if classes == 1 {
+		warnings = append(warnings, "the password uses a single class of characters")
+	}
+	if len(distinct) == 1 && length > 1 {
+		warnings = append(warnings, "the password repeats a single character")
+		bits = math.Log2(float64(pool)) + math.Log2(float64(length))
+	}
+	for _, common := range commonPasswords {
+		if strings.EqualFold(password, common) {
+			warnings = append(warnings, "the password is a common password")
+			bits = math.Log2(float64(len(commonPasswords)))
+			break
+		}
+	}
+	return bits, warnings
+}
+
+// maxPasswordAttempts is the number of times [DecodeChainFunc] asks for the
+// password.
+const maxPasswordAttempts = 3
+
+// DecodeChainFunc is like [DecodeChain], but obtains the password by calling
+// prompter, e.g. to ask the user for it.  hint is the first Friendly Name
+// found in the unencrypted contents of pfxData, if any, which usually names
+// the key; it is empty otherwise.  If the password is incorrect, prompter is
+// called again, up to 3 times in total, after which ErrIncorrectPassword is
+// returned.  An error returned by prompter is returned as is.
+func DecodeChainFunc(pfxData []byte, prompter func(hint string) (string, error)) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeChainFunc(pfxData, prompter)
+}
+
+// DecodeChainFunc is like the package-level [DecodeChainFunc], but uses the options in opts.
+func (opts *DecodeOptions) DecodeChainFunc(pfxData []byte, prompter func(hint string) (string, error)) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
+	hint := opts.passwordHint(pfxData)
+	for i := 0; i < maxPasswordAttempts; i++ {
+		password, err := prompter(hint)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		privateKey, certificate, caCerts, err = opts.DecodeChain(pfxData, password)
+		if err != ErrIncorrectPassword {
+			return privateKey, certificate, caCerts, err
+		}
+	}
+	return nil, nil, nil, ErrIncorrectPassword
+}
+
+// passwordHint returns the first Friendly Name in the unencrypted
+// SafeContents of pfxData, without verifying its MAC, or "" if there is none.
+func (opts *DecodeOptions) passwordHint(pfxData []byte) string {
+	if opts.OuterEncryption {
+		return ""
+	}
+	// the hint is only a convenience: skip the contents that can't be parsed
+	bags, err := plaintextSafeBags(pfxData, true)
+	if err != nil {
+		return ""
+	}
+	for _, bag := range bags {
+		if name, err := bag.friendlyName(); err == nil && name != "" {
+			return name
+		}
+	}
+	return ""
+}
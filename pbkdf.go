@@ -6,35 +6,14 @@ package pkcs12
 
 import (
 	"bytes"
-	"crypto/sha1"
-	"crypto/sha256"
+	"hash"
 	"math/big"
-
-	"github.com/emmansun/gmsm/sm3"
 )
 
 var (
 	one = big.NewInt(1)
 )
 
-// sha1Sum returns the SHA-1 hash of in.
-func sha1Sum(in []byte) []byte {
-	sum := sha1.Sum(in)
-	return sum[:]
-}
-
-// sha256Sum returns the SHA-256 hash of in.
-func sha256Sum(in []byte) []byte {
-	sum := sha256.Sum256(in)
-	return sum[:]
-}
-
-// sm3Sum returns the SM3 hash of in.
-func sm3Sum(in []byte) []byte {
-	sum := sm3.Sum(in)
-	return sum[:]
-}
-
 // fillWithRepeats returns v*ceiling(len(pattern) / v) bytes consisting of
 // repeats of pattern.
 func fillWithRepeats(pattern []byte, v int) []byte {
@@ -45,7 +24,7 @@ func fillWithRepeats(pattern []byte, v int) []byte {
 	return bytes.Repeat(pattern, (outputLen+len(pattern)-1)/len(pattern))[:outputLen]
 }
 
-func pbkdf(hash func([]byte) []byte, u, v int, salt, password []byte, r int, ID byte, size int) (key []byte) {
+func pbkdf(hFn func() hash.Hash, u, v int, salt, password []byte, r int, ID byte, size int) (key []byte) {
 	// implementation of https://tools.ietf.org/html/rfc7292#appendix-B.2 , RFC text verbatim in comments
 
 	//    Let H be a hash function built around a compression function f:
@@ -119,12 +98,20 @@ func pbkdf(hash func([]byte) []byte, u, v int, salt, password []byte, r int, ID
 	//    6.  For i=1, 2, ..., c, do the following:
 	A := make([]byte, c*u)
 	var IjBuf []byte
+	h := hFn()
+	Ai := make([]byte, 0, u)
 	for i := 0; i < c; i++ {
 		//        A.  Set A2=H^r(D||I). (i.e., the r-th hash of D||1,
 		//            H(H(H(... H(D||I))))
-		Ai := hash(append(D, I...))
+		// The hash and its output buffer are reused across iterations.
+		h.Reset()
+		h.Write(D)
+		h.Write(I)
+		Ai = h.Sum(Ai[:0])
 		for j := 1; j < r; j++ {
-			Ai = hash(Ai)
+			h.Reset()
+			h.Write(Ai)
+			Ai = h.Sum(Ai[:0])
 		}
 		copy(A[i*u:], Ai[:])
 
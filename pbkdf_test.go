@@ -6,6 +6,7 @@ package pkcs12
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"testing"
 )
 
@@ -26,7 +27,7 @@ func TestThatPBKDFHandlesLeadingZeros(t *testing.T) {
 	// byte, meaning that len(Ijb) < v (leading zeros get stripped by big.Int).
 	// This was previously causing bug whereby certain inputs would break the
 	// derivation and produce the wrong output.
-	key := pbkdf(sha1Sum, 20, 64, []byte("\xf3\x7e\x05\xb5\x18\x32\x4b\x4b"), []byte("\x00\x00"), 2048, 1, 24)
+	key := pbkdf(sha1.New, 20, 64, []byte("\xf3\x7e\x05\xb5\x18\x32\x4b\x4b"), []byte("\x00\x00"), 2048, 1, 24)
 	expected := []byte("\x00\xf7\x59\xff\x47\xd1\x4d\xd0\x36\x65\xd5\x94\x3c\xb3\xc4\xa3\x9a\x25\x55\xc0\x2a\xed\x66\xe1")
 	if !bytes.Equal(key, expected) {
 		t.Fatalf("expected key '%x', but found '%x'", expected, key)
@@ -12,6 +12,11 @@
 // Note that only DER-encoded PKCS#12 files are supported, even though PKCS#12
 // allows BER encoding.  This is because encoding/asn1 only supports DER.
 //
+// On 64-bit platforms, files of up to 4 GiB can be decoded, such as very
+// large trust stores, but a single certificate, key or other bag must be
+// smaller than 2 GiB, the limit of encoding/asn1.  Decoding holds the whole
+// file in memory, along with the decrypted contents.
+//
 // This package is forked from github.com/SSLMate/go-pkcs12 which is forked from
 // golang.org/x/crypto/pkcs12, which is frozen.
 // The implementation is distilled from https://tools.ietf.org/html/rfc7292
@@ -19,10 +24,16 @@
 package pkcs12
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
@@ -30,7 +41,9 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"sort"
 
 	"github.com/emmansun/gmsm/sm2"
 	"github.com/emmansun/gmsm/smx509"
@@ -50,40 +63,32 @@ type Encoder struct {
 	certAlgorithm        asn1.ObjectIdentifier // Certificate encryption pbe: PKCS12-PBE or PBES2
 	keyAlgorithm         asn1.ObjectIdentifier // Private Key encryption pbe: PKCS12-PBE or PBES2
 	kdfPrf               asn1.ObjectIdentifier // PBES2 PBKDF2 PRF
-	encryptionScheme     asn1.ObjectIdentifier // PBES2 encryption scheme
+	certEncryptionScheme asn1.ObjectIdentifier // PBES2 encryption scheme for certificates
+	keyEncryptionScheme  asn1.ObjectIdentifier // PBES2 encryption scheme for private keys
 	macIterations        int                   // MAC iteration count
 	encryptionIterations int                   // Encryption iteration count
+	keyIterations        int                   // Key encryption iteration count, if not encryptionIterations
 	saltLen              int                   // Length of salt for both MAC and encryption
+	nullEmptyPassword    bool                  // Encode an empty password as zero bytes rather than "\x00\x00"
+	omitAttributes       bool                  // Omit the bag attributes of keys and certificates
+	fixedContentSalt     []byte                // Salt for every encryption instead of a random one
+	fixedMacSalt         []byte                // MAC salt instead of a random one
+	fixedIV              []byte                // PBES2 IV for every encryption instead of a random one
 	rand                 io.Reader
-}
-
-// WithIterations creates a new Encoder identical to enc except that
-// it will use the given number of KDF iterations for deriving the MAC
-// and encryption keys.
-//
-// Note that even with a large number of iterations, a weak
-// password can still be brute-forced in much less time than it would
-// take to brute-force a high-entropy encrytion key.  For the best
-// security, don't worry about the number of iterations and just
-// use a high-entropy password (e.g. one generated with `openssl rand -hex 16`).
-// See https://neilmadden.blog/2023/01/09/on-pbkdf2-iterations/ for more detail.
-//
-// Panics if iterations is less than 1.
-func (enc Encoder) WithIterations(iterations int) *Encoder {
-	if iterations < 1 {
-		panic("pkcs12: number of iterations is less than 1")
-	}
-	enc.macIterations = iterations
-	enc.encryptionIterations = iterations
-	return &enc
-}
-
-// WithRand creates a new Encoder identical to enc except that
-// it will use the given io.Reader for its random number generator
-// instead of [crypto/rand.Reader].
-func (enc Encoder) WithRand(rand io.Reader) *Encoder {
-	enc.rand = rand
-	return &enc
+	saltRand             io.Reader             // Source of salts, if not rand
+	ivRand               io.Reader             // Source of PBES2 IVs, if not rand
+	chainOrder           ChainOrder            // Order of the CA certificate bags
+	matchedNames         bool                  // Write the same friendlyName on the leaf certificate and key bags
+	verifyRoots          *smx509.CertPool      // Roots to verify the chain against before encoding, if any
+	layout               Layout                // SafeContents of the key and certificate bags, if not OpenSSLLayout
+	maxOutputSize        int                   // Maximum length of the encoding, or 0 for no limit
+	explicitNullParams   bool                  // Write NULL parameters for the MAC digest and PBES2 PRF algorithms
+	macParamsNull        *bool                 // Write NULL parameters for the MAC digest algorithm, if not explicitNullParams
+	contentType          asn1.ObjectIdentifier // Content type of plaintext SafeContents, if not data
+	bagOrder             BagOrder              // Order of the bags within a SafeContents
+	localKeyID           []byte                // localKeyId of the key and leaf certificate, if not their fingerprint
+	clientAuth           bool                  // Require the clientAuth extended key usage of the end-entity certificate
+	parallelKDFThreshold int                   // MAC iterations from which the MAC key is derived concurrently, if not the default
 }
 
 // LegacyRC2 encodes PKCS#12 files using weak algorithms that were
@@ -106,7 +111,8 @@ var LegacyRC2 = &Encoder{
 	certAlgorithm:        oidPBEWithSHAAnd40BitRC2CBC,
 	keyAlgorithm:         oidPBEWithSHAAnd3KeyTripleDESCBC,
 	kdfPrf:               nil,
-	encryptionScheme:     nil,
+	certEncryptionScheme: nil,
+	keyEncryptionScheme:  nil,
 	macIterations:        1,
 	encryptionIterations: 2048,
 	saltLen:              8,
@@ -129,7 +135,8 @@ var LegacyDES = &Encoder{
 	certAlgorithm:        oidPBEWithSHAAnd3KeyTripleDESCBC,
 	keyAlgorithm:         oidPBEWithSHAAnd3KeyTripleDESCBC,
 	kdfPrf:               nil,
-	encryptionScheme:     nil,
+	certEncryptionScheme: nil,
+	keyEncryptionScheme:  nil,
 	macIterations:        1,
 	encryptionIterations: 2048,
 	saltLen:              8,
@@ -143,12 +150,13 @@ var LegacyDES = &Encoder{
 //
 // When using this encoder, you MUST specify an empty password.
 var Passwordless = &Encoder{
-	macAlgorithm:     nil,
-	certAlgorithm:    nil,
-	keyAlgorithm:     nil,
-	kdfPrf:           nil,
-	encryptionScheme: nil,
-	rand:             rand.Reader,
+	macAlgorithm:         nil,
+	certAlgorithm:        nil,
+	keyAlgorithm:         nil,
+	kdfPrf:               nil,
+	certEncryptionScheme: nil,
+	keyEncryptionScheme:  nil,
+	rand:                 rand.Reader,
 }
 
 // Modern2023 encodes PKCS#12 files using algorithms that are considered modern
@@ -174,7 +182,8 @@ var Modern2023 = &Encoder{
 	certAlgorithm:        oidPBES2,
 	keyAlgorithm:         oidPBES2,
 	kdfPrf:               oidHmacWithSHA256,
-	encryptionScheme:     oidAES256CBC,
+	certEncryptionScheme: oidAES256CBC,
+	keyEncryptionScheme:  oidAES256CBC,
 	macIterations:        2048,
 	encryptionIterations: 2048,
 	saltLen:              16,
@@ -189,10 +198,99 @@ var ShangMi2024 = &Encoder{
 	certAlgorithm:        oidPBES2,
 	keyAlgorithm:         oidPBES2,
 	kdfPrf:               oidHmacWithSM3,
-	encryptionScheme:     oidSM4CBC,
+	certEncryptionScheme: oidSM4CBC,
+	keyEncryptionScheme:  oidSM4CBC,
+	macIterations:        2048,
+	encryptionIterations: 2048,
+	saltLen:              16,
+	rand:                 rand.Reader,
+}
+
+// DotNet encodes PKCS#12 files for import into .NET with X509Certificate2.
+// The AuthenticatedSafe holds a single SafeContents, encrypted using PBES2
+// with PBKDF2-HMAC-SHA-256 and AES-256-CBC, which contains both the
+// certificate bags and the shrouded key bag.  The MAC algorithm is
+// HMAC-SHA-256.  Keys are derived with 2000 iterations, as .NET does.
+//
+// The files it writes import with the X509Certificate2 constructor and
+// X509Certificate2Collection.Import in .NET 8.0.20 on Linux (Debian 12);
+// import on Windows, where .NET uses the platform's PKCS#12 reader, hasn't
+// been tested.  These are not the parameters of X509Certificate2.Export:
+// .NET 8 on Linux exports with pbeWithSHAAnd3-KeyTripleDES-CBC and an
+// HMAC-SHA-1 MAC, like [LegacyDES].
+//
+// As with [Modern2023], it is RECOMMENDED that you use [DefaultPassword] or a
+// high-entropy password.
+var DotNet = &Encoder{
+	macAlgorithm:         oidSHA256,
+	certAlgorithm:        oidPBES2,
+	keyAlgorithm:         oidPBES2,
+	kdfPrf:               oidHmacWithSHA256,
+	certEncryptionScheme: oidAES256CBC,
+	keyEncryptionScheme:  oidAES256CBC,
+	macIterations:        2000,
+	encryptionIterations: 2000,
+	saltLen:              16,
+	layout:               Layout{{Contents: LayoutKey | LayoutLeafCert | LayoutCACerts, Encrypted: true}},
+	rand:                 rand.Reader,
+}
+
+// AppleConfigProfile encodes PKCS#12 files for the certificate payloads
+// (com.apple.security.pkcs12) of iOS and macOS configuration profiles and
+// MDM commands.  Older iOS and macOS versions are expected to only import
+// files that use the PKCS#12 PBE algorithms, so certificates and keys are
+// encrypted using PBE with 3DES, and MACs use HMAC-SHA-1, with keys derived
+// with 2048 iterations.
+//
+// Import into iOS and macOS is not covered by the tests of this package,
+// which only check these parameters; check a file on the versions that you
+// target, e.g. on macOS with
+// `security import file.p12 -k <keychain> -P <password>`, before it is put
+// in a profile.
+//
+// Due to the weak encryption, it is STRONGLY RECOMMENDED that you use a
+// high-entropy password and protect the profile using other means, such as
+// signing and encrypting it.
+var AppleConfigProfile = &Encoder{
+	macAlgorithm:         oidSHA1,
+	certAlgorithm:        oidPBEWithSHAAnd3KeyTripleDESCBC,
+	keyAlgorithm:         oidPBEWithSHAAnd3KeyTripleDESCBC,
+	macIterations:        2048,
+	encryptionIterations: 2048,
+	saltLen:              8,
+	rand:                 rand.Reader,
+}
+
+// BrowserClientCert encodes PKCS#12 files holding a TLS client certificate
+// for import into browsers, such as the certificate manager of Chrome and
+// Edge, which hands the file to the platform: NSS on Linux, and CryptoAPI
+// on Windows.  Certificates and keys are encrypted as with [Modern2023],
+// and MACs use HMAC-SHA-256 rather than HMAC-SHA-1, which newer importers
+// may reject.  The key bag and the end-entity certificate bag have the same
+// localKeyId, which links the key to the certificate, and the same
+// friendlyName, which browsers display; see [Encoder.WithMatchedNames].
+//
+// Browsers only offer certificates with the clientAuth extended key usage
+// for client authentication, so Encode and [Encoder.ValidateForEncode]
+// return an error if the end-entity certificate doesn't have it.
+//
+// The import of these files into browsers is not covered by the tests of
+// this package, which only check the parameters and the linking described
+// above; check the browsers and platforms that you target.  As with
+// [Modern2023], older Windows versions can't decrypt these files; use
+// [LegacyDES] for them.
+var BrowserClientCert = &Encoder{
+	macAlgorithm:         oidSHA256,
+	certAlgorithm:        oidPBES2,
+	keyAlgorithm:         oidPBES2,
+	kdfPrf:               oidHmacWithSHA256,
+	certEncryptionScheme: oidAES256CBC,
+	keyEncryptionScheme:  oidAES256CBC,
 	macIterations:        2048,
 	encryptionIterations: 2048,
 	saltLen:              16,
+	matchedNames:         true,
+	clientAuth:           true,
 	rand:                 rand.Reader,
 }
 
@@ -216,11 +314,14 @@ var Modern = Modern2023
 
 var (
 	oidDataContentType          = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 7, 1})
+	oidSignedDataContentType    = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 7, 2})
 	oidEncryptedDataContentType = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 7, 6})
 
 	oidFriendlyName     = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 20})
 	oidLocalKeyID       = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 21})
 	oidMicrosoftCSPName = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 311, 17, 1})
+	// the CERT_FRIENDLY_NAME_PROP_ID certificate property, as exported by Windows
+	oidMicrosoftFriendlyName = asn1.ObjectIdentifier([]int{1, 3, 6, 1, 4, 1, 311, 10, 11, 11})
 
 	oidJavaTrustStore      = asn1.ObjectIdentifier([]int{2, 16, 840, 1, 113894, 746875, 1, 1})
 	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier([]int{2, 5, 29, 37, 0})
@@ -232,6 +333,72 @@ type pfxPdu struct {
 	MacData  macData `asn1:"optional"`
 }
 
+// parsePFX parses the PFX PDU der.  Some software encodes the version as an
+// ENUMERATED or with another tag than INTEGER, or writes the macData before
+// the authSafe, which is tolerated since it doesn't affect the rest of the
+// file: the MAC is computed over the contents of the authSafe either way.
+func parsePFX(der []byte) (*pfxPdu, error) {
+	if len(der) > maxASN1Length {
+		return parseLargePFX(der)
+	}
+	pfx := new(pfxPdu)
+	err := unmarshal(der, pfx)
+	if err == nil {
+		return pfx, nil
+	}
+
+	var lenient struct {
+		Version  asn1.RawValue
+		AuthSafe contentInfo
+		MacData  macData `asn1:"optional"`
+	}
+	if unmarshal(der, &lenient) != nil {
+		var swapped struct {
+			Version  asn1.RawValue
+			MacData  macData
+			AuthSafe contentInfo
+		}
+		if unmarshal(der, &swapped) != nil {
+			return nil, err
+		}
+		lenient.Version, lenient.AuthSafe, lenient.MacData = swapped.Version, swapped.AuthSafe, swapped.MacData
+	}
+	if lenient.Version.IsCompound || len(lenient.Version.Bytes) == 0 || len(lenient.Version.Bytes) > 4 {
+		return nil, err
+	}
+	pfx = new(pfxPdu)
+	for _, b := range lenient.Version.Bytes {
+		pfx.Version = pfx.Version<<8 | int(b)
+	}
+	pfx.AuthSafe = lenient.AuthSafe
+	pfx.MacData = lenient.MacData
+	return pfx, nil
+}
+
+// parseLargePFX parses a PFX PDU that is too large for encoding/asn1.
+func parseLargePFX(der []byte) (*pfxPdu, error) {
+	elements, err := unmarshalSequenceOf(der)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) < 2 || len(elements) > 3 {
+		return nil, errors.New("pkcs12: malformed PFX")
+	}
+	pfx := new(pfxPdu)
+	if err := unmarshal(elements[0].FullBytes, &pfx.Version); err != nil {
+		return nil, err
+	}
+	if err := unmarshalContentInfo(elements[1].FullBytes, &pfx.AuthSafe); err != nil {
+		return nil, err
+	}
+	if len(elements) == 3 {
+		if err := unmarshal(elements[2].FullBytes, &pfx.MacData); err != nil {
+			return nil, err
+		}
+	}
+	return pfx, nil
+}
+
 type contentInfo struct {
 	ContentType asn1.ObjectIdentifier
 	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
@@ -240,6 +407,7 @@ type contentInfo struct {
 type encryptedData struct {
 	Version              int
 	EncryptedContentInfo encryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"` // CMS (rfc5652#section-8), ignored
 }
 
 type encryptedContentInfo struct {
@@ -271,6 +439,69 @@ func (bag *safeBag) hasAttribute(id asn1.ObjectIdentifier) bool {
 	return false
 }
 
+// localKeyID returns the value of the bag's localKeyId attribute, or nil if
+// it has none.
+func (bag *safeBag) localKeyID() []byte {
+	for _, attr := range bag.Attributes {
+		if attr.Id.Equal(oidLocalKeyID) {
+			var id []byte
+			if err := unmarshal(attr.Value.Bytes, &id); err != nil {
+				return nil
+			}
+			return id
+		}
+	}
+	return nil
+}
+
+// attributeMap returns the values of the bag's attributes, keyed by their
+// OIDs in dotted form, or nil if it has none.
+func (bag *safeBag) attributeMap() map[string][]byte {
+	if len(bag.Attributes) == 0 {
+		return nil
+	}
+	attributes := make(map[string][]byte, len(bag.Attributes))
+	for _, attr := range bag.Attributes {
+		attributes[attr.Id.String()] = attr.Value.Bytes
+	}
+	return attributes
+}
+
+// friendlyName returns the value of the bag's friendlyName attribute, or ""
+// if it has none.
+func (bag *safeBag) friendlyName() (string, error) {
+	for _, attr := range bag.Attributes {
+		if attr.Id.Equal(oidFriendlyName) {
+			var value asn1.RawValue
+			if err := unmarshal(attr.Value.Bytes, &value); err != nil {
+				return "", err
+			}
+			return decodeAttributeString(value)
+		}
+	}
+	return "", nil
+}
+
+// trustedKeyUsage returns the extended key usages listed in the bag's Java
+// trusted key usage attribute.
+func (bag *safeBag) trustedKeyUsage() ([]asn1.ObjectIdentifier, error) {
+	var usages []asn1.ObjectIdentifier
+	for _, attr := range bag.Attributes {
+		if !attr.Id.Equal(oidJavaTrustStore) {
+			continue
+		}
+		for rest := attr.Value.Bytes; len(rest) > 0; {
+			var usage asn1.ObjectIdentifier
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &usage); err != nil {
+				return nil, errors.New("pkcs12: error reading trusted key usage: " + err.Error())
+			}
+			usages = append(usages, usage)
+		}
+	}
+	return usages, nil
+}
+
 type pkcs12Attribute struct {
 	Id    asn1.ObjectIdentifier
 	Value asn1.RawValue `asn1:"set"`
@@ -324,7 +555,8 @@ func ToPEM(pfxData []byte, password string) ([]*pem.Block, error) {
 		return nil, ErrIncorrectPassword
 	}
 
-	bags, encodedPassword, err := getSafeContents(pfxData, encodedPassword, 2, 2)
+	kd := defaultDecodeOptions.newKeyDeriverFor(password)
+	bags, encodedPassword, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, kd, 2, 2)
 
 	if err != nil {
 		return nil, err
@@ -332,7 +564,7 @@ func ToPEM(pfxData []byte, password string) ([]*pem.Block, error) {
 
 	blocks := make([]*pem.Block, 0, len(bags))
 	for _, bag := range bags {
-		block, err := convertBag(&bag, encodedPassword)
+		block, err := convertBag(&bag, encodedPassword, kd)
 		if err != nil {
 			return nil, err
 		}
@@ -342,7 +574,7 @@ func ToPEM(pfxData []byte, password string) ([]*pem.Block, error) {
 	return blocks, nil
 }
 
-func convertBag(bag *safeBag, password []byte) (*pem.Block, error) {
+func convertBag(bag *safeBag, password []byte, kd *keyDeriver) (*pem.Block, error) {
 	block := &pem.Block{
 		Headers: make(map[string]string),
 	}
@@ -366,7 +598,7 @@ func convertBag(bag *safeBag, password []byte) (*pem.Block, error) {
 	case bag.Id.Equal(oidPKCS8ShroundedKeyBag):
 		block.Type = privateKeyType
 
-		key, err := decodePkcs8ShroudedKeyBag(bag.Value.Bytes, password)
+		key, err := decodePkcs8ShroudedKeyBag(bag.Value.Bytes, password, kd)
 		if err != nil {
 			return nil, err
 		}
@@ -414,7 +646,7 @@ func convertAttribute(attribute *pkcs12Attribute) (key, value string, err error)
 		if err := unmarshal(attribute.Value.Bytes, &attribute.Value); err != nil {
 			return "", "", err
 		}
-		if value, err = decodeBMPString(attribute.Value.Bytes); err != nil {
+		if value, err = decodeAttributeString(attribute.Value); err != nil {
 			return "", "", err
 		}
 	} else {
@@ -433,8 +665,13 @@ func convertAttribute(attribute *pkcs12Attribute) (key, value string, err error)
 // pfxData.  Since PKCS#12 files often contain more than one certificate, you
 // probably want to use [DecodeChain] instead.
 func Decode(pfxData []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, err error) {
+	return defaultDecodeOptions.Decode(pfxData, password)
+}
+
+// Decode is like the package-level [Decode], but uses the options in opts.
+func (opts *DecodeOptions) Decode(pfxData []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, err error) {
 	var caCerts []*smx509.Certificate
-	privateKey, certificate, caCerts, err = DecodeChain(pfxData, password)
+	privateKey, certificate, caCerts, err = opts.DecodeChain(pfxData, password)
 	if len(caCerts) != 0 {
 		err = errors.New("pkcs12: expected exactly two safe bags in the PFX PDU")
 	}
@@ -443,123 +680,241 @@ func Decode(pfxData []byte, password string) (privateKey interface{}, certificat
 
 // DecodeChain extracts a certificate, a CA certificate chain, and private key
 // from pfxData, which must be a DER-encoded PKCS#12 file. This function assumes that there is at least one certificate
-// and only one private key in the pfxData.  The first certificate is assumed to
-// be the leaf certificate, and subsequent certificates, if any, are assumed to
-// comprise the CA certificate chain.
+// and only one private key in the pfxData.  The leaf certificate is the one
+// whose localKeyId matches that of the private key or, failing that, the first
+// one whose public key matches the private key; if there is no such
+// certificate, the first certificate is assumed to be the leaf.  The
+// public key match finds the leaf in files that have no localKeyId
+// attributes and don't list it first, such as some exports of PKI bundles.
+// The other certificates, if any, are assumed to comprise the CA
+// certificate chain.
+//
+// Shrouded key bags with the same localKeyId are taken as copies of the
+// private key shrouded with different passwords, as written by
+// [Encoder.EncodeDualPassword]: the first one that password decrypts is
+// used.
 func DecodeChain(pfxData []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
-	encodedPassword, err := bmpStringZeroTerminated(password)
-	if err != nil {
-		return nil, nil, nil, err
-	}
+	return defaultDecodeOptions.DecodeChain(pfxData, password)
+}
+
+// DecodeChain is like the package-level [DecodeChain], but uses the options in opts.
+func (opts *DecodeOptions) DecodeChain(pfxData []byte, password string) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, err error) {
+	privateKey, certificate, caCerts, _, err = opts.DecodeChainWithInfo(pfxData, password)
+	return
+}
 
-	bags, encodedPassword, err := getSafeContents(pfxData, encodedPassword, 1, 2)
+// decodeChainWithInfo implements [DecodeOptions.DecodeChainWithInfo] with
+// the password encoded as a BMPString, and the keyDeriver for it.
+func (opts *DecodeOptions) decodeChainWithInfo(pfxData, encodedPassword []byte, kd *keyDeriver) (privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, info *DecodeInfo, err error) {
+	bags, encodedPassword, err := opts.getSafeContents(pfxData, encodedPassword, kd, 1, opts.maxContentInfos())
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
+	var certs []*smx509.Certificate
+	var certKeyIDs [][]byte
+	var keyID, pkData []byte
+	var keyCopyErr error
+	keyCopies := countKeyCopies(bags)
+	bagDigests := make(map[string][]byte)
 	for _, bag := range bags {
 		switch {
 		case bag.Id.Equal(oidCertBag):
 			certsData, err := decodeCertBag(bag.Value.Bytes)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
-			certs, err := smx509.ParseCertificates(certsData)
+			parsedCerts, err := smx509.ParseCertificates(certsData)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
-			if len(certs) != 1 {
+			if len(parsedCerts) != 1 {
 				err = errors.New("pkcs12: expected exactly one certificate in the certBag")
-				return nil, nil, nil, err
-			}
-			if certificate == nil {
-				certificate = certs[0]
-			} else {
-				caCerts = append(caCerts, certs[0])
+				return nil, nil, nil, nil, err
 			}
+			certs = append(certs, parsedCerts[0])
+			certKeyIDs = append(certKeyIDs, bag.localKeyID())
 
 		case bag.Id.Equal(oidKeyBag):
 			if privateKey != nil {
 				err = errors.New("pkcs12: expected exactly one key bag")
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
 
-			if privateKey, err = smx509.ParsePKCS8PrivateKey(bag.Value.Bytes); err != nil {
-				return nil, nil, nil, err
+			pkData = bag.Value.Bytes
+			if privateKey, err = parsePkcs8PrivateKey(pkData); err != nil {
+				return nil, nil, nil, nil, err
 			}
+			keyID = bag.localKeyID()
 
 		case bag.Id.Equal(oidPKCS8ShroundedKeyBag):
+			isCopy := keyCopies[string(bag.localKeyID())] > 1
+			keyPassword, err := opts.keyBagPassword(&bag, encodedPassword)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
 			if privateKey != nil {
-				err = errors.New("pkcs12: expected exactly one key bag")
-				return nil, nil, nil, err
+				if !isCopy || !bytes.Equal(bag.localKeyID(), keyID) || !isCopyOfKey(&bag, keyPassword, kd, privateKey) {
+					err = errors.New("pkcs12: expected exactly one key bag")
+					return nil, nil, nil, nil, err
+				}
+				continue
 			}
 
-			if privateKey, err = decodePkcs8ShroudedKeyBag(bag.Value.Bytes, encodedPassword); err != nil {
-				return nil, nil, nil, err
+			if pkData, err = decryptPkcs8ShroudedKeyBag(bag.Value.Bytes, keyPassword, kd); err != nil {
+				if isCopy {
+					// Another copy may be shrouded with this password.
+					keyCopyErr = err
+					continue
+				}
+				return nil, nil, nil, nil, err
 			}
+			if privateKey, err = parsePkcs8PrivateKey(pkData); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			keyID = bag.localKeyID()
+			digest := sha256.Sum256(bag.Value.Bytes)
+			bagDigests[string(keyID)] = digest[:]
 		}
 	}
 
-	if certificate == nil {
-		return nil, nil, nil, errors.New("pkcs12: certificate missing")
+	if len(certs) == 0 {
+		return nil, nil, nil, nil, errors.New("pkcs12: certificate missing")
+	}
+	if privateKey == nil && keyCopyErr != nil {
+		return nil, nil, nil, nil, keyCopyErr
 	}
 	if privateKey == nil {
-		return nil, nil, nil, errors.New("pkcs12: private key missing")
+		return nil, nil, nil, nil, errors.New("pkcs12: private key missing")
+	}
+
+	leaf := findLeaf(privateKey, keyID, certs, certKeyIDs)
+	certificate = certs[leaf]
+	if opts.VerifyKeyPair {
+		if err = publicKeyMatches(privateKey, certificate); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	for i, cert := range certs {
+		if i != leaf {
+			caCerts = append(caCerts, cert)
+		}
+	}
+
+	info = &DecodeInfo{KeyCurve: pkcs8NamedCurve(pkData), Warnings: kd.warnings, bagDigests: bagDigests, encryptions: kd.encryptions, integrity: kd.integrity, keyDER: pkData}
+	var pkInfo pkcs8PrivateKeyInfo
+	if _, err := asn1.Unmarshal(pkData, &pkInfo); err == nil {
+		info.KeyAlgorithm = pkInfo.Algo
+	}
+	if key, ok := privateKey.(*rsa.PrivateKey); ok {
+		info.KeyBits = key.N.BitLen()
 	}
 
 	return
 }
 
-// DecodeTrustStore extracts the certificates from pfxData, which must be a DER-encoded
-// PKCS#12 file containing exclusively certificates with attribute 2.16.840.1.113894.746875.1.1,
-// which is used by Java to designate a trust anchor.
-//
-// If the password argument is empty, DecodeTrustStore will decode either password-less
-// PKCS#12 files (i.e. those without encryption) or files with a literal empty password.
-func DecodeTrustStore(pfxData []byte, password string) (certs []*smx509.Certificate, err error) {
-	encodedPassword, err := bmpStringZeroTerminated(password)
+// isCopyOfKey reports whether the shrouded key bag, which has the same
+// localKeyId as privateKey, may hold another copy of it, as written by
+// [Encoder.EncodeDualPassword].  If the bag decrypts to a key with password,
+// it must be the same key; if it doesn't, it is shrouded with another
+// password, and only its localKeyId ties it to the certificate of privateKey.
+func isCopyOfKey(bag *safeBag, password []byte, kd *keyDeriver, privateKey interface{}) bool {
+	pkData, err := decryptPkcs8ShroudedKeyBag(bag.Value.Bytes, password, kd)
 	if err != nil {
-		return nil, err
+		return true
 	}
-
-	bags, _, err := getSafeContents(pfxData, encodedPassword, 1, 1)
+	key, err := parsePkcs8PrivateKey(pkData)
 	if err != nil {
-		return nil, err
+		// a wrong password rarely yields valid padding
+		return true
 	}
+	k, ok := key.(interface{ Equal(crypto.PrivateKey) bool })
+	return ok && k.Equal(privateKey)
+}
 
-	for _, bag := range bags {
-		switch {
-		case bag.Id.Equal(oidCertBag):
-			if !bag.hasAttribute(oidJavaTrustStore) {
-				return nil, errors.New("pkcs12: trust store contains a certificate that is not marked as trusted")
-			}
-			certsData, err := decodeCertBag(bag.Value.Bytes)
-			if err != nil {
-				return nil, err
-			}
-			parsedCerts, err := smx509.ParseCertificates(certsData)
-			if err != nil {
-				return nil, err
+// countKeyCopies counts the shrouded key bags of bags by localKeyId.  Key
+// bags with the same localKeyId, such as those written by
+// [Encoder.EncodeDualPassword], are copies of the same key shrouded with
+// different passwords.  Key bags without a localKeyId are not counted.
+func countKeyCopies(bags []safeBag) map[string]int {
+	copies := make(map[string]int)
+	for i := range bags {
+		if bags[i].Id.Equal(oidPKCS8ShroundedKeyBag) {
+			if keyID := bags[i].localKeyID(); len(keyID) != 0 {
+				copies[string(keyID)]++
 			}
+		}
+	}
+	return copies
+}
 
-			if len(parsedCerts) != 1 {
-				err = errors.New("pkcs12: expected exactly one certificate in the certBag")
-				return nil, err
+// findLeaf returns the index of the certificate that belongs to privateKey.
+// A certificate whose localKeyId uniquely matches that of the key is
+// preferred; otherwise, as localKeyIds are missing or ambiguous in files
+// produced by some software (e.g. NSS), the first certificate whose public
+// key matches the private key is used.  If neither is found, the first
+// certificate is assumed to be the leaf.
+func findLeaf(privateKey interface{}, keyID []byte, certs []*smx509.Certificate, certKeyIDs [][]byte) int {
+	if len(keyID) != 0 {
+		match := -1
+		for i, id := range certKeyIDs {
+			if bytes.Equal(id, keyID) {
+				if match != -1 {
+					match = -1
+					break
+				}
+				match = i
 			}
+		}
+		if match != -1 && publicKeyMatches(privateKey, certs[match]) != ErrKeyCertMismatch {
+			return match
+		}
+	}
+	for i, cert := range certs {
+		if publicKeyMatches(privateKey, cert) == nil {
+			return i
+		}
+	}
+	return 0
+}
 
-			certs = append(certs, parsedCerts[0])
+// publicKeyMatches reports whether the public key of privateKey is that of
+// cert.  It returns ErrKeyCertMismatch if it isn't, or another error if
+// that can't be determined.
+func publicKeyMatches(privateKey interface{}, cert *smx509.Certificate) error {
+	priv, ok := privateKey.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return NotImplementedError(fmt.Sprintf("unsupported private key type: %T", privateKey))
+	}
+	pub, ok := priv.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return NotImplementedError(fmt.Sprintf("unsupported public key type: %T", priv.Public()))
+	}
+	if !pub.Equal(cert.PublicKey) {
+		return ErrKeyCertMismatch
+	}
+	return nil
+}
 
-		default:
-			return nil, errors.New("pkcs12: expected only certificate bags")
+func (opts *DecodeOptions) getSafeContents(p12Data, password []byte, kd *keyDeriver, expectedItemsMin int, expectedItemsMax int) (bags []safeBag, updatedPassword []byte, err error) {
+	if err := checkTruncated(p12Data); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.OuterEncryption {
+		if p12Data, err = unwrapOuterEncryption(p12Data, password, kd); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return
-}
+	if opts.StrictDER {
+		if err := checkDER(p12Data); err != nil {
+			return nil, nil, err
+		}
+	}
 
-func getSafeContents(p12Data, password []byte, expectedItemsMin int, expectedItemsMax int) (bags []safeBag, updatedPassword []byte, err error) {
-	pfx := new(pfxPdu)
-	if err := unmarshal(p12Data, pfx); err != nil {
+	pfx, err := parsePFX(p12Data)
+	if err != nil {
 		return nil, nil, errors.New("pkcs12: error reading P12 data: " + err.Error())
 	}
 
@@ -567,75 +922,412 @@ func getSafeContents(p12Data, password []byte, expectedItemsMin int, expectedIte
 		return nil, nil, NotImplementedError("can only decode v3 PFX PDU's")
 	}
 
-	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
-		return nil, nil, NotImplementedError("only password-protected PFX is implemented")
+	signed := pfx.AuthSafe.ContentType.Equal(oidSignedDataContentType)
+	switch {
+	case pfx.AuthSafe.ContentType.Equal(oidDataContentType):
+		// unmarshal the explicit bytes in the content for type 'data'
+		if err := unmarshalRawValue(pfx.AuthSafe.Content.Bytes, &pfx.AuthSafe.Content); err != nil {
+			return nil, nil, &parseError{where: "authSafe", err: err}
+		}
+	case signed:
+		if pfx.AuthSafe.Content.Bytes, err = opts.verifySignedData(pfx.AuthSafe); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, NotImplementedError("only password-protected and signed PFX are implemented")
 	}
 
-	// unmarshal the explicit bytes in the content for type 'data'
-	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &pfx.AuthSafe.Content); err != nil {
-		return nil, nil, err
+	type macResult struct {
+		password []byte
+		err      error
 	}
-
-	if len(pfx.MacData.Mac.Algorithm.Algorithm) == 0 {
+	if !signed && !opts.IgnoreMAC && len(pfx.MacData.Mac.Algorithm.Algorithm) != 0 {
+		salt, iterations := macKDFParameters(&pfx.MacData)
+		if len(salt) < MinMACSaltLen {
+			kd.warn(WarningWeakMACSalt, fmt.Sprintf("the MAC salt is %d bytes long", len(salt)))
+		}
+		if iterations < MinMACIterations {
+			kd.warn(WarningLowMACIterations, fmt.Sprintf("the MAC key is derived with %d iterations", iterations))
+		}
+		kd.describeIntegrity(macDescription(&pfx.MacData))
+	}
+	var macDone chan macResult
+	switch {
+	case signed && opts.SignerCertificate == nil:
+		kd.describeIntegrity("signature not verified")
+	case signed:
+		// public-key integrity mode: the signature replaces the MAC
+		kd.describeIntegrity("signed")
+	case opts.IgnoreMAC:
+		kd.describeIntegrity("MAC not verified")
+	case len(pfx.MacData.Mac.Algorithm.Algorithm) == 0:
 		if !(len(password) == 2 && password[0] == 0 && password[1] == 0) {
 			return nil, nil, errors.New("pkcs12: no MAC in data")
 		}
-	} else if err := verifyMac(&pfx.MacData, pfx.AuthSafe.Content.Bytes, password); err != nil {
-		if err == ErrIncorrectPassword && len(password) == 2 && password[0] == 0 && password[1] == 0 {
-			// some implementations use an empty byte array
-			// for the empty string password try one more
-			// time with empty-empty password
-			password = nil
-			err = verifyMac(&pfx.MacData, pfx.AuthSafe.Content.Bytes, password)
-		}
+		kd.describeIntegrity("no MAC")
+	case useParallelKDF(opts.ParallelKDFThreshold, macIterations(&pfx.MacData)):
+		// Verify the MAC while the keys of the contents are being derived.
+		macDone = make(chan macResult, 1)
+		go func(password []byte) {
+			matched, err := opts.verifyMacData(&pfx.MacData, pfx.AuthSafe.Content.Bytes, password, kd.fallbackPasswordsFor(password))
+			macDone <- macResult{matched, err}
+		}(password)
+	default:
+		matched, err := opts.verifyMacData(&pfx.MacData, pfx.AuthSafe.Content.Bytes, password, kd.fallbackPasswordsFor(password))
 		if err != nil {
 			return nil, nil, err
 		}
+		password = kd.matchedPassword(matched, password)
+	}
+
+	if macDone != nil {
+		opts.deriveContentKeys(pfx.AuthSafe.Content.Bytes, password, kd)
+		result := <-macDone
+		if result.err != nil {
+			return nil, nil, result.err
+		}
+		// the MAC may have matched another encoding of the password
+		password = kd.matchedPassword(result.password, password)
 	}
 
-	var authenticatedSafe []contentInfo
-	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+	// The contents are only decompressed, decrypted and parsed once the MAC
+	// has been verified.
+	authenticatedSafe := pfx.AuthSafe.Content.Bytes
+	if opts.DecompressContent && bytes.HasPrefix(authenticatedSafe, gzipMagic) {
+		if authenticatedSafe, err = gunzip(authenticatedSafe); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	bags, err = opts.decodeAuthenticatedSafe(authenticatedSafe, password, kd, expectedItemsMin, expectedItemsMax)
+	if err != nil {
 		return nil, nil, err
 	}
+	return bags, password, nil
+}
+
+// deriveContentKeys derives through kd the keys of the EncryptedData
+// ContentInfos of the AuthenticatedSafe encoded in authenticatedSafeBytes,
+// while their MAC is being verified, so that decoding them once the MAC has
+// been verified doesn't wait for the key derivations.  Only the algorithms
+// of the EncryptedData are read: nothing is decrypted.  Errors are ignored,
+// to be reported by decoding after the MAC has been verified.
+func (opts *DecodeOptions) deriveContentKeys(authenticatedSafeBytes, password []byte, kd *keyDeriver) {
+	if kd == nil || opts.BagPassword != nil || (opts.DecompressContent && bytes.HasPrefix(authenticatedSafeBytes, gzipMagic)) {
+		return
+	}
+	authenticatedSafe, err := parseAuthenticatedSafe(authenticatedSafeBytes)
+	if err != nil {
+		return
+	}
+	for _, ci := range authenticatedSafe {
+		if !ci.ContentType.Equal(oidEncryptedDataContentType) {
+			continue
+		}
+		var encryptedData encryptedData
+		if err := unmarshalEncryptedData(ci.Content.Bytes, &encryptedData); err != nil {
+			return
+		}
+		if _, _, err := pbeCipherFor(encryptedData.EncryptedContentInfo.Algorithm(), password, kd); err != nil {
+			return
+		}
+	}
+}
+
+// gzipMagic starts gzip streams (rfc1952#section-2.3.1).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// An AuthenticatedSafe decompressed for [DecodeOptions.DecompressContent]
+// may be at most maxDecompressionRatio times as long as the compressed one,
+// or minDecompressedLimit bytes long if that is more, so that a small file
+// can't force a large allocation.
+const (
+	maxDecompressionRatio = 32
+	minDecompressedLimit  = 4 << 20
+)
+
+// gunzip decompresses the gzip stream data.
+func gunzip(data []byte) ([]byte, error) {
+	limit := minDecompressedLimit
+	if len(data) > limit/maxDecompressionRatio {
+		limit = len(data) * maxDecompressionRatio
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("pkcs12: error decompressing the content: " + err.Error())
+	}
+	decompressed, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, errors.New("pkcs12: error decompressing the content: " + err.Error())
+	}
+	if len(decompressed) > limit {
+		return nil, fmt.Errorf("pkcs12: the decompressed content is longer than the limit of %d bytes", limit)
+	}
+	return decompressed, nil
+}
+
+// decodeAuthenticatedSafe decrypts and parses the SafeContents in the
+// AuthenticatedSafe encoded in authenticatedSafeBytes.
+func (opts *DecodeOptions) decodeAuthenticatedSafe(authenticatedSafeBytes, password []byte, kd *keyDeriver, expectedItemsMin int, expectedItemsMax int) (bags []safeBag, err error) {
+	if opts.StrictDER {
+		if err := checkDER(authenticatedSafeBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	authenticatedSafe, err := parseAuthenticatedSafe(authenticatedSafeBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(authenticatedSafe) < expectedItemsMin || len(authenticatedSafe) > expectedItemsMax {
 		if expectedItemsMin == expectedItemsMax {
-			return nil, nil, NotImplementedError(fmt.Sprintf("expected exactly %d items in the authenticated safe, but this file has %d", expectedItemsMin, len(authenticatedSafe)))
+			return nil, NotImplementedError(fmt.Sprintf("expected exactly %d items in the authenticated safe, but this file has %d", expectedItemsMin, len(authenticatedSafe)))
 		}
-		return nil, nil, NotImplementedError(fmt.Sprintf("expected between %d and %d items in the authenticated safe, but this file has %d", expectedItemsMin, expectedItemsMax, len(authenticatedSafe)))
+		return nil, NotImplementedError(fmt.Sprintf("expected between %d and %d items in the authenticated safe, but this file has %d", expectedItemsMin, expectedItemsMax, len(authenticatedSafe)))
 	}
 
-	for _, ci := range authenticatedSafe {
-		var data []byte
+	for i, ci := range authenticatedSafe {
+		if len(opts.ContentTypeOID) != 0 && ci.ContentType.Equal(opts.ContentTypeOID) {
+			ci.ContentType = oidDataContentType
+		}
+		encrypted := ci.ContentType.Equal(oidEncryptedDataContentType)
+		where := fmt.Sprintf("content #%d", i+1)
+		if encrypted {
+			where = "encrypted " + where
+		}
+		blockPassword := password
+		if opts.BagPassword != nil && encrypted {
+			if blockPassword, err = opts.bagPassword("encryptedData", nil); err != nil {
+				return nil, err
+			}
+		}
+		data, err := decryptContentInfo(ci, blockPassword, kd)
+		if err != nil {
+			return nil, inParseContext(err, where)
+		}
 
-		switch {
-		case ci.ContentType.Equal(oidDataContentType):
-			if err := unmarshal(ci.Content.Bytes, &data); err != nil {
-				return nil, nil, err
+		if opts.StrictDER {
+			if err := checkDER(data); err != nil {
+				return nil, err
 			}
-		case ci.ContentType.Equal(oidEncryptedDataContentType):
-			var encryptedData encryptedData
-			if err := unmarshal(ci.Content.Bytes, &encryptedData); err != nil {
-				return nil, nil, err
+		}
+
+		safeContents, err := parseSafeContents(data)
+		if err != nil {
+			if encrypted {
+				// valid padding, but the plaintext is garbage
+				return nil, ErrDecryption
 			}
-			if encryptedData.Version != 0 {
-				return nil, nil, NotImplementedError("only version 0 of EncryptedData is supported")
+			if !opts.Lenient {
+				return nil, inParseContext(err, where)
 			}
-			if data, err = pbDecrypt(encryptedData.EncryptedContentInfo, password); err != nil {
-				return nil, nil, err
+			// some minimal exporters store a bare certificate
+			if _, certErr := smx509.ParseCertificate(data); certErr != nil {
+				return nil, inParseContext(err, where)
 			}
-		default:
-			return nil, nil, NotImplementedError("only data and encryptedData content types are supported in authenticated safe")
+			certBag, certErr := makeCertBag(data, nil)
+			if certErr != nil {
+				return nil, certErr
+			}
+			safeContents = []safeBag{*certBag}
 		}
-
-		var safeContents []safeBag
-		if err := unmarshal(data, &safeContents); err != nil {
-			return nil, nil, err
+		if safeContents, err = flattenSafeContents(safeContents, 0, opts.maxNestingDepth()); err != nil {
+			return nil, inParseContext(err, where)
 		}
 		bags = append(bags, safeContents...)
 	}
 
-	return bags, password, nil
+	return bags, nil
+}
+
+// decryptContentInfo returns the SafeContents held by ci, decrypting it with
+// a key derived from password through kd, which may be nil, if it is of type
+// encryptedData.
+func decryptContentInfo(ci contentInfo, password []byte, kd *keyDeriver) (data []byte, err error) {
+	switch {
+	case ci.ContentType.Equal(oidDataContentType):
+		if data, err = unmarshalOctetString(ci.Content.Bytes); err != nil {
+			return nil, &parseError{where: "data", err: err}
+		}
+	case ci.ContentType.Equal(oidEncryptedDataContentType):
+		var encryptedData encryptedData
+		if err := unmarshalEncryptedData(ci.Content.Bytes, &encryptedData); err != nil {
+			return nil, &parseError{where: "encryptedData", err: err}
+		}
+		// The version is 0, or 2 if there are unprotected attributes, but
+		// doesn't affect the decryption: any version is accepted.
+		if data, err = pbDecrypt(encryptedData.EncryptedContentInfo, password, kd); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, NotImplementedError("only data and encryptedData content types are supported in authenticated safe")
+	}
+	return data, nil
+}
+
+// flattenSafeContents replaces the safeContentsBags in bags, which nest
+// another SafeContents, with the bags they contain.  depth is the nesting
+// depth of bags, and maxDepth the maximum depth, or negative for no limit.
+func flattenSafeContents(bags []safeBag, depth, maxDepth int) ([]safeBag, error) {
+	var flattened []safeBag
+	for i, bag := range bags {
+		if !bag.Id.Equal(oidSafeContentsBag) {
+			flattened = append(flattened, bag)
+			continue
+		}
+		if maxDepth >= 0 && depth >= maxDepth {
+			return nil, fmt.Errorf("pkcs12: safeContentsBags are nested too deeply (maximum depth %d)", maxDepth)
+		}
+		nested, err := parseSafeContents(bag.Value.Bytes)
+		if err == nil {
+			nested, err = flattenSafeContents(nested, depth+1, maxDepth)
+		}
+		if err != nil {
+			return nil, inParseContext(err, fmt.Sprintf("safe bag #%d", i+1))
+		}
+		flattened = append(flattened, nested...)
+	}
+	return flattened, nil
+}
+
+// parseAuthenticatedSafe parses the AuthenticatedSafe encoded in der.  The
+// ContentInfos are parsed one by one, so that an error tells which one is
+// malformed.
+func parseAuthenticatedSafe(der []byte) ([]contentInfo, error) {
+	elements, err := unmarshalSequenceOf(der)
+	if err != nil {
+		return nil, &parseError{where: "authenticated safe", err: err}
+	}
+	authenticatedSafe := make([]contentInfo, len(elements))
+	for i, element := range elements {
+		if err := unmarshalContentInfo(element.FullBytes, &authenticatedSafe[i]); err != nil {
+			return nil, &parseError{where: fmt.Sprintf("content #%d", i+1), err: err}
+		}
+	}
+	return authenticatedSafe, nil
+}
+
+// parseSafeContents parses the SafeContents encoded in der.  Like
+// parseAuthenticatedSafe, it parses the bags one by one.
+func parseSafeContents(der []byte) ([]safeBag, error) {
+	elements, err := unmarshalSequenceOf(der)
+	if err != nil {
+		return nil, &parseError{where: "SafeContents", err: err}
+	}
+	safeContents := make([]safeBag, len(elements))
+	for i, element := range elements {
+		if err := unmarshal(element.FullBytes, &safeContents[i]); err != nil {
+			return nil, &parseError{where: fmt.Sprintf("safe bag #%d", i+1), err: err}
+		}
+	}
+	return safeContents, nil
+}
+
+// verifyMacData verifies the MAC of message and returns the encoding of the
+// password that it was computed with: password, or one of fallbacks, the
+// encodings of the same password by non-conforming implementations.  The
+// fallbacks are only tried with the PKCS#12 KDF: PBMAC1 takes the password
+// as UTF-8.
+func (opts *DecodeOptions) verifyMacData(macData *macData, message, password []byte, fallbacks [][]byte) ([]byte, error) {
+	candidates := [][]byte{password}
+	if len(password) == 2 && password[0] == 0 && password[1] == 0 {
+		// some implementations use an empty byte array
+		// for the empty string password
+		candidates = append(candidates, nil)
+	}
+	if !macData.Mac.Algorithm.Algorithm.Equal(oidPBMAC1) {
+		candidates = append(candidates, fallbacks...)
+	}
+
+	var matched []byte
+	found := false
+	for _, candidate := range candidates {
+		err := verifyMac(macData, message, candidate)
+		if opts.ConstantTimeDecode {
+			if err == nil && !found {
+				matched, found = candidate, true
+			}
+			continue
+		}
+		if err == nil {
+			return candidate, nil
+		}
+		if err != ErrIncorrectPassword {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, ErrIncorrectPassword
+	}
+	return matched, nil
+}
+
+// passwordError returns the error to report when password couldn't be
+// encoded.  With ConstantTimeDecode, it performs the same MAC key derivation
+// as a real password check and returns ErrIncorrectPassword.
+func (opts *DecodeOptions) passwordError(pfxData []byte, err error) error {
+	if !opts.ConstantTimeDecode {
+		return err
+	}
+	if pfx, err := parsePFX(pfxData); err == nil && len(pfx.MacData.Mac.Algorithm.Algorithm) != 0 {
+		var message []byte
+		if unmarshal(pfx.AuthSafe.Content.Bytes, &message) == nil {
+			verifyMac(&pfx.MacData, message, nil)
+		}
+	}
+	return ErrIncorrectPassword
+}
+
+// fallbackPasswordsFor returns the encodings, other than the BMPString
+// encoding, that non-conforming implementations use for the password encoded
+// in the BMPString password, or nil if the password is ASCII, for which they
+// agree.  These are the UTF-8 encoding without a terminator, as used by some
+// older Go implementations, and the byte-by-byte BMPString encoding, as used by
+// OpenSSL before 1.1.0.  If the password isn't valid UTF-8, only the
+// byte-by-byte encoding recorded by newKeyDeriverFor is returned, as the
+// invalid bytes were replaced with U+FFFD in password.
+func (kd *keyDeriver) fallbackPasswordsFor(password []byte) [][]byte {
+	if kd != nil && kd.bytewisePassword != nil {
+		return [][]byte{kd.bytewisePassword}
+	}
+	s, err := decodeBMPString(password)
+	if err != nil {
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return [][]byte{[]byte(s), bytewiseBMPStringZeroTerminated(s)}
+		}
+	}
+	return nil
+}
+
+// encodePassword returns the password as used for deriving keys.
+func (enc *Encoder) encodePassword(password string) ([]byte, error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, err
+	}
+	return enc.keyDerivationPassword(encodedPassword), nil
+}
+
+// keyDerivationPassword returns the password as used for deriving keys,
+// given its BMPString encoding.
+func (enc *Encoder) keyDerivationPassword(encodedPassword []byte) []byte {
+	if len(encodedPassword) == 2 && enc.nullEmptyPassword {
+		return nil
+	}
+	return encodedPassword
+}
+
+// checkEncodeArgs checks the private key and the emptiness of the password
+// given to [Encoder.Encode] and its variants.
+func (enc *Encoder) checkEncodeArgs(privateKey interface{}, emptyPassword bool) error {
+	if enc.macAlgorithm == nil && enc.certAlgorithm == nil && enc.keyAlgorithm == nil && !emptyPassword {
+		return errors.New("password must be empty")
+	}
+	return checkPrivateKeyType(privateKey)
 }
 
 // Encode is equivalent to LegacyRC2.WithRand(rand).Encode.
@@ -648,6 +1340,24 @@ func Encode(rand io.Reader, privateKey interface{}, certificate *smx509.Certific
 	return LegacyRC2.WithRand(rand).Encode(privateKey, certificate, caCerts, password)
 }
 
+// CreateIdentity encodes a private key, the end-entity certificate leaf and
+// the CA certificates of its chain as a PKCS#12 file protected with
+// password, using [Modern2023].  It is the simplest way to create a file
+// for current software; use an [Encoder] to control the algorithms.
+//
+// It returns [ErrKeyCertMismatch] if key doesn't belong to leaf.  The chain
+// is written from the issuer of leaf up to the root, whatever its order;
+// see [ChainLeafToRoot].
+func CreateIdentity(key interface{}, leaf *smx509.Certificate, chain []*smx509.Certificate, password string) ([]byte, error) {
+	if err := checkPrivateKeyType(key); err != nil {
+		return nil, err
+	}
+	if err := publicKeyMatches(key, leaf); err != nil {
+		return nil, err
+	}
+	return Modern2023.WithChainOrder(ChainLeafToRoot).Encode(key, leaf, chain, password)
+}
+
 // Encode produces pfxData containing one private key (privateKey), an
 // end-entity certificate (certificate), and any number of CA certificates
 // (caCerts).
@@ -661,42 +1371,107 @@ func Encode(rand io.Reader, privateKey interface{}, certificate *smx509.Certific
 // private key shrouded with the key encryption algorithm.  The private key bag and
 // the end-entity certificate bag have the LocalKeyId attribute set to the SHA-1
 // fingerprint of the end-entity certificate.
+//
+// The certificates are written as they are, with all their extensions, so
+// importers that link them through their subject and authority key
+// identifiers rather than through LocalKeyId attributes can build the chain.
 func (enc *Encoder) Encode(privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, password string) (pfxData []byte, err error) {
-	if enc.macAlgorithm == nil && enc.certAlgorithm == nil && enc.keyAlgorithm == nil && password != "" {
-		return nil, errors.New("password must be empty")
+	if err := enc.checkEncodeArgs(privateKey, password == ""); err != nil {
+		return nil, err
 	}
 
-	encodedPassword, err := bmpStringZeroTerminated(password)
+	encodedPassword, err := enc.encodePassword(password)
 	if err != nil {
 		return nil, err
 	}
+	return enc.encode(privateKey, certificate, caCerts, encodedPassword, nil)
+}
 
+// encode implements [Encoder.Encode] with the password encoded as a
+// BMPString.  extraKeyPasswords are passed to makeAuthenticatedSafe.
+func (enc *Encoder) encode(privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, encodedPassword []byte, extraKeyPasswords [][]byte) (pfxData []byte, err error) {
 	var pfx pfxPdu
 	pfx.Version = 3
 
+	// The MAC key doesn't depend on the contents, so it may be derived
+	// while the contents are being encrypted.
+	var newMac func() (hash.Hash, error)
+	if enc.macAlgorithm != nil {
+		if newMac, err = enc.startMacData(&pfx.MacData, encodedPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	authenticatedSafe, err := enc.makeAuthenticatedSafe(privateKey, certificate, caCerts, encodedPassword, extraKeyPasswords)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = setAuthSafe(&pfx, authenticatedSafe, newMac); err != nil {
+		return nil, err
+	}
+
+	if pfxData, err = asn1.Marshal(pfx); err != nil {
+		return nil, errors.New("pkcs12: error writing P12 data: " + err.Error())
+	}
+	if err = enc.checkOutputSize(pfxData); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// makeAuthenticatedSafe returns the AuthenticatedSafe built by
+// [Encoder.Encode].  For each of extraKeyPasswords, a copy of the private
+// key shrouded with that password follows the key bag.
+func (enc *Encoder) makeAuthenticatedSafe(privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, encodedPassword []byte, extraKeyPasswords [][]byte) (authenticatedSafe []contentInfo, err error) {
+	if err := enc.verifyChain(certificate, caCerts); err != nil {
+		return nil, err
+	}
+	if enc.clientAuth && !hasClientAuth(certificate) {
+		return nil, errors.New("pkcs12: the certificate doesn't have the clientAuth extended key usage")
+	}
+
 	var certFingerprint = sha1.Sum(certificate.Raw)
+	localKeyID := certFingerprint[:]
+	if enc.localKeyID != nil {
+		localKeyID = enc.localKeyID
+	}
 	var localKeyIdAttr pkcs12Attribute
 	localKeyIdAttr.Id = oidLocalKeyID
 	localKeyIdAttr.Value.Class = 0
 	localKeyIdAttr.Value.Tag = 17
 	localKeyIdAttr.Value.IsCompound = true
-	if localKeyIdAttr.Value.Bytes, err = asn1.Marshal(certFingerprint[:]); err != nil {
+	if localKeyIdAttr.Value.Bytes, err = asn1.Marshal(localKeyID); err != nil {
 		return nil, err
 	}
 
-	var certBags []safeBag
-	if certBag, err := makeCertBag(certificate.Raw, []pkcs12Attribute{localKeyIdAttr}); err != nil {
+	leafAttributes, caAttributes := []pkcs12Attribute{localKeyIdAttr}, []pkcs12Attribute{}
+	if enc.matchedNames {
+		name := certificate.Subject.CommonName
+		if name == "" {
+			name = certificate.Subject.String()
+		}
+		friendlyName, err := makeFriendlyNameAttribute(name)
+		if err != nil {
+			return nil, err
+		}
+		leafAttributes = append(leafAttributes, friendlyName)
+	}
+	if enc.omitAttributes {
+		leafAttributes, caAttributes = nil, nil
+	}
+
+	leafBag, err := makeCertBag(certificate.Raw, leafAttributes)
+	if err != nil {
 		return nil, err
-	} else {
-		certBags = append(certBags, *certBag)
 	}
 
-	// Add all CA certificates to the cert bags.
-	for _, cert := range caCerts {
-		if certBag, err := makeCertBag(cert.Raw, []pkcs12Attribute{}); err != nil {
+	var caBags []safeBag
+	for _, cert := range orderChain(certificate, caCerts, enc.chainOrder) {
+		if certBag, err := makeCertBag(cert.Raw, caAttributes); err != nil {
 			return nil, err
 		} else {
-			certBags = append(certBags, *certBag)
+			caBags = append(caBags, *certBag)
 		}
 	}
 
@@ -718,216 +1493,266 @@ func (enc *Encoder) Encode(privateKey interface{}, certificate *smx509.Certifica
 			return nil, err
 		}
 	}
-	keyBag.Attributes = append(keyBag.Attributes, localKeyIdAttr)
-
-	// Construct an authenticated safe with two SafeContents.
-	// The first SafeContents is encrypted and contains the cert bags.
-	// The second SafeContents is unencrypted and contains the shrouded key bag.
-	var authenticatedSafe [2]contentInfo
-	if authenticatedSafe[0], err = enc.makeSafeContents(enc.rand, certBags, enc.certAlgorithm, encodedPassword); err != nil {
-		return nil, err
-	}
-	if authenticatedSafe[1], err = enc.makeSafeContents(enc.rand, []safeBag{keyBag}, nil, nil); err != nil {
-		return nil, err
+	keyBag.Attributes = leafAttributes
+	keyBags := []safeBag{keyBag}
+	for _, password := range extraKeyPasswords {
+		keyBag.Value.Bytes, err = enc.encodePkcs8ShroudedKeyBag(enc.rand, privateKey, password)
+		if err != nil {
+			return nil, err
+		}
+		keyBags = append(keyBags, keyBag)
 	}
 
-	var authenticatedSafeBytes []byte
-	if authenticatedSafeBytes, err = asn1.Marshal(authenticatedSafe[:]); err != nil {
-		return nil, err
+	// Construct an authenticated safe with a SafeContents per block of
+	// the layout.  By default, the first SafeContents is encrypted and
+	// contains the cert bags, and the second SafeContents is unencrypted
+	// and contains the shrouded key bag.
+	layout := enc.layout
+	if layout == nil {
+		layout = OpenSSLLayout
 	}
-
-	if enc.macAlgorithm != nil {
-		// compute the MAC
-		pfx.MacData.Mac.Algorithm.Algorithm = enc.macAlgorithm
-		pfx.MacData.MacSalt = make([]byte, enc.saltLen)
-		if _, err = enc.rand.Read(pfx.MacData.MacSalt); err != nil {
-			return nil, err
+	for _, block := range layout {
+		var bags []safeBag
+		if block.Contents&LayoutKey != 0 && enc.bagOrder == KeyFirst {
+			bags = append(bags, keyBags...)
+		}
+		if block.Contents&LayoutLeafCert != 0 {
+			bags = append(bags, *leafBag)
+		}
+		if block.Contents&LayoutCACerts != 0 {
+			bags = append(bags, caBags...)
+		}
+		if block.Contents&LayoutKey != 0 && enc.bagOrder == CertFirst {
+			bags = append(bags, keyBags...)
+		}
+		if len(bags) == 0 {
+			continue
 		}
-		pfx.MacData.Iterations = enc.macIterations
-		if err = computeMac(&pfx.MacData, authenticatedSafeBytes, encodedPassword); err != nil {
+		var ci contentInfo
+		if block.Encrypted {
+			ci, err = enc.makeSafeContents(enc.rand, bags, enc.certAlgorithm, encodedPassword)
+		} else {
+			ci, err = enc.makeSafeContents(enc.rand, bags, nil, nil)
+		}
+		if err != nil {
 			return nil, err
 		}
+		authenticatedSafe = append(authenticatedSafe, ci)
 	}
 
-	pfx.AuthSafe.ContentType = oidDataContentType
-	pfx.AuthSafe.Content.Class = 2
-	pfx.AuthSafe.Content.Tag = 0
-	pfx.AuthSafe.Content.IsCompound = true
-	if pfx.AuthSafe.Content.Bytes, err = asn1.Marshal(authenticatedSafeBytes); err != nil {
-		return nil, err
-	}
-
-	if pfxData, err = asn1.Marshal(pfx); err != nil {
-		return nil, errors.New("pkcs12: error writing P12 data: " + err.Error())
-	}
-	return
+	return authenticatedSafe, nil
 }
 
-// EncodeTrustStore is equivalent to LegacyRC2.WithRand(rand).EncodeTrustStore.
-// See [Encoder.EncodeTrustStore] and [LegacyRC2] for details.
-//
-// Deprecated: for the same behavior, use LegacyRC2.EncodeTrustStore; to generate passwordless trust stores,
-// use Passwordless.EncodeTrustStore.
-func EncodeTrustStore(rand io.Reader, certs []*smx509.Certificate, password string) (pfxData []byte, err error) {
-	return LegacyRC2.WithRand(rand).EncodeTrustStore(certs, password)
-}
-
-// EncodeTrustStore produces pfxData containing any number of CA certificates
-// (certs) to be trusted. The certificates will be marked with a special OID that
-// allow it to be used as a Java TrustStore in Java 1.8 and newer.
-//
-// EncodeTrustStore creates a single SafeContents that's optionally encrypted
-// and contains the certificates.
-//
-// The Subject of the certificates are used as the Friendly Names (Aliases)
-// within the resulting pfxData. If certificates share a Subject, then the
-// resulting Friendly Names (Aliases) will be identical, which Java may treat as
-// the same entry when used as a Java TrustStore, e.g. with `keytool`.  To
-// customize the Friendly Names, use [EncodeTrustStoreEntries].
-func (enc *Encoder) EncodeTrustStore(certs []*smx509.Certificate, password string) (pfxData []byte, err error) {
-	var certsWithFriendlyNames []TrustStoreEntry
-	for _, cert := range certs {
-		certsWithFriendlyNames = append(certsWithFriendlyNames, TrustStoreEntry{
-			Cert:         cert,
-			FriendlyName: cert.Subject.String(),
-		})
-	}
-	return enc.EncodeTrustStoreEntries(certsWithFriendlyNames, password)
-}
-
-// TrustStoreEntry represents an entry in a Java TrustStore.
-type TrustStoreEntry struct {
-	Cert         *smx509.Certificate
-	FriendlyName string
-}
-
-// EncodeTrustStoreEntries is equivalent to LegacyRC2.WithRand(rand).EncodeTrustStoreEntries.
-// See [Encoder.EncodeTrustStoreEntries] and [LegacyRC2] for details.
-//
-// Deprecated: for the same behavior, use LegacyRC2.EncodeTrustStoreEntries; to generate passwordless trust stores,
-// use Passwordless.EncodeTrustStoreEntries.
-func EncodeTrustStoreEntries(rand io.Reader, entries []TrustStoreEntry, password string) (pfxData []byte, err error) {
-	return LegacyRC2.WithRand(rand).EncodeTrustStoreEntries(entries, password)
+// checkPrivateKeyType returns a NotImplementedError if privateKey is not of a
+// type that can be encoded.
+func checkPrivateKeyType(privateKey interface{}) error {
+	switch privateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, *sm2.PrivateKey, ed25519.PrivateKey:
+		return nil
+	}
+	return NotImplementedError(fmt.Sprintf("unsupported private key type: %T (supported types are *rsa.PrivateKey, *ecdsa.PrivateKey, *sm2.PrivateKey and ed25519.PrivateKey)", privateKey))
 }
 
-// EncodeTrustStoreEntries produces pfxData containing any number of CA
-// certificates (entries) to be trusted. The certificates will be marked with a
-// special OID that allow it to be used as a Java TrustStore in Java 1.8 and newer.
-//
-// This is identical to [Encoder.EncodeTrustStore], but also allows for setting specific
-// Friendly Names (Aliases) to be used per certificate, by specifying a slice
-// of TrustStoreEntry.
-//
-// If the same Friendly Name is used for more than one certificate, then the
-// resulting Friendly Names (Aliases) in the pfxData will be identical, which Java
-// may treat as the same entry when used as a Java TrustStore, e.g. with `keytool`.
-//
-// EncodeTrustStoreEntries creates a single SafeContents that's optionally
-// encrypted and contains the certificates.
-func (enc *Encoder) EncodeTrustStoreEntries(entries []TrustStoreEntry, password string) (pfxData []byte, err error) {
-	if enc.macAlgorithm == nil && enc.certAlgorithm == nil && password != "" {
-		return nil, errors.New("password must be empty")
+// makeFriendlyNameAttribute returns the friendlyName attribute with the
+// given name, encoded as a BMPString.
+func makeFriendlyNameAttribute(name string) (pkcs12Attribute, error) {
+	bmpFriendlyName, err := bmpString(name)
+	if err != nil {
+		return pkcs12Attribute{}, err
 	}
 
-	encodedPassword, err := bmpStringZeroTerminated(password)
+	encodedFriendlyName, err := asn1.Marshal(asn1.RawValue{
+		Class:      0,
+		Tag:        30,
+		IsCompound: false,
+		Bytes:      bmpFriendlyName,
+	})
 	if err != nil {
-		return nil, err
+		return pkcs12Attribute{}, err
 	}
 
-	var pfx pfxPdu
-	pfx.Version = 3
-
-	var certAttributes []pkcs12Attribute
+	return pkcs12Attribute{
+		Id: oidFriendlyName,
+		Value: asn1.RawValue{
+			Class:      0,
+			Tag:        17,
+			IsCompound: true,
+			Bytes:      encodedFriendlyName,
+		},
+	}, nil
+}
 
-	extKeyUsageOidBytes, err := asn1.Marshal(oidAnyExtendedKeyUsage)
-	if err != nil {
-		return nil, err
+// makeTrustedKeyUsageAttribute returns the Java trusted key usage attribute
+// listing the given extended key usages, or anyExtendedKeyUsage if there are
+// none.
+func makeTrustedKeyUsageAttribute(usages []asn1.ObjectIdentifier) (pkcs12Attribute, error) {
+	if len(usages) == 0 {
+		usages = []asn1.ObjectIdentifier{oidAnyExtendedKeyUsage}
+	}
+	encodedUsages := make([][]byte, len(usages))
+	for i, usage := range usages {
+		var err error
+		if encodedUsages[i], err = asn1.Marshal(usage); err != nil {
+			return pkcs12Attribute{}, err
+		}
 	}
+	// the values of a SET OF are sorted in DER
+	sort.Slice(encodedUsages, func(i, j int) bool {
+		return bytes.Compare(encodedUsages[i], encodedUsages[j]) < 0
+	})
 
 	// the oidJavaTrustStore attribute contains the EKUs for which
 	// this trust anchor will be valid
-	certAttributes = append(certAttributes, pkcs12Attribute{
+	return pkcs12Attribute{
 		Id: oidJavaTrustStore,
 		Value: asn1.RawValue{
 			Class:      0,
 			Tag:        17,
 			IsCompound: true,
-			Bytes:      extKeyUsageOidBytes,
+			Bytes:      bytes.Join(encodedUsages, nil),
 		},
-	})
+	}, nil
+}
 
-	var certBags []safeBag
-	for _, entry := range entries {
+// makeMacData computes the MAC of authenticatedSafeBytes into macData.
+func (enc *Encoder) makeMacData(macData *macData, authenticatedSafeBytes, password []byte) (err error) {
+	newMac, err := enc.startMacData(macData, password)
+	if err != nil {
+		return err
+	}
+	mac, err := newMac()
+	if err != nil {
+		return err
+	}
+	mac.Write(authenticatedSafeBytes)
+	macData.Mac.Digest = mac.Sum(nil)
+	return nil
+}
 
-		bmpFriendlyName, err := bmpString(entry.FriendlyName)
-		if err != nil {
+// startMacData fills in the parameters of macData and starts deriving the
+// MAC key, concurrently if it is expensive.  The returned newMac waits for
+// the key and returns the keyed MAC, to which the AuthenticatedSafe must be
+// written; its sum is the digest of macData.
+func (enc *Encoder) startMacData(macData *macData, password []byte) (newMac func() (hash.Hash, error), err error) {
+	macData.Mac.Algorithm.Algorithm = enc.macAlgorithm
+	salt := enc.fixedMacSalt
+	if salt == nil {
+		if salt, err = GenerateSalt(enc.saltSource(enc.rand), enc.saltLen); err != nil {
 			return nil, err
 		}
-
-		encodedFriendlyName, err := asn1.Marshal(asn1.RawValue{
-			Class:      0,
-			Tag:        30,
-			IsCompound: false,
-			Bytes:      bmpFriendlyName,
-		})
-		if err != nil {
+	}
+	if enc.macAlgorithm.Equal(oidPBMAC1) {
+		// rfc9579#section-6: the salt and iteration count are carried in
+		// the PBKDF2 parameters, and those in the MacData are ignored.
+		if macData.Mac.Algorithm.Parameters.FullBytes, err = makePBMAC1Parameters(oidHmacWithSHA256, oidHmacWithSHA256, salt, enc.macIterations, 32); err != nil {
 			return nil, err
 		}
+		macData.MacSalt = []byte("NOT USED")
+		macData.Iterations = 1
+	} else {
+		if enc.macNullParams() {
+			macData.Mac.Algorithm.Parameters = asn1.NullRawValue
+		}
+		macData.MacSalt = salt
+		macData.Iterations = enc.macIterations
+	}
+
+	if !useParallelKDF(enc.parallelKDFThreshold, enc.macIterations) {
+		return func() (hash.Hash, error) {
+			return newMacHash(macData, password)
+		}, nil
+	}
 
-		friendlyName := pkcs12Attribute{
-			Id: oidFriendlyName,
-			Value: asn1.RawValue{
-				Class:      0,
-				Tag:        17,
-				IsCompound: true,
-				Bytes:      encodedFriendlyName,
-			},
+	type macKey struct {
+		hFn func() hash.Hash
+		key []byte
+		err error
+	}
+	done := make(chan macKey, 1)
+	go func() {
+		hFn, key, err := deriveMacKey(macData, password)
+		done <- macKey{hFn, key, err}
+	}()
+	return func() (hash.Hash, error) {
+		k := <-done
+		if k.err != nil {
+			return nil, k.err
 		}
+		return hmac.New(k.hFn, k.key), nil
+	}, nil
+}
 
-		certBag, err := makeCertBag(entry.Cert.Raw, append(certAttributes, friendlyName))
-		if err != nil {
-			return nil, err
+// setAuthSafe sets the AuthSafe of pfx to the ContentInfo of type data
+// holding authenticatedSafe, and computes its MAC with the MAC returned by
+// newMac, unless it is nil.  The length of the AuthenticatedSafe is computed
+// first, so that every ContentInfo is serialized only once, straight into
+// the MAC and the AuthSafe, which is allocated at its final size: no other
+// copy of the whole AuthenticatedSafe is held.
+func setAuthSafe(pfx *pfxPdu, authenticatedSafe []contentInfo, newMac func() (hash.Hash, error)) error {
+	var mac hash.Hash
+	if newMac != nil {
+		var err error
+		if mac, err = newMac(); err != nil {
+			return err
 		}
-		certBags = append(certBags, *certBag)
 	}
 
-	// Construct an authenticated safe with one SafeContent.
-	// The SafeContents is contains the cert bags.
-	var authenticatedSafe [1]contentInfo
-	if authenticatedSafe[0], err = enc.makeSafeContents(enc.rand, certBags, enc.certAlgorithm, encodedPassword); err != nil {
-		return nil, err
+	lengths := make([]int, len(authenticatedSafe))
+	length := 0
+	for i, ci := range authenticatedSafe {
+		var err error
+		if lengths[i], err = contentInfoLength(ci); err != nil {
+			return err
+		}
+		length += lengths[i]
 	}
 
-	var authenticatedSafeBytes []byte
-	if authenticatedSafeBytes, err = asn1.Marshal(authenticatedSafe[:]); err != nil {
-		return nil, err
+	sequenceHeader := appendDERHeader(nil, asn1.TagSequence, true, length)
+	contentLength := len(sequenceHeader) + length
+	content := make([]byte, 0, derHeaderLength(contentLength)+contentLength)
+	content = appendDERHeader(content, asn1.TagOctetString, false, contentLength)
+	content = append(content, sequenceHeader...)
+	if mac != nil {
+		mac.Write(sequenceHeader)
 	}
-
-	if enc.macAlgorithm != nil {
-		// compute the MAC
-		pfx.MacData.Mac.Algorithm.Algorithm = enc.macAlgorithm
-		pfx.MacData.MacSalt = make([]byte, enc.saltLen)
-		if _, err = enc.rand.Read(pfx.MacData.MacSalt); err != nil {
-			return nil, err
+	for i, ci := range authenticatedSafe {
+		encoded, err := asn1.Marshal(ci)
+		if err != nil {
+			return err
 		}
-		pfx.MacData.Iterations = enc.macIterations
-		if err = computeMac(&pfx.MacData, authenticatedSafeBytes, encodedPassword); err != nil {
-			return nil, err
+		if len(encoded) != lengths[i] {
+			return errors.New("pkcs12: internal error: unexpected length of ContentInfo")
 		}
+		content = append(content, encoded...)
+		if mac != nil {
+			mac.Write(encoded)
+		}
+	}
+	if mac != nil {
+		pfx.MacData.Mac.Digest = mac.Sum(nil)
 	}
 
 	pfx.AuthSafe.ContentType = oidDataContentType
 	pfx.AuthSafe.Content.Class = 2
 	pfx.AuthSafe.Content.Tag = 0
 	pfx.AuthSafe.Content.IsCompound = true
-	if pfx.AuthSafe.Content.Bytes, err = asn1.Marshal(authenticatedSafeBytes); err != nil {
-		return nil, err
-	}
+	pfx.AuthSafe.Content.Bytes = content
+	return nil
+}
 
-	if pfxData, err = asn1.Marshal(pfx); err != nil {
-		return nil, errors.New("pkcs12: error writing P12 data: " + err.Error())
+// contentInfoLength returns the length of the DER encoding of ci without
+// serializing its content.
+func contentInfoLength(ci contentInfo) (int, error) {
+	contentType, err := asn1.Marshal(ci.ContentType)
+	if err != nil {
+		return 0, err
 	}
-	return
+	content := len(ci.Content.FullBytes)
+	if content == 0 {
+		content = derHeaderLength(len(ci.Content.Bytes)) + len(ci.Content.Bytes)
+	}
+	inner := len(contentType) + content
+	return derHeaderLength(inner) + inner, nil
 }
 
 func makeCertBag(certBytes []byte, attributes []pkcs12Attribute) (certBag *safeBag, err error) {
@@ -951,6 +1776,9 @@ func (encoder *Encoder) makeSafeContents(rand io.Reader, bags []safeBag, algoID
 
 	if algoID == nil {
 		ci.ContentType = oidDataContentType
+		if encoder.contentType != nil {
+			ci.ContentType = encoder.contentType
+		}
 		ci.Content.Class = 2
 		ci.Content.Tag = 0
 		ci.Content.IsCompound = true
@@ -958,15 +1786,15 @@ func (encoder *Encoder) makeSafeContents(rand io.Reader, bags []safeBag, algoID
 			return
 		}
 	} else {
-		randomSalt := make([]byte, encoder.saltLen)
-		if _, err = rand.Read(randomSalt); err != nil {
+		var randomSalt []byte
+		if randomSalt, err = encoder.newSalt(rand); err != nil {
 			return
 		}
 
 		var algo pkix.AlgorithmIdentifier
 		algo.Algorithm = algoID
 		if algoID.Equal(oidPBES2) {
-			if algo.Parameters.FullBytes, err = makePBES2Parameters(encoder.kdfPrf, encoder.encryptionScheme, rand, randomSalt, encoder.encryptionIterations); err != nil {
+			if algo.Parameters.FullBytes, err = makePBES2Parameters(encoder.kdfPrf, encoder.certEncryptionScheme, encoder.ivSource(rand), randomSalt, encoder.encryptionIterations, encoder.explicitNullParams); err != nil {
 				return
 			}
 		} else {
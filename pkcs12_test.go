@@ -5,16 +5,43 @@
 package pkcs12
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
 	"os"
 	"path"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/emmansun/gmsm/pkcs"
+	"github.com/emmansun/gmsm/pkcs7"
+	"github.com/emmansun/gmsm/pkcs8"
 	"github.com/emmansun/gmsm/sm2"
 	"github.com/emmansun/gmsm/smx509"
 )
@@ -240,6 +267,126 @@ func TestTrustStore(t *testing.T) {
 	}
 }
 
+func TestEmptyTrustStore(t *testing.T) {
+	// OpenSSL 3.0.17 also accepts the empty stores written by these
+	// encoders, as checked by hand with
+	//
+	//	openssl pkcs12 [-legacy] -in empty.p12 -info -noout -passin pass:password
+	//
+	// which verifies the MAC, if any, and decrypts the empty SafeContents.
+	// This test doesn't run OpenSSL.
+	encoders := map[string]*Encoder{
+		"LegacyRC2":    LegacyRC2,
+		"Modern2023":   Modern2023,
+		"Passwordless": Passwordless,
+	}
+	for name, enc := range encoders {
+		password := "password"
+		if enc == Passwordless {
+			password = ""
+		}
+		for _, certs := range [][]*smx509.Certificate{nil, {}} {
+			pfxData, err := enc.EncodeTrustStore(certs, password)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			decodedCerts, err := DecodeTrustStore(pfxData, password)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(decodedCerts) != 0 {
+				t.Errorf("%s: got %d certificates, want none", name, len(decodedCerts))
+			}
+		}
+	}
+}
+
+func TestTrustStoreEntries(t *testing.T) {
+	_, root := generateTestCertificate(t, "root", nil, nil)
+	_, tlsRoot := generateTestCertificate(t, "tls root", nil, nil)
+	serverAndClientAuth := []asn1.ObjectIdentifier{
+		{1, 3, 6, 1, 5, 5, 7, 3, 2},
+		{1, 3, 6, 1, 5, 5, 7, 3, 1},
+	}
+
+	pfxData, err := Modern2023.EncodeTrustStoreEntries([]TrustStoreEntry{
+		{Cert: root, FriendlyName: "root"},
+		{Cert: tlsRoot, FriendlyName: "tls", TrustedKeyUsage: serverAndClientAuth},
+	}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&DecodeOptions{StrictDER: true}).DecodeTrustStore(pfxData, "password"); err != nil {
+		t.Fatalf("trusted key usage is not canonical DER: %v", err)
+	}
+
+	entries, err := DecodeTrustStoreEntries(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+
+	if !entries[0].Cert.Equal(root) || entries[0].FriendlyName != "root" {
+		t.Errorf("entry 0: got %q", entries[0].FriendlyName)
+	}
+	if len(entries[0].TrustedKeyUsage) != 1 || !entries[0].TrustedKeyUsage[0].Equal(oidAnyExtendedKeyUsage) {
+		t.Errorf("entry 0: got trusted key usage %v, want anyExtendedKeyUsage", entries[0].TrustedKeyUsage)
+	}
+
+	if !entries[1].Cert.Equal(tlsRoot) || entries[1].FriendlyName != "tls" {
+		t.Errorf("entry 1: got %q", entries[1].FriendlyName)
+	}
+	if len(entries[1].TrustedKeyUsage) != 2 {
+		t.Fatalf("entry 1: got trusted key usage %v, want %v", entries[1].TrustedKeyUsage, serverAndClientAuth)
+	}
+	// the usages are sorted by their encoding
+	if !entries[1].TrustedKeyUsage[0].Equal(serverAndClientAuth[1]) || !entries[1].TrustedKeyUsage[1].Equal(serverAndClientAuth[0]) {
+		t.Errorf("entry 1: got trusted key usage %v, want %v", entries[1].TrustedKeyUsage, serverAndClientAuth)
+	}
+}
+
+func TestTrustStoreUnparseableFriendlyName(t *testing.T) {
+	_, root := generateTestCertificate(t, "root", nil, nil)
+	anyEKU, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bag := testCertBag(t, root, nil, "")
+	bag.Attributes = append(bag.Attributes,
+		pkcs12Attribute{Id: oidJavaTrustStore, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: anyEKU}},
+		// a UTF8String that isn't valid UTF-8
+		pkcs12Attribute{Id: oidFriendlyName, Value: asn1.RawValue{FullBytes: []byte{0x31, 0x03, 0x0c, 0x01, 0xff}}},
+	)
+	pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{bag})
+
+	entries, err := DecodeTrustStoreEntries(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].Cert.Equal(root) || entries[0].FriendlyName != "" {
+		t.Fatalf("got %d entries, want the root certificate without a friendly name", len(entries))
+	}
+
+	certs, warnings, err := DecodeTrustStoreWithWarnings(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, w := range warnings {
+		found = found || w.Kind == WarningUnparseableFriendlyName
+	}
+	if len(certs) != 1 || !found {
+		t.Errorf("got %d certificates and warnings %v, want a WarningUnparseableFriendlyName", len(certs), warnings)
+	}
+
+	if _, err := DecodeTrustStoreStrict(pfxData, "password"); err == nil {
+		t.Error("DecodeTrustStoreStrict: expected an error")
+	}
+}
+
 func TestPBES2_AES256CBC(t *testing.T) {
 	// This P12 PDU is a self-signed certificate exported via Windows certmgr.
 	// It is encrypted with the following options (verified via openssl): PBES2, PBKDF2, AES-256-CBC, Iteration 2000, PRF hmacWithSHA256
@@ -368,3 +515,4581 @@ p8SsTugkit8wOwYJKoZIhvcNAQkUMS4eLABGAHIAaQBlAG4AZABsAHkAIABuAGEAbQBlACAAZgBv
 AHIAIABjAGUAcgB0MDEwITAJBgUrDgMCGgUABBRFsNz3Zd1O1GI8GTuFwCWuDOjEEwQIuBEfIcAy
 HQ8CAggA`,
 }
+
+func TestOuterEncryption(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	priv, cert, err := Decode(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Passwordless.EncodeWithOuterEncryption(priv, cert, nil, ""); err == nil {
+		t.Error("expected error for passwordless encoder")
+	}
+
+	for _, enc := range []*Encoder{LegacyDES, Modern2023, ShangMi2024} {
+		pfxData, err := enc.EncodeWithOuterEncryption(priv, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := Decode(pfxData, "password"); err == nil {
+			t.Error("expected plain Decode to fail on outer-encrypted data")
+		}
+
+		opts := &DecodeOptions{OuterEncryption: true}
+		if _, _, err := opts.Decode(pfxData, "wrong"); err != ErrIncorrectPassword {
+			t.Errorf("expected ErrIncorrectPassword, got %v", err)
+		}
+		privNew, certNew, err := opts.Decode(pfxData, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !privNew.(*rsa.PrivateKey).Equal(priv) {
+			t.Error("decoded private key differs")
+		}
+		if !certNew.Equal(cert) {
+			t.Error("decoded certificate differs")
+		}
+	}
+}
+
+func TestNonBMPEncodedPassword(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	priv, cert, err := Decode(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// These files are synthetic: they are made by this package, with the
+	// password encoded the way the non-conforming implementations do,
+	// rather than by the implementations themselves.
+	password := "pässwörd"
+	var latin1 []rune
+	for _, b := range []byte(password) {
+		latin1 = append(latin1, rune(b))
+	}
+	bytewise, err := bmpStringZeroTerminatedBytes([]byte(string(latin1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// remac replaces the MAC of pfxData with one computed with
+	// encodedPassword, leaving the contents encrypted with the BMPString
+	// password.
+	remac := func(enc *Encoder, pfxData, encodedPassword []byte) []byte {
+		pfx, err := parsePFX(pfxData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var authenticatedSafe []byte
+		if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.makeMacData(&pfx.MacData, authenticatedSafe, encodedPassword); err != nil {
+			t.Fatal(err)
+		}
+		if pfxData, err = asn1.Marshal(*pfx); err != nil {
+			t.Fatal(err)
+		}
+		return pfxData
+	}
+	for _, test := range []struct {
+		name            string
+		encodedPassword []byte
+	}{
+		// older Go implementations used the UTF-8 password as is
+		{"UTF-8", []byte(password)},
+		// OpenSSL before 1.1.0 treated the UTF-8 password as Latin-1,
+		// encoding every UTF-8 byte as its own BMP character
+		{"byte-wise", bytewise},
+	} {
+		// The PKCS#12 PBE keys are derived from the same encoding as the
+		// MAC key.
+		legacy, err := LegacyDES.encode(priv, cert, nil, test.encodedPassword, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// PBES2 takes the password as UTF-8, whatever the MAC key is
+		// derived from.
+		modern, err := Modern2023.Encode(priv, cert, nil, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modern = remac(Modern2023, modern, test.encodedPassword)
+
+		for _, pfxData := range [][]byte{legacy, modern} {
+			if _, _, err := Decode(pfxData, password); err != nil {
+				t.Errorf("%s: expected fallback to the %s password encoding, got %v", test.name, test.name, err)
+			}
+			if _, _, err := Decode(pfxData, "passwörd"); err != ErrIncorrectPassword {
+				t.Errorf("%s: expected ErrIncorrectPassword, got %v", test.name, err)
+			}
+		}
+	}
+
+	// PBMAC1 takes the password as UTF-8, so there is no fallback, even
+	// for a password whose UTF-8 encoding isn't a valid BMPString.
+	pfxData, err := Modern2023.WithMACAlgorithm(OIDMACPBMAC1).Encode(priv, cert, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Decode(pfxData, "pä"); err != ErrIncorrectPassword {
+		t.Errorf("PBMAC1: expected ErrIncorrectPassword, got %v", err)
+	}
+}
+
+func TestExportedOIDs(t *testing.T) {
+	for _, test := range []struct {
+		exported, internal asn1.ObjectIdentifier
+	}{
+		{OIDMACSHA1, oidSHA1},
+		{OIDMACSHA256, oidSHA256},
+		{OIDMACSM3, oidSM3},
+		{OIDMACPBMAC1, oidPBMAC1},
+		{OIDPBEWithSHAAnd3KeyTripleDESCBC, oidPBEWithSHAAnd3KeyTripleDESCBC},
+		{OIDPBEWithSHAAnd128BitRC2CBC, oidPBEWithSHAAnd128BitRC2CBC},
+		{OIDPBEWithSHAAnd40BitRC2CBC, oidPBEWithSHAAnd40BitRC2CBC},
+		{OIDPBES2, oidPBES2},
+		{OIDCipherAES128CBC, oidAES128CBC},
+		{OIDCipherAES192CBC, oidAES192CBC},
+		{OIDCipherAES256CBC, oidAES256CBC},
+		{OIDCipherSM4CBC, oidSM4CBC},
+		{OIDPRFHmacSHA1, oidHmacWithSHA1},
+		{OIDPRFHmacSHA256, oidHmacWithSHA256},
+		{OIDPRFHmacSM3, oidHmacWithSM3},
+	} {
+		if !test.exported.Equal(test.internal) {
+			t.Errorf("got %v, want %v", test.exported, test.internal)
+		}
+		// modifying an exported OID mustn't change the internal one
+		if &test.exported[0] == &test.internal[0] {
+			t.Errorf("%v shares its storage with the internal OID", test.exported)
+		}
+	}
+}
+
+func TestEncoderAlgorithmOptions(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	priv, cert, err := Decode(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoders := []*Encoder{
+		Modern2023.WithMACAlgorithm(OIDMACPBMAC1),
+		Modern2023.WithMACAlgorithm(OIDMACSM3).WithKeyBagCipher(OIDCipherSM4CBC).WithCertBagCipher(OIDCipherAES128CBC),
+		LegacyDES.WithKeyBagCipher(OIDCipherAES192CBC).WithPRF(OIDPRFHmacSM3),
+		Modern2023.WithCertBagCipher(OIDPBEWithSHAAnd128BitRC2CBC).WithPRF(OIDPRFHmacSHA1),
+		Modern2023.WithCertBagCipher(nil),
+		Passwordless.WithMACAlgorithm(OIDMACSHA256).WithKeyBagCipher(OIDCipherAES256CBC),
+	}
+	for i, enc := range encoders {
+		pfxData, err := enc.Encode(priv, cert, nil, "password")
+		if err != nil {
+			t.Fatalf("encoder %d: %v", i, err)
+		}
+		privNew, certNew, err := Decode(pfxData, "password")
+		if err != nil {
+			t.Fatalf("encoder %d: %v", i, err)
+		}
+		if !privNew.(*rsa.PrivateKey).Equal(priv) || !certNew.Equal(cert) {
+			t.Errorf("encoder %d: round trip mismatch", i)
+		}
+	}
+
+	for _, f := range []func(){
+		func() { Modern2023.WithMACAlgorithm(OIDCipherAES128CBC) },
+		func() { Modern2023.WithKeyBagCipher(OIDMACSHA256) },
+		func() { Modern2023.WithPRF(OIDMACSHA256) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic for unsupported algorithm")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestDecodeChainLeafSelection(t *testing.T) {
+	caKey, ca := generateTestCertificate(t, "ca", nil, nil)
+	leafKey, leaf := generateTestCertificate(t, "leaf", ca, caKey)
+
+	// These files are synthetic: they are assembled by this package to
+	// mimic the bag orderings of other producers, and none of them was
+	// exported by NSS pk12util itself.
+	keyID := []byte{1, 2, 3, 4}
+	otherID := []byte{5, 6, 7, 8}
+	password := "password"
+
+	tests := []struct {
+		name string
+		bags []safeBag
+	}{
+		{
+			// like NSS pk12util: CA first, friendlyName on the key bag
+			"ca first, matching localKeyId",
+			[]safeBag{
+				testCertBag(t, ca, nil, "ca"),
+				testCertBag(t, leaf, keyID, "leaf"),
+				testKeyBag(t, Modern2023, leafKey, password, keyID, "leaf"),
+			},
+		},
+		{
+			"ambiguous localKeyId",
+			[]safeBag{
+				testCertBag(t, ca, keyID, ""),
+				testCertBag(t, leaf, keyID, ""),
+				testKeyBag(t, Modern2023, leafKey, password, keyID, ""),
+			},
+		},
+		{
+			"no localKeyId",
+			[]safeBag{
+				testCertBag(t, ca, nil, ""),
+				testCertBag(t, leaf, nil, ""),
+				testKeyBag(t, Modern2023, leafKey, password, nil, ""),
+			},
+		},
+		{
+			"localKeyId on the wrong certificate",
+			[]safeBag{
+				testCertBag(t, ca, keyID, ""),
+				testCertBag(t, leaf, otherID, ""),
+				testKeyBag(t, Modern2023, leafKey, password, keyID, ""),
+			},
+		},
+	}
+	for _, test := range tests {
+		pfxData := encodeTestBags(t, Modern2023, password, test.bags)
+		_, cert, caCerts, err := DecodeChain(pfxData, password)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !cert.Equal(leaf) {
+			t.Errorf("%s: got leaf %q, want %q", test.name, cert.Subject.CommonName, leaf.Subject.CommonName)
+		}
+		if len(caCerts) != 1 || !caCerts[0].Equal(ca) {
+			t.Errorf("%s: unexpected CA certificates", test.name)
+		}
+	}
+}
+
+func TestDecodeChainWithoutLocalKeyID(t *testing.T) {
+	// the layout of a PKI bundle export: no attributes, and the
+	// intermediate and root certificates before the leaf
+	pfxData, err := readFile("testdata/no-local-key-id.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, cert, caCerts, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "app.example.com" {
+		t.Errorf("got leaf %q, want app.example.com", cert.Subject.CommonName)
+	}
+	if err := publicKeyMatches(privateKey, cert); err != nil {
+		t.Error(err)
+	}
+	if len(caCerts) != 2 || caCerts[0].Subject.CommonName != "Vault Intermediate CA" || caCerts[1].Subject.CommonName != "Vault Root CA" {
+		t.Errorf("got %d CA certificates, want the intermediate and the root in file order", len(caCerts))
+	}
+
+	entries, err := DecodeEntries(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[0].PrivateKey == nil || !entries[0].Certificate.Equal(cert) {
+		t.Error("DecodeEntries didn't pair the key with the leaf")
+	}
+}
+
+// generateTestCertificate creates an ECDSA key and a certificate for it
+// issued by parent, or a self-signed one if parent is nil.
+func generateTestCertificate(t *testing.T, commonName string, parent *smx509.Certificate, parentKey crypto.Signer) (*ecdsa.PrivateKey, *smx509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &smx509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := smx509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := smx509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// testAttributes returns the localKeyId and friendlyName attributes for a
+// test bag, omitting empty ones.
+func testAttributes(t *testing.T, localKeyID []byte, friendlyName string) []pkcs12Attribute {
+	t.Helper()
+	var attrs []pkcs12Attribute
+	if localKeyID != nil {
+		value, err := asn1.Marshal(localKeyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs = append(attrs, pkcs12Attribute{
+			Id:    oidLocalKeyID,
+			Value: asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: value},
+		})
+	}
+	if friendlyName != "" {
+		bmpName, err := bmpString(friendlyName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := asn1.Marshal(asn1.RawValue{Class: 0, Tag: 30, Bytes: bmpName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs = append(attrs, pkcs12Attribute{
+			Id:    oidFriendlyName,
+			Value: asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: value},
+		})
+	}
+	return attrs
+}
+
+func testCertBag(t *testing.T, cert *smx509.Certificate, localKeyID []byte, friendlyName string) safeBag {
+	t.Helper()
+	bag, err := makeCertBag(cert.Raw, testAttributes(t, localKeyID, friendlyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *bag
+}
+
+func testKeyBag(t *testing.T, enc *Encoder, key interface{}, password string, localKeyID []byte, friendlyName string) safeBag {
+	t.Helper()
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bag := safeBag{Id: oidPKCS8ShroundedKeyBag}
+	bag.Value.Class = 2
+	bag.Value.Tag = 0
+	bag.Value.IsCompound = true
+	if bag.Value.Bytes, err = enc.encodePkcs8ShroudedKeyBag(rand.Reader, key, encodedPassword); err != nil {
+		t.Fatal(err)
+	}
+	bag.Attributes = testAttributes(t, localKeyID, friendlyName)
+	return bag
+}
+
+// encodeTestBags assembles a PFX with a single SafeContents containing bags,
+// encrypted and MACed as configured by enc, for building files with layouts
+// that the encoder doesn't produce itself.
+func encodeTestBags(t *testing.T, enc *Encoder, password string, bags []safeBag) []byte {
+	t.Helper()
+	return encodeTestSafeContents(t, enc, password, [][]safeBag{bags})
+}
+
+// encodeTestSafeContents is like encodeTestBags, but creates one SafeContents
+// per element of contents.
+func encodeTestSafeContents(t *testing.T, enc *Encoder, password string, contents [][]safeBag) []byte {
+	t.Helper()
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafe []contentInfo
+	for _, bags := range contents {
+		ci, err := enc.makeSafeContents(rand.Reader, bags, enc.certAlgorithm, encodedPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticatedSafe = append(authenticatedSafe, ci)
+	}
+	return encodeTestAuthenticatedSafe(t, enc, password, authenticatedSafe)
+}
+
+// encodeTestAuthenticatedSafe assembles a PFX from the given content infos,
+// MACed as configured by enc.
+func encodeTestAuthenticatedSafe(t *testing.T, enc *Encoder, password string, authenticatedSafe []contentInfo) []byte {
+	t.Helper()
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticatedSafeBytes, err := asn1.Marshal(authenticatedSafe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pfx pfxPdu
+	pfx.Version = 3
+	if enc.macAlgorithm != nil {
+		if err := enc.makeMacData(&pfx.MacData, authenticatedSafeBytes, encodedPassword); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pfx.AuthSafe.ContentType = oidDataContentType
+	pfx.AuthSafe.Content.Class = 2
+	pfx.AuthSafe.Content.Tag = 0
+	pfx.AuthSafe.Content.IsCompound = true
+	if pfx.AuthSafe.Content.Bytes, err = asn1.Marshal(authenticatedSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	pfxData, err := asn1.Marshal(pfx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pfxData
+}
+
+type unsupportedSigner struct {
+	crypto.Signer
+}
+
+func TestEncodeUnsupportedKeyType(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	priv, cert, err := Decode(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Modern2023.Encode(unsupportedSigner{priv.(crypto.Signer)}, cert, nil, "password")
+	if _, ok := err.(NotImplementedError); !ok {
+		t.Fatalf("expected NotImplementedError, got %T %v", err, err)
+	}
+	if !strings.Contains(err.Error(), "unsupported private key type: pkcs12.unsupportedSigner") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	// Ed25519 is supported.
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData, err := Modern2023.Encode(edKey, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privNew, _, err := Decode(pfxData, "password"); err != nil {
+		t.Fatal(err)
+	} else if !edKey.Equal(privNew) {
+		t.Error("decoded Ed25519 key differs")
+	}
+}
+
+// dataContentInfo returns a ContentInfo of type data holding content.
+func dataContentInfo(t *testing.T, content []byte) contentInfo {
+	t.Helper()
+	var ci contentInfo
+	ci.ContentType = oidDataContentType
+	ci.Content.Class = 2
+	ci.Content.Tag = 0
+	ci.Content.IsCompound = true
+	var err error
+	if ci.Content.Bytes, err = asn1.Marshal(content); err != nil {
+		t.Fatal(err)
+	}
+	return ci
+}
+
+func TestLenientCertificateInDataContent(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	password := "password"
+
+	// The file is synthetic: it is assembled by this package to mimic the
+	// minimal exporters that store the DER certificate directly in a data
+	// content, and wasn't produced by one of them.
+	bags, err := asn1.Marshal([]safeBag{testKeyBag(t, Modern2023, key, password, nil, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData := encodeTestAuthenticatedSafe(t, Modern2023, password, []contentInfo{
+		dataContentInfo(t, cert.Raw),
+		dataContentInfo(t, bags),
+	})
+
+	if _, _, err := Decode(pfxData, password); err == nil {
+		t.Error("expected strict decode to fail")
+	}
+	_, certNew, err := (&DecodeOptions{Lenient: true}).Decode(pfxData, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certNew.Equal(cert) {
+		t.Error("decoded certificate differs")
+	}
+}
+
+func TestWithCompatibility(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	priv, cert, err := Decode(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target       CompatTarget
+		macAlgorithm asn1.ObjectIdentifier
+		iterations   int
+	}{
+		{CompatJava8, oidSHA1, 1024},
+		{CompatWindows, oidSHA1, 2000},
+		{CompatOpenSSL1, oidSHA1, 1},
+		{CompatGM, oidSM3, 2048},
+	}
+	for _, test := range tests {
+		enc := Modern2023.WithCompatibility(test.target)
+		pfxData, err := enc.Encode(priv, cert, nil, "password")
+		if err != nil {
+			t.Fatalf("target %d: %v", test.target, err)
+		}
+		var pfx pfxPdu
+		if err := unmarshal(pfxData, &pfx); err != nil {
+			t.Fatal(err)
+		}
+		if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(test.macAlgorithm) || pfx.MacData.Iterations != test.iterations {
+			t.Errorf("target %d: unexpected MAC %v with %d iterations", test.target, pfx.MacData.Mac.Algorithm.Algorithm, pfx.MacData.Iterations)
+		}
+		if _, _, err := Decode(pfxData, "password"); err != nil {
+			t.Errorf("target %d: %v", test.target, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for unknown target")
+		}
+	}()
+	Modern2023.WithCompatibility(0)
+}
+
+func TestTrustStoreWithCorruptCertificate(t *testing.T) {
+	_, cert1 := generateTestCertificate(t, "ca1", nil, nil)
+	_, cert2 := generateTestCertificate(t, "ca2", nil, nil)
+	corrupt := &smx509.Certificate{Raw: []byte{0x30, 0x03, 0x02, 0x01, 0x00}}
+
+	// The trust store is synthetic: this package encodes the corrupt
+	// certificate bag, as no other tool would write one.  Use enough MAC
+	// iterations not to be warned about.
+	pfxData, err := Modern2023.WithIterations(MinMACIterations).EncodeTrustStoreEntries([]TrustStoreEntry{
+		{Cert: cert1, FriendlyName: "ca1"},
+		{Cert: corrupt, FriendlyName: "corrupt"},
+		{Cert: cert2, FriendlyName: "ca2"},
+	}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := DecodeTrustStore(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(cert1) || !certs[1].Equal(cert2) {
+		t.Errorf("unexpected certificates: %v", certs)
+	}
+
+	certs, warnings, err := DecodeTrustStoreWithWarnings(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 {
+		t.Errorf("expected 2 certificates, got %d", len(certs))
+	}
+	if len(warnings) != 1 || warnings[0].Kind != WarningUnparseableCertificate || !strings.Contains(warnings[0].Message, "#1") {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	if _, err := DecodeTrustStoreStrict(pfxData, "password"); err == nil {
+		t.Error("expected strict decode to fail")
+	}
+}
+
+func TestEncodeSigned(t *testing.T) {
+	signerKey, signerCert := generateTestCertificate(t, "signer", nil, nil)
+	_, otherCert := generateTestCertificate(t, "other", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+
+	pfxData, err := Modern2023.EncodeSigned(signerKey, signerCert, key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A signed file is only accepted without a signer certificate if the
+	// caller opts out of verification.
+	if _, _, err := Decode(pfxData, "password"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("decode without a signer certificate: got %v, want ErrInvalidSignature", err)
+	}
+	if _, _, err := (&DecodeOptions{IgnoreSignature: true}).Decode(pfxData, "password"); err != nil {
+		t.Fatalf("decode without verification: %v", err)
+	}
+
+	opts := &DecodeOptions{SignerCertificate: signerCert}
+	decodedKey, decodedCert, err := opts.Decode(pfxData, "password")
+	if err != nil {
+		t.Fatalf("decode with verification: %v", err)
+	}
+	if !decodedCert.Equal(cert) {
+		t.Error("decoded certificate doesn't match")
+	}
+	if !key.Equal(decodedKey) {
+		t.Error("decoded key doesn't match")
+	}
+
+	opts = &DecodeOptions{SignerCertificate: otherCert}
+	if _, _, err := opts.Decode(pfxData, "password"); err != ErrInvalidSignature {
+		t.Fatalf("wrong signer: got %v, want ErrInvalidSignature", err)
+	}
+
+	// The signature is the last element of the file.
+	tampered := append([]byte(nil), pfxData...)
+	tampered[len(tampered)-1] ^= 1
+	opts = &DecodeOptions{SignerCertificate: signerCert}
+	if _, _, err := opts.Decode(tampered, "password"); err == nil {
+		t.Fatal("tampered file: expected an error")
+	}
+	if _, _, err := Decode(tampered, "password"); err == nil {
+		t.Fatal("tampered file: expected an error without a signer certificate")
+	}
+
+	// A file forged by someone else, with contents and signature of their
+	// choosing, is rejected by default.
+	forgerKey, forgerCert := generateTestCertificate(t, "forger", nil, nil)
+	forged, err := Modern2023.EncodeSigned(forgerKey, forgerCert, key, cert, nil, "any password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Decode(forged, "any password"); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("forged file: got %v, want ErrInvalidSignature", err)
+	}
+	if _, _, err := opts.Decode(forged, "any password"); err != ErrInvalidSignature {
+		t.Errorf("forged file with a signer certificate: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestNullEmptyPassword(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+
+	for _, enc := range []*Encoder{LegacyRC2, LegacyDES, Modern2023, ShangMi2024} {
+		for _, null := range []bool{false, true} {
+			pfxData, err := enc.WithNullEmptyPassword(null).Encode(key, cert, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var pfx pfxPdu
+			if err := unmarshal(pfxData, &pfx); err != nil {
+				t.Fatal(err)
+			}
+			var authSafe []byte
+			if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+				t.Fatal(err)
+			}
+			emptyBMPString := []byte{0, 0}
+			if err := verifyMac(&pfx.MacData, authSafe, emptyBMPString); (err == nil) == null {
+				t.Errorf("null=%v: MAC verification with an empty BMPString: %v", null, err)
+			}
+			if err := verifyMac(&pfx.MacData, authSafe, nil); (err == nil) != null {
+				t.Errorf("null=%v: MAC verification with a zero-length password: %v", null, err)
+			}
+
+			decodedKey, decodedCert, err := Decode(pfxData, "")
+			if err != nil {
+				t.Fatalf("null=%v: %v", null, err)
+			}
+			if !decodedCert.Equal(cert) || !key.Equal(decodedKey) {
+				t.Errorf("null=%v: decoded key or certificate doesn't match", null)
+			}
+		}
+	}
+}
+
+func TestConstantTimeDecode(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	pfxData, err := Modern2023.Encode(key, cert, nil, "pässword")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &DecodeOptions{ConstantTimeDecode: true}
+	if _, _, err := opts.Decode(pfxData, "pässword"); err != nil {
+		t.Fatalf("correct password: %v", err)
+	}
+	if _, _, err := opts.Decode(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Fatalf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+
+	// A password that can't be encoded as a BMPString.
+	const unencodable = "\U0001F511"
+	if _, _, err := Decode(pfxData, unencodable); err == nil || err == ErrIncorrectPassword {
+		t.Fatalf("unencodable password: got %v, want an encoding error", err)
+	}
+	if _, _, err := opts.Decode(pfxData, unencodable); err != ErrIncorrectPassword {
+		t.Fatalf("unencodable password: got %v, want ErrIncorrectPassword", err)
+	}
+	if _, err := opts.DecodeTrustStore(pfxData, unencodable); err != ErrIncorrectPassword {
+		t.Fatalf("unencodable password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestWithoutAttributes(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+
+	pfxData, err := Modern2023.WithoutAttributes().Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedPassword, err := bmpStringZeroTerminated("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bags, _, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, nil, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bags) != 3 {
+		t.Fatalf("got %d bags, want 3", len(bags))
+	}
+	for i, bag := range bags {
+		if len(bag.Attributes) != 0 {
+			t.Errorf("bag %d has %d attributes, want none", i, len(bag.Attributes))
+		}
+	}
+
+	decodedKey, decodedCert, caCerts, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decodedCert.Equal(cert) || !key.Equal(decodedKey) {
+		t.Error("decoded key or certificate doesn't match")
+	}
+	if len(caCerts) != 1 || !caCerts[0].Equal(caCert) {
+		t.Error("decoded CA certificates don't match")
+	}
+}
+
+func TestParallelKDF(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	opts := &DecodeOptions{ParallelKDFThreshold: 1}
+
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	for _, enc := range []*Encoder{LegacyRC2, LegacyDES, Modern2023, ShangMi2024, Modern2023.WithMACAlgorithm(OIDMACPBMAC1)} {
+		enc = enc.WithParallelKDFThreshold(1)
+		pfxData, err := enc.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		decodedKey, decodedCert, err := opts.Decode(pfxData, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decodedCert.Equal(cert) || !key.Equal(decodedKey) {
+			t.Error("decoded key or certificate doesn't match")
+		}
+		if _, _, err := opts.Decode(pfxData, "wrong"); err != ErrIncorrectPassword {
+			t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+		}
+
+		// Nothing is decrypted before the MAC has been verified.
+		decrypted := false
+		hooked := *opts
+		hooked.BagPassword = func(bagType string, localKeyID []byte) ([]byte, error) {
+			decrypted = true
+			return []byte("wrong"), nil
+		}
+		if _, _, err := hooked.Decode(pfxData, "wrong"); err != ErrIncorrectPassword || decrypted {
+			t.Errorf("wrong password: got %v, decrypted %v, want ErrIncorrectPassword before decrypting", err, decrypted)
+		}
+
+		// The MAC matches another encoding of the password than the one
+		// whose keys are derived first.
+		pfxData, err = enc.WithNullEmptyPassword(true).Encode(key, cert, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := opts.Decode(pfxData, ""); err != nil {
+			t.Errorf("null empty password: %v", err)
+		}
+	}
+}
+
+func benchmarkKDF(b *testing.B, f func() error) {
+	for i := 0; i < b.N; i++ {
+		if err := f(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKDF(b *testing.B) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	template := &smx509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "leaf"}}
+	der, err := smx509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cert, err := smx509.ParseCertificate(der)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	enc := Modern2023.WithIterations(100000)
+	pfxData, err := enc.Encode(key, cert, nil, "password")
+	if err != nil {
+		b.Fatal(err)
+	}
+	encode := func(threshold int) func() error {
+		return func() error {
+			_, err := enc.WithParallelKDFThreshold(threshold).Encode(key, cert, nil, "password")
+			return err
+		}
+	}
+	decode := func(threshold int) func() error {
+		return func() error {
+			_, _, err := (&DecodeOptions{ParallelKDFThreshold: threshold}).Decode(pfxData, "password")
+			return err
+		}
+	}
+
+	b.Run("Encode/Sequential", func(b *testing.B) { benchmarkKDF(b, encode(-1)) })
+	b.Run("Encode/Parallel", func(b *testing.B) { benchmarkKDF(b, encode(1)) })
+	b.Run("Decode/Sequential", func(b *testing.B) { benchmarkKDF(b, decode(-1)) })
+	b.Run("Decode/Parallel", func(b *testing.B) { benchmarkKDF(b, decode(1)) })
+}
+
+func BenchmarkDecodeChain(b *testing.B) {
+	sm2Data, err := readFile("testdata/gmcert_pkcs12-test-withca.p12")
+	if err != nil {
+		b.Fatal(err)
+	}
+	rsaData, err := base64.StdEncoding.DecodeString(testdata["Windows Azure Tools"])
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		pfxData  []byte
+		password string
+	}{
+		{"RSA", rsaData, ""},
+		{"SM2", sm2Data, "123456"},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := DecodeChain(test.pfxData, test.password); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	pfxData, err := readFile("testdata/gmcert_pkcs12-test-withca.p12")
+	if err != nil {
+		b.Fatal(err)
+	}
+	key, cert, caCerts, err := DecodeChain(pfxData, "123456")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		enc  *Encoder
+	}{
+		{"LegacyRC2", LegacyRC2},
+		{"LegacyDES", LegacyDES},
+		{"Modern2023", Modern2023},
+		{"ShangMi2024", ShangMi2024},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := test.enc.Encode(key, cert, caCerts, "password"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeTrustStore(b *testing.B) {
+	pfxData, err := readFile("testdata/gmcert_pkcs12-test-withca.p12")
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, cert, caCerts, err := DecodeChain(pfxData, "123456")
+	if err != nil {
+		b.Fatal(err)
+	}
+	certs := append([]*smx509.Certificate{cert}, caCerts...)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Modern2023.EncodeTrustStore(certs, DefaultPassword); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRewrapPKCS8(t *testing.T) {
+	key, _ := generateTestCertificate(t, "leaf", nil, nil)
+	oldPassword, err := bmpStringZeroTerminated("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := LegacyDES.encodePkcs8ShroudedKeyBag(rand.Reader, key, oldPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := RewrapPKCS8(rand.Reader, der, "old", "new", Modern2023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkinfo encryptedPrivateKeyInfo
+	if err := unmarshal(rewrapped, &pkinfo); err != nil {
+		t.Fatal(err)
+	}
+	if !pkinfo.AlgorithmIdentifier.Algorithm.Equal(oidPBES2) {
+		t.Errorf("got algorithm %v, want PBES2", pkinfo.AlgorithmIdentifier.Algorithm)
+	}
+
+	newPassword, err := bmpStringZeroTerminated("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedKey, err := decodePkcs8ShroudedKeyBag(rewrapped, newPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(decodedKey) {
+		t.Error("rewrapped key doesn't match")
+	}
+
+	if _, err := RewrapPKCS8(rand.Reader, der, "wrong", "new", Modern2023); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+	if _, err := RewrapPKCS8(rand.Reader, der, "old", "", Passwordless); err == nil {
+		t.Error("passwordless encoder: expected an error")
+	}
+}
+
+func TestVerifyKeyPair(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	sm2Key, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte{1, 2, 3, 4}
+	opts := &DecodeOptions{VerifyKeyPair: true}
+
+	pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{
+		testCertBag(t, cert, keyID, ""),
+		testKeyBag(t, Modern2023, key, "password", keyID, ""),
+	})
+	if _, _, err := opts.Decode(pfxData, "password"); err != nil {
+		t.Fatalf("matching key: %v", err)
+	}
+
+	// An SM2 key paired with an ECDSA certificate.
+	pfxData = encodeTestBags(t, Modern2023, "password", []safeBag{
+		testCertBag(t, cert, keyID, ""),
+		testKeyBag(t, Modern2023, sm2Key, "password", keyID, ""),
+	})
+	if _, _, err := Decode(pfxData, "password"); err != nil {
+		t.Fatalf("mismatched key without VerifyKeyPair: %v", err)
+	}
+	if _, _, err := opts.Decode(pfxData, "password"); err != ErrKeyCertMismatch {
+		t.Fatalf("mismatched key: got %v, want ErrKeyCertMismatch", err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestManyEncryptedBlocks(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	_, other := generateTestCertificate(t, "other", nil, nil)
+	enc := LegacyDES.WithIterations(1)
+	password := "password"
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// encode returns a PFX holding the key and the certificate, followed
+	// by 200 encrypted blocks holding a single certificate each.
+	encode := func(rand io.Reader) []byte {
+		first, err := enc.makeSafeContents(rand, []safeBag{
+			testKeyBag(t, enc, key, password, nil, ""),
+			testCertBag(t, cert, nil, ""),
+		}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticatedSafe := []contentInfo{first}
+		for i := 0; i < 200; i++ {
+			ci, err := enc.makeSafeContents(rand, []safeBag{testCertBag(t, other, nil, "")}, enc.certAlgorithm, encodedPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			authenticatedSafe = append(authenticatedSafe, ci)
+		}
+		return encodeTestAuthenticatedSafe(t, enc, password, authenticatedSafe)
+	}
+
+	pfxData := encode(zeroReader{})
+	if _, _, _, err := DecodeChain(pfxData, password); err == nil || !strings.Contains(err.Error(), "items in the authenticated safe") {
+		t.Fatalf("default MaxContentInfos: got %v, want too many items", err)
+	}
+
+	// All blocks share the same salt, so their key is derived only once.
+	opts := &DecodeOptions{MaxContentInfos: -1}
+	_, _, caCerts, err := opts.DecodeChain(pfxData, password)
+	if err != nil {
+		t.Fatalf("shared salt: %v", err)
+	}
+	if len(caCerts) != 200 {
+		t.Errorf("shared salt: got %d CA certificates, want 200", len(caCerts))
+	}
+
+	pfxData = encode(rand.Reader)
+	if _, _, _, err := opts.DecodeChain(pfxData, password); err == nil || !strings.Contains(err.Error(), "too many key derivations") {
+		t.Fatalf("distinct salts: got %v, want too many key derivations", err)
+	}
+	if _, _, _, err := (&DecodeOptions{MaxContentInfos: -1, MaxKeyDerivations: -1}).DecodeChain(pfxData, password); err != nil {
+		t.Fatalf("distinct salts without limit: %v", err)
+	}
+}
+
+func TestDecodeSignerAndDecrypter(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	signer, cert, err := DecodeSigner(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := signer.(*rsa.PrivateKey); !ok {
+		t.Errorf("got signer of type %T, want *rsa.PrivateKey", signer)
+	}
+	if !cert.PublicKey.(*rsa.PublicKey).Equal(signer.Public()) {
+		t.Error("signer doesn't match the certificate")
+	}
+	if _, _, err := DecodeDecrypter(p12, ""); err != nil {
+		t.Errorf("RSA decrypter: %v", err)
+	}
+
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	pfxData, err := Modern2023.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeSigner(pfxData, "password"); err != nil {
+		t.Errorf("ECDSA signer: %v", err)
+	}
+	if _, _, err := DecodeDecrypter(pfxData, "password"); err == nil {
+		t.Error("ECDSA decrypter: expected an error")
+	}
+}
+
+// testSafeContentsBag returns a safeContentsBag nesting bags.
+func testSafeContentsBag(t *testing.T, bags ...safeBag) safeBag {
+	t.Helper()
+	nested, err := asn1.Marshal(bags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bag := safeBag{Id: oidSafeContentsBag}
+	bag.Value = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: nested}
+	return bag
+}
+
+func TestSafeContentsBag(t *testing.T) {
+	caKey, ca := generateTestCertificate(t, "ca", nil, nil)
+	leafKey, leaf := generateTestCertificate(t, "leaf", ca, caKey)
+	keyID := []byte{1, 2, 3, 4}
+
+	pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{
+		testSafeContentsBag(t,
+			testCertBag(t, ca, nil, "ca"),
+			testSafeContentsBag(t,
+				testCertBag(t, leaf, keyID, "leaf"),
+				testKeyBag(t, Modern2023, leafKey, "password", keyID, "leaf"),
+			),
+		),
+	})
+	privateKey, certificate, caCerts, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leafKey.Equal(privateKey) || !certificate.Equal(leaf) {
+		t.Error("nested key or certificate doesn't match")
+	}
+	if len(caCerts) != 1 || !caCerts[0].Equal(ca) {
+		t.Error("nested CA certificate doesn't match")
+	}
+
+	bag := testCertBag(t, leaf, nil, "")
+	for i := 0; i <= defaultMaxNestingDepth; i++ {
+		bag = testSafeContentsBag(t, bag)
+	}
+	pfxData = encodeTestBags(t, Modern2023, "password", []safeBag{bag})
+	if _, err := DecodeTrustStore(pfxData, "password"); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("deep nesting: got %v, want an error", err)
+	}
+}
+
+func TestWithFixedSalt(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	key, cert, err := Decode(p12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contentSalt := []byte("content salt 16b")
+	macSalt := []byte("mac salt 16bytes")
+	iv := []byte("0123456789abcdef")
+
+	// The MAC key and the certificate encryption key and IV are test vectors
+	// computed independently of this package by OpenSSL 3.0.17, e.g. for
+	// Modern2023, where hexpass is the BMPString "password" with its NUL
+	// terminator:
+	//
+	//	openssl kdf -keylen 32 -kdfopt digest:SHA256 -kdfopt hexpass:00700061007300730077006f007200640000 \
+	//	    -kdfopt salt:"mac salt 16bytes" -kdfopt iter:2048 -kdfopt id:3 PKCS12KDF
+	//	openssl kdf -keylen 32 -kdfopt digest:SHA256 -kdfopt pass:password \
+	//	    -kdfopt salt:"content salt 16b" -kdfopt iter:2048 PBKDF2
+	//
+	// and for LegacyDES, the PKCS12KDF with SHA-1 and id 3 (1 iteration)
+	// for the MAC key, id 1 for the 3DES key and id 2 for its IV.  The
+	// files also pass `openssl pkcs12 -legacy -info -noout`.
+	for _, test := range []struct {
+		name       string
+		enc        *Encoder
+		sha        string
+		macHash    func() hash.Hash
+		macKey     string
+		newCipher  func(key []byte) (cipher.Block, error)
+		contentKey string
+		contentIV  string
+	}{
+		{
+			"LegacyDES", LegacyDES, "f9729cde1af14e25eabda21b2ac5dea133e3d9c2bc45c34c936422610eaf9d1b",
+			sha1.New, "72ec6a237575fc4aeaf361e9b031f402b9b35838",
+			des.NewTripleDESCipher, "07b0293ba258a5297f0186c638e6887c206745bfce10a805", "0cbf3b7c409d0de9",
+		},
+		{
+			"Modern2023", Modern2023, "c01b0e60d444fe1bcf8382dc02f066b84219c7b4782fdd4ccde76f7cf2c0ce92",
+			sha256.New, "fcbb670cc360c2ce30bd0a7c796c7455992bd3560507c48d8bd80c28ed8304b8",
+			aes.NewCipher, "75b8bcfd81b2c81501df88ee30d9740b216394654c8025a8195443d507d4fa8a", hex.EncodeToString(iv),
+		},
+	} {
+		enc := test.enc.WithFixedSalt(contentSalt, macSalt, iv)
+		pfxData, err := enc.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := enc.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pfxData, again) {
+			t.Errorf("%s: output is not reproducible", test.name)
+		}
+		if sum := sha256.Sum256(pfxData); hex.EncodeToString(sum[:]) != test.sha {
+			t.Errorf("%s: got SHA-256 %x, want %s", test.name, sum, test.sha)
+		}
+
+		var pfx pfxPdu
+		if err := unmarshal(pfxData, &pfx); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pfx.MacData.MacSalt, macSalt) {
+			t.Errorf("%s: got MAC salt %x, want %x", test.name, pfx.MacData.MacSalt, macSalt)
+		}
+		var authenticatedSafeBytes []byte
+		if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+			t.Fatal(err)
+		}
+		macKey, _ := hex.DecodeString(test.macKey)
+		mac := hmac.New(test.macHash, macKey)
+		mac.Write(authenticatedSafeBytes)
+		if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+			t.Errorf("%s: the MAC doesn't match the test vector", test.name)
+		}
+
+		var authenticatedSafe []contentInfo
+		if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+			t.Fatal(err)
+		}
+		var ed encryptedData
+		if err := unmarshal(authenticatedSafe[0].Content.Bytes, &ed); err != nil {
+			t.Fatal(err)
+		}
+		contentKey, _ := hex.DecodeString(test.contentKey)
+		contentIV, _ := hex.DecodeString(test.contentIV)
+		block, err := test.newCipher(contentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext := make([]byte, len(ed.EncryptedContentInfo.EncryptedContent))
+		cipher.NewCBCDecrypter(block, contentIV).CryptBlocks(plaintext, ed.EncryptedContentInfo.EncryptedContent)
+		if !bytes.Contains(plaintext, cert.Raw) {
+			t.Errorf("%s: the certificates don't decrypt with the test vector", test.name)
+		}
+
+		if _, _, err := Decode(pfxData, "password"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestPBEWithMD5AndDES(t *testing.T) {
+	// generated with OpenSSL's legacy provider:
+	// openssl pkcs12 -export -keypbe PBE-MD5-DES -certpbe PBE-MD5-DES -macalg sha1 ...
+	p12, err := readFile("testdata/pbe-md5-des.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, cert, err := Decode(p12, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "archive.example.com" {
+		t.Errorf("got common name %q, want archive.example.com", cert.Subject.CommonName)
+	}
+	if !priv.(*ecdsa.PrivateKey).PublicKey.Equal(cert.PublicKey) {
+		t.Error("public key doesn't match the certificate")
+	}
+
+	// openssl pkcs8 -topk8 -v1 PBE-MD5-DES -outform DER ...
+	der, err := readFile("testdata/pbe-md5-des.p8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, err := RewrapPKCS8(rand.Reader, der, "password", "password", Modern2023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := bmpStringZeroTerminated("password")
+	rewrappedKey, err := decodePkcs8ShroudedKeyBag(rewrapped, password, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priv.(*ecdsa.PrivateKey).Equal(rewrappedKey) {
+		t.Error("PKCS#8 key doesn't match the PKCS#12 key")
+	}
+
+	alg := pkix.AlgorithmIdentifier{Algorithm: oidPBEWithMD5AndDESCBC}
+	if _, _, err := pbEncrypterFor(alg, password); err == nil {
+		t.Error("pbeWithMD5AndDES-CBC must not be used for encoding")
+	}
+}
+
+func TestListSubjects(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "root", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+
+	// a certificate with a duplicated extension, which smx509 refuses to parse
+	quirky := &smx509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "quirky", Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte{5, 0}},
+			{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte{5, 0}},
+		},
+	}
+	quirkyDER, err := smx509.CreateCertificate(rand.Reader, quirky, quirky, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := smx509.ParseCertificate(quirkyDER); err == nil {
+		t.Fatal("expected the quirky certificate to be unparseable")
+	}
+
+	pfxData, err := Modern2023.Encode(key, cert, []*smx509.Certificate{caCert, {Raw: quirkyDER}}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjects, err := ListSubjects(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CN=leaf", "CN=root", "CN=quirky,O=Example"}
+	if len(subjects) != len(want) {
+		t.Fatalf("got %d subjects, want %d", len(subjects), len(want))
+	}
+	for i, subject := range subjects {
+		if subject.String() != want[i] {
+			t.Errorf("subject #%d: got %q, want %q", i, subject, want[i])
+		}
+	}
+
+	if _, err := ListSubjects(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestDecodeEntriesByName(t *testing.T) {
+	// two renewals of the same certificate share the "server" alias
+	pfxData, err := readFile("testdata/duplicate-aliases.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := DecodeEntriesByName(pfxData, "password", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	for i, want := range []string{"server 2023", "server 2024"} {
+		if entries[i].Certificate.Subject.CommonName != want {
+			t.Errorf("entry #%d: got certificate %q, want %q", i, entries[i].Certificate.Subject.CommonName, want)
+		}
+		if err := publicKeyMatches(entries[i].PrivateKey, entries[i].Certificate); err != nil {
+			t.Errorf("entry #%d: %v", i, err)
+		}
+	}
+	if _, err := DecodeEntryByName(pfxData, "password", "server"); err != ErrAmbiguousName {
+		t.Errorf("got %v, want ErrAmbiguousName", err)
+	}
+
+	entry, err := DecodeEntryByName(pfxData, "password", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Certificate.Subject.CommonName != "client" || entry.PrivateKey == nil {
+		t.Errorf("got entry %q, want the client key entry", entry.Certificate.Subject.CommonName)
+	}
+	entry, err = DecodeEntryByName(pfxData, "password", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Certificate.Subject.CommonName != "ca" || entry.PrivateKey != nil {
+		t.Errorf("got entry %q, want the ca certificate entry", entry.Certificate.Subject.CommonName)
+	}
+
+	if _, err := DecodeEntriesByName(pfxData, "password", "missing"); err != ErrEntryNotFound {
+		t.Errorf("got %v, want ErrEntryNotFound", err)
+	}
+}
+
+func TestDecodeChainFunc(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	keyID := []byte{1}
+	encodedPassword, _ := bmpStringZeroTerminated("password")
+	certs, err := Modern2023.makeSafeContents(rand.Reader, []safeBag{testCertBag(t, cert, keyID, "my key")}, Modern2023.certAlgorithm, encodedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the shrouded key bag is in an unencrypted SafeContents, as usual
+	keys, err := Modern2023.makeSafeContents(rand.Reader, []safeBag{testKeyBag(t, Modern2023, key, "password", keyID, "my key")}, nil, encodedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData := encodeTestAuthenticatedSafe(t, Modern2023, "password", []contentInfo{certs, keys})
+
+	var hints []string
+	passwords := []string{"wrong", "password"}
+	privateKey, certificate, _, err := DecodeChainFunc(pfxData, func(hint string) (string, error) {
+		hints = append(hints, hint)
+		password := passwords[0]
+		passwords = passwords[1:]
+		return password, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(privateKey) || !certificate.Equal(cert) {
+		t.Error("decoded key or certificate doesn't match")
+	}
+	if len(hints) != 2 || hints[0] != "my key" || hints[1] != "my key" {
+		t.Errorf("got hints %q, want the friendly name twice", hints)
+	}
+
+	calls := 0
+	_, _, _, err = DecodeChainFunc(pfxData, func(string) (string, error) {
+		calls++
+		return "wrong", nil
+	})
+	if err != ErrIncorrectPassword || calls != maxPasswordAttempts {
+		t.Errorf("got %v after %d attempts, want ErrIncorrectPassword after %d", err, calls, maxPasswordAttempts)
+	}
+
+	errCanceled := errors.New("canceled")
+	if _, _, _, err := DecodeChainFunc(pfxData, func(string) (string, error) { return "", errCanceled }); err != errCanceled {
+		t.Errorf("got %v, want the prompter's error", err)
+	}
+}
+
+func TestPasswordHintSkipsUnparseableContents(t *testing.T) {
+	key, _ := generateTestCertificate(t, "leaf", nil, nil)
+	encodedPassword, _ := bmpStringZeroTerminated("password")
+	// a plaintext SafeContents that isn't a valid SEQUENCE OF SafeBag
+	garbage, err := asn1.Marshal([]byte{0x30, 0x03, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := contentInfo{ContentType: oidDataContentType}
+	bad.Content = asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: garbage}
+	keys, err := Modern2023.makeSafeContents(rand.Reader, []safeBag{testKeyBag(t, Modern2023, key, "password", nil, "my key")}, nil, encodedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData := encodeTestAuthenticatedSafe(t, Modern2023, "password", []contentInfo{bad, keys})
+
+	if hint := defaultDecodeOptions.passwordHint(pfxData); hint != "my key" {
+		t.Errorf("got hint %q, want the friendly name after the unparseable contents", hint)
+	}
+	if _, err := ExtractEncryptedKey(pfxData); err == nil {
+		t.Error("ExtractEncryptedKey: expected an error for the unparseable contents")
+	}
+}
+
+func TestPBES2KeyLength(t *testing.T) {
+	// the key bag is encrypted with AES-128, as stated by the pbkdf2 key
+	// length, although its encryption scheme is AES-256-CBC
+	pfxData, err := readFile("testdata/pbes2-keylength.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, certificate, err := Decode(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publicKeyMatches(privateKey, certificate); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExtractEncryptedKey(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	pfxData, err := Modern2023.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := ExtractEncryptedKey(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := bmpStringZeroTerminated("password")
+	extractedKey, err := decodePkcs8ShroudedKeyBag(der, password, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(extractedKey) {
+		t.Error("extracted key doesn't match")
+	}
+
+	pfxData, err = Passwordless.Encode(key, cert, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtractEncryptedKey(pfxData); err == nil {
+		t.Error("passwordless: expected an error")
+	}
+}
+
+func TestSetAuthSafe(t *testing.T) {
+	for _, length := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000, 1 << 24, 1<<31 - 1} {
+		if got, want := derHeaderLength(length), len(appendDERHeader(nil, asn1.TagOctetString, false, length)); got != want {
+			t.Errorf("derHeaderLength(%#x) = %d, want %d", length, got, want)
+		}
+	}
+
+	for _, size := range []int{0, 100, 1000, 70000, 3 << 20} {
+		// a large secret in an unencrypted SafeContents
+		data, err := asn1.Marshal(bytes.Repeat([]byte{'s'}, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ci := contentInfo{ContentType: oidDataContentType}
+		ci.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: data}
+		authenticatedSafe := []contentInfo{ci, ci}
+
+		for _, enc := range []*Encoder{LegacyDES, Modern2023} {
+			password, _ := bmpStringZeroTerminated("password")
+			var pfx pfxPdu
+			newMac, err := enc.startMacData(&pfx.MacData, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := setAuthSafe(&pfx, authenticatedSafe, newMac); err != nil {
+				t.Fatal(err)
+			}
+
+			authenticatedSafeBytes, err := asn1.Marshal(authenticatedSafe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantContent, err := asn1.Marshal(authenticatedSafeBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pfx.AuthSafe.Content.Bytes, wantContent) {
+				t.Errorf("size %d: AuthSafe content differs from its one-shot encoding", size)
+			}
+			wantMac := pfx.MacData
+			if err := computeMac(&wantMac, authenticatedSafeBytes, password); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pfx.MacData.Mac.Digest, wantMac.Mac.Digest) {
+				t.Errorf("size %d: got MAC %x, want %x", size, pfx.MacData.Mac.Digest, wantMac.Mac.Digest)
+			}
+		}
+	}
+}
+
+func TestWrongPasswordCBC(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	keyID := []byte{1}
+
+	// the key bag has another password than the rest of the file, so the
+	// MAC can't detect it
+	pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{
+		testCertBag(t, cert, keyID, ""),
+		testKeyBag(t, Modern2023, key, "other", keyID, ""),
+	})
+	if _, _, err := Decode(pfxData, "password"); err != ErrDecryption {
+		t.Errorf("got %v, want ErrDecryption", err)
+	}
+
+	// a wrong password yields valid padding about once in 256 attempts;
+	// the error must not depend on it
+	bag := testKeyBag(t, Modern2023.WithIterations(1), key, "password", nil, "")
+	for i := 0; i < 1000; i++ {
+		password, _ := bmpStringZeroTerminated(fmt.Sprintf("wrong %d", i))
+		if _, err := decodePkcs8ShroudedKeyBag(bag.Value.Bytes, password, nil); err != ErrDecryption {
+			t.Fatalf("password %d: got %v, want ErrDecryption", i, err)
+		}
+	}
+}
+
+func TestDecodeChainWithInfo(t *testing.T) {
+	ecKey, cert := generateTestCertificate(t, "leaf", nil, nil)
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm2Key, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      interface{}
+		enc      *Encoder
+		password string
+		curve    asn1.ObjectIdentifier
+		bits     int
+	}{
+		{"P-256", ecKey, Modern2023, "password", asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}, 0},
+		{"P-224", p224Key, Passwordless, "", asn1.ObjectIdentifier{1, 3, 132, 0, 33}, 0},
+		{"SM2", sm2Key, ShangMi2024, "password", asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301}, 0},
+		{"RSA", rsaKey, LegacyDES, "password", nil, 1024},
+		{"Ed25519", edKey, Modern2023, "password", nil, 0},
+	}
+	for _, test := range tests {
+		pfxData, err := test.enc.Encode(test.key, cert, nil, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, info, err := DecodeChainWithInfo(pfxData, test.password)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !info.KeyCurve.Equal(test.curve) {
+			t.Errorf("%s: got curve %v, want %v", test.name, info.KeyCurve, test.curve)
+		}
+		if info.KeyBits != test.bits {
+			t.Errorf("%s: got %d bits, want %d", test.name, info.KeyBits, test.bits)
+		}
+	}
+}
+
+// constReader returns an endless stream of the same byte.
+type constReader byte
+
+func (r constReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("unexpected read")
+}
+
+func TestWithSaltRandAndIVRand(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	enc := Modern2023.WithRand(errReader{}).WithSaltRand(constReader(0xaa)).WithIVRand(constReader(0xbb))
+	pfxData, err := enc.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSalt := bytes.Repeat([]byte{0xaa}, 16)
+	wantIV := bytes.Repeat([]byte{0xbb}, 16)
+
+	var pfx pfxPdu
+	if err := unmarshal(pfxData, &pfx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pfx.MacData.MacSalt, wantSalt) {
+		t.Errorf("got MAC salt %x, want %x", pfx.MacData.MacSalt, wantSalt)
+	}
+	var authenticatedSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafe []contentInfo
+	if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+		t.Fatal(err)
+	}
+	var encrypted encryptedData
+	if err := unmarshal(authenticatedSafe[0].Content.Bytes, &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	checkPBES2 := func(what string, algorithm pkix.AlgorithmIdentifier) {
+		t.Helper()
+		var params pbes2Params
+		if err := unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			t.Fatal(err)
+		}
+		var kdfParams pbkdf2Params
+		if err := unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(kdfParams.Salt.Bytes, wantSalt) {
+			t.Errorf("%s: got salt %x, want %x", what, kdfParams.Salt.Bytes, wantSalt)
+		}
+		if !bytes.Equal(params.EncryptionScheme.Parameters.Bytes, wantIV) {
+			t.Errorf("%s: got IV %x, want %x", what, params.EncryptionScheme.Parameters.Bytes, wantIV)
+		}
+	}
+	checkPBES2("certificates", encrypted.EncryptedContentInfo.ContentEncryptionAlgorithm)
+
+	der, err := ExtractEncryptedKey(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkinfo encryptedPrivateKeyInfo
+	if err := unmarshal(der, &pkinfo); err != nil {
+		t.Fatal(err)
+	}
+	checkPBES2("private key", pkinfo.AlgorithmIdentifier)
+
+	if _, _, err := Decode(pfxData, "password"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithChainOrder(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "root", nil, nil)
+	intermediateKey, intermediate := generateTestCertificate(t, "intermediate", root, rootKey)
+	key, leaf := generateTestCertificate(t, "leaf", intermediate, intermediateKey)
+	_, unrelated := generateTestCertificate(t, "unrelated", nil, nil)
+	caCerts := []*smx509.Certificate{unrelated, root, intermediate}
+
+	tests := []struct {
+		order ChainOrder
+		want  []string
+	}{
+		{ChainAsGiven, []string{"unrelated", "root", "intermediate"}},
+		{ChainLeafToRoot, []string{"intermediate", "root", "unrelated"}},
+		{ChainRootToLeaf, []string{"root", "intermediate", "unrelated"}},
+	}
+	for _, test := range tests {
+		pfxData, err := Modern2023.WithChainOrder(test.order).Encode(key, leaf, caCerts, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects, err := ListSubjects(pfxData, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, subject := range subjects[1:] {
+			got = append(got, subject.CommonName)
+		}
+		if subjects[0].CommonName != "leaf" || strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("order %d: got %s then %q, want leaf then %q", test.order, subjects[0].CommonName, got, test.want)
+		}
+	}
+}
+
+func TestDecryptContentInfo(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	for _, enc := range []*Encoder{LegacyRC2, LegacyDES, Modern2023, ShangMi2024} {
+		pfxData, err := enc.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pfx pfxPdu
+		if err := unmarshal(pfxData, &pfx); err != nil {
+			t.Fatal(err)
+		}
+		var authenticatedSafeBytes []byte
+		if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+			t.Fatal(err)
+		}
+		var authenticatedSafe []asn1.RawValue
+		if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+			t.Fatal(err)
+		}
+
+		// the certificates, then the shrouded key
+		for i, want := range []asn1.ObjectIdentifier{oidCertBag, oidPKCS8ShroundedKeyBag} {
+			safeContents, err := DecryptContentInfo(authenticatedSafe[i].FullBytes, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bags []safeBag
+			if err := unmarshal(safeContents, &bags); err != nil {
+				t.Fatal(err)
+			}
+			if len(bags) != 1 || !bags[0].Id.Equal(want) {
+				t.Errorf("ContentInfo #%d: got %d bags, want a single %v", i, len(bags), want)
+			}
+		}
+
+		if _, err := DecryptContentInfo(authenticatedSafe[0].FullBytes, "wrong"); err != ErrDecryption {
+			t.Errorf("wrong password: got %v, want ErrDecryption", err)
+		}
+	}
+}
+
+func TestLenientPFXVersion(t *testing.T) {
+	// gmcert_pkcs12-withoutca.p12 with its version encoded as an ENUMERATED
+	p12data, err := readFile("testdata/enumerated-version.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, certificate, _, err := DecodeChain(p12data, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publicKeyMatches(privateKey, certificate); err != nil {
+		t.Error(err)
+	}
+
+	// the version must still be 3
+	p12data = append([]byte(nil), p12data...)
+	p12data[6] = 2
+	if _, _, _, err := DecodeChain(p12data, "123456"); err == nil {
+		t.Error("version 2: expected an error")
+	}
+}
+
+func TestMacDataBeforeAuthSafe(t *testing.T) {
+	// the PFX of hybrid-pem-pfx.p12 with its macData moved before its
+	// authSafe
+	p12data, err := readFile("testdata/macdata-first.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, certificate, _, err := DecodeChain(p12data, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Subject.CommonName != "hybrid.example.com" {
+		t.Errorf("got certificate %q, want hybrid.example.com", certificate.Subject.CommonName)
+	}
+	if err := publicKeyMatches(privateKey, certificate); err != nil {
+		t.Error(err)
+	}
+
+	// the MAC is still verified over the authSafe
+	if _, _, _, err := DecodeChain(p12data, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+	p12data = append([]byte(nil), p12data...)
+	p12data[len(p12data)-1] ^= 1
+	if _, _, _, err := DecodeChain(p12data, "password"); err == nil {
+		t.Error("modified authSafe: expected an error")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "root", nil, nil)
+	key, leaf := generateTestCertificate(t, "leaf", root, rootKey)
+	for _, enc := range []*Encoder{LegacyRC2, Modern2023, ShangMi2024, Passwordless} {
+		password := "password"
+		if enc == Passwordless {
+			password = ""
+		}
+		pfxData, err := enc.Encode(key, leaf, []*smx509.Certificate{root}, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SelfTest(pfxData, password); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, tc := range sm2testdata {
+		p12data, err := readFile(tc.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SelfTest(p12data, tc.password); err != nil {
+			t.Errorf("%s: %v", tc.filename, err)
+		}
+		if err := SelfTest(p12data, "wrong"); err == nil || !strings.Contains(err.Error(), ErrIncorrectPassword.Error()) {
+			t.Errorf("%s: wrong password: got %v", tc.filename, err)
+		}
+	}
+}
+
+// kmsBagPassword derives the password of a bag from master, the way the KMS
+// that exported testdata/derived-passwords.p12 does.
+func kmsBagPassword(master, bagType string, localKeyID []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(master))
+	mac.Write([]byte(bagType))
+	mac.Write(localKeyID)
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestBagPassword(t *testing.T) {
+	pfxData, err := readFile("testdata/derived-passwords.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Decode(pfxData, "master"); err == nil {
+		t.Fatal("expected an error without BagPassword")
+	}
+
+	var calls []string
+	opts := &DecodeOptions{BagPassword: func(bagType string, localKeyID []byte) ([]byte, error) {
+		calls = append(calls, fmt.Sprintf("%s %x", bagType, localKeyID))
+		return kmsBagPassword("master", bagType, localKeyID), nil
+	}}
+	privateKey, certificate, err := opts.Decode(pfxData, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publicKeyMatches(privateKey, certificate); err != nil {
+		t.Error(err)
+	}
+	if want := "encryptedData ,pkcs8ShroudedKeyBag deadbeef"; strings.Join(calls, ",") != want {
+		t.Errorf("got calls %q, want %q", calls, want)
+	}
+
+	// the MAC is still verified with the master password
+	if _, _, err := opts.Decode(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestProtectionWarnings(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	shortSalt := *Modern2023.WithIterations(MinMACIterations)
+	shortSalt.saltLen = 4
+
+	tests := []struct {
+		name string
+		enc  *Encoder
+		want []WarningKind
+	}{
+		{"Modern2023", Modern2023.WithIterations(MinMACIterations), nil},
+		{"PBMAC1", Modern2023.WithIterations(MinMACIterations).WithMACAlgorithm(OIDMACPBMAC1), nil},
+		{"Modern2023 default iterations", Modern2023, []WarningKind{WarningLowMACIterations}},
+		{"short salt", &shortSalt, []WarningKind{WarningWeakMACSalt}},
+		{"LegacyDES", LegacyDES, []WarningKind{WarningLowMACIterations, WarningLegacyPBES1}},
+		{"LegacyRC2", LegacyRC2, []WarningKind{WarningLowMACIterations, WarningLegacyPBES1, WarningLegacyPBES1}},
+	}
+	for _, test := range tests {
+		pfxData, err := test.enc.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, info, err := DecodeChainWithInfo(pfxData, "password")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var got []WarningKind
+		for _, w := range info.Warnings {
+			got = append(got, w.Kind)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got warnings %v, want kinds %v", test.name, info.Warnings, test.want)
+		}
+	}
+}
+
+func TestDecodeEnveloped(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	pfxData, err := Modern2023.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rsaKeys []interface{}
+	var rsaCerts []*smx509.Certificate
+	for _, base64P12 := range testdata {
+		p12, _ := base64.StdEncoding.DecodeString(base64P12)
+		rsaKey, rsaCert, err := Decode(p12, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsaKeys = append(rsaKeys, rsaKey)
+		rsaCerts = append(rsaCerts, rsaCert)
+	}
+	rsaKey := rsaKeys[len(rsaKeys)-1]
+	sm2PFX, err := readFile("testdata/gmcert_pkcs12-withoutca.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm2Key, sm2Cert, err := Decode(sm2PFX, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaEnvelope, err := pkcs7.Encrypt(pkcs.AES256CBC, pfxData, rsaCerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm2Envelope, err := pkcs7.EncryptSM(pkcs.SM4CBC, pfxData, []*smx509.Certificate{sm2Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		envelope []byte
+		key      crypto.PrivateKey
+	}{
+		"RSA": {rsaEnvelope, rsaKey},
+		"SM2": {sm2Envelope, sm2Key},
+	} {
+		privateKey, certificate, _, err := DecodeEnveloped(test.envelope, test.key, "password")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !key.Equal(privateKey) || !certificate.Equal(cert) {
+			t.Errorf("%s: decoded a different key or certificate", name)
+		}
+		if _, _, _, err := DecodeEnveloped(test.envelope, test.key, "wrong"); err != ErrIncorrectPassword {
+			t.Errorf("%s: wrong password: got %v, want ErrIncorrectPassword", name, err)
+		}
+	}
+
+	if _, _, _, err := DecodeEnveloped(sm2Envelope, rsaKey, "password"); err == nil {
+		t.Error("expected an error with a key of another recipient")
+	}
+}
+
+func TestWithMatchedNames(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+
+	pfxData, err := Modern2023.WithMatchedNames(true).Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedPassword, err := bmpStringZeroTerminated("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bags, _, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, nil, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bags) != 3 {
+		t.Fatalf("got %d bags, want 3", len(bags))
+	}
+	friendlyName := func(bag *safeBag) []byte {
+		for _, attr := range bag.Attributes {
+			if attr.Id.Equal(oidFriendlyName) {
+				return attr.Value.Bytes
+			}
+		}
+		return nil
+	}
+	certName, keyName := friendlyName(&bags[0]), friendlyName(&bags[2])
+	if certName == nil || !bytes.Equal(certName, keyName) {
+		t.Errorf("got friendlyName %x on the certificate bag and %x on the key bag, want the same", certName, keyName)
+	}
+	if name, err := bags[2].friendlyName(); err != nil || name != "leaf" {
+		t.Errorf("got friendlyName %q (%v), want %q", name, err, "leaf")
+	}
+	if friendlyName(&bags[1]) != nil {
+		t.Error("CA certificate bag has a friendlyName")
+	}
+
+	entry, err := DecodeEntryByName(pfxData, "password", "leaf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(entry.PrivateKey) || !entry.Certificate.Equal(cert) {
+		t.Error("decoded a different key or certificate")
+	}
+}
+
+func TestMachineGeneratedPasswords(t *testing.T) {
+	tests := []struct {
+		filename string
+		password string
+		wrong    []string
+	}{
+		// produced by OpenSSL 3.0 with its default algorithms
+		{"testdata/control-chars-password.p12", "\x01\x02\x1b\x7f\tA", []string{"\x01\x02\x1b\x7f\t", "\x02\x1b\x7f\tA"}},
+		// produced by OpenSSL 3.0 with -legacy, which encodes the invalid
+		// UTF-8 password byte by byte
+		{"testdata/invalid-utf8-password.p12", "a\xff\xfe\x80z", []string{"a\xfe\xff\x80z", "a\ufffd\ufffd\ufffdz"}},
+		// produced by LegacyDES in the baseline release, which replaced every
+		// invalid UTF-8 byte with U+FFFD
+		{"testdata/fffd-password.p12", "a\xff\xfe\x80z", []string{"a\ufffd\ufffdz", "b\xff\xfe\x80z"}},
+		// produced by Modern2023, since OpenSSL can't take a password with NULs
+		{"testdata/nul-password.p12", "\x00pass\x00word\x01", []string{"pass\x00word\x01", "\x00pass\x00word"}},
+	}
+	for _, test := range tests {
+		p12data, err := readFile(test.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateKey, certificate, err := Decode(p12data, test.password)
+		if err != nil {
+			t.Errorf("%s: %v", test.filename, err)
+			continue
+		}
+		if err := publicKeyMatches(privateKey, certificate); err != nil {
+			t.Errorf("%s: %v", test.filename, err)
+		}
+		for _, password := range test.wrong {
+			if _, _, err := Decode(p12data, password); err != ErrIncorrectPassword {
+				t.Errorf("%s: password %q: got %v, want ErrIncorrectPassword", test.filename, password, err)
+			}
+		}
+		if _, _, _, _, err := DecodeChainWithProvider(p12data, StringPassword(test.password)); err != nil {
+			t.Errorf("%s: with a PasswordProvider: %v", test.filename, err)
+		}
+	}
+
+	// Round trip through the classic KDF, PBES2 and PBMAC1.
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	for _, enc := range []*Encoder{LegacyDES, Modern2023, Modern2023.WithMACAlgorithm(OIDMACPBMAC1)} {
+		pfxData, err := enc.Encode(key, cert, nil, "\x00\x01\xff\x00")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := Decode(pfxData, "\x00\x01\xff\x00"); err != nil {
+			t.Error(err)
+		}
+		// Invalid bytes are all encoded as U+FFFD, so only the valid ones
+		// tell passwords apart.
+		if _, _, err := Decode(pfxData, "\x00\x02\xff\x00"); err != ErrIncorrectPassword {
+			t.Errorf("got %v, want ErrIncorrectPassword", err)
+		}
+	}
+}
+
+func TestWithVerifyChain(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "root", nil, nil)
+	_, other := generateTestCertificate(t, "other root", nil, nil)
+
+	// generateTestCertificate only creates self-signed CAs
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &smx509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := smx509.CreateCertificate(rand.Reader, template, root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := smx509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, leaf := generateTestCertificate(t, "leaf", intermediate, intermediateKey)
+
+	roots := smx509.NewCertPool()
+	roots.AddCert(root)
+	enc := Modern2023.WithVerifyChain(roots)
+
+	tests := []struct {
+		name    string
+		caCerts []*smx509.Certificate
+		ok      bool
+	}{
+		{"complete chain", []*smx509.Certificate{intermediate, root}, true},
+		{"chain without root", []*smx509.Certificate{intermediate}, true},
+		{"missing intermediate", []*smx509.Certificate{root}, false},
+		{"unrelated certificate", []*smx509.Certificate{intermediate, other}, false},
+	}
+	for _, test := range tests {
+		_, err := enc.Encode(key, leaf, test.caCerts, "password")
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	// verification is off by default
+	if _, err := Modern2023.Encode(key, leaf, []*smx509.Certificate{other}, "password"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeCertificate(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+	keyID := []byte{1, 2, 3, 4}
+
+	// The key is encrypted with another password, so that decoding fails
+	// if it is decrypted.
+	pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{
+		testCertBag(t, caCert, nil, ""),
+		testCertBag(t, cert, keyID, ""),
+		testKeyBag(t, Modern2023, key, "other", keyID, ""),
+	})
+	if _, _, _, err := DecodeChain(pfxData, "password"); err == nil {
+		t.Fatal("expected DecodeChain to fail")
+	}
+	certificate, err := DecodeCertificate(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Equal(cert) {
+		t.Errorf("got certificate %q, want %q", certificate.Subject, cert.Subject)
+	}
+
+	if _, err := DecodeCertificate(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("got %v, want ErrIncorrectPassword", err)
+	}
+
+	// Without localKeyId, the first certificate is returned.
+	pfxData, err = Modern2023.WithoutAttributes().Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate, err = DecodeCertificate(pfxData, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Equal(cert) {
+		t.Errorf("got certificate %q, want %q", certificate.Subject, cert.Subject)
+	}
+}
+
+func TestHMACAlgorithmAsMACAlgorithm(t *testing.T) {
+	// produced by OpenSSL 3.0, with the MAC algorithm then replaced by
+	// hmacWithSHA256
+	p12data, err := readFile("testdata/hmac-mac-oid.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, certificate, err := Decode(p12data, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publicKeyMatches(privateKey, certificate); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := Decode(p12data, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestDotNet(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+
+	pfxData, err := DotNet.Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx, err := parsePFX(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA256) || pfx.MacData.Iterations != 2000 {
+		t.Errorf("got MAC %v with %d iterations, want %v with 2000", pfx.MacData.Mac.Algorithm.Algorithm, pfx.MacData.Iterations, oidSHA256)
+	}
+	var authenticatedSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafe []contentInfo
+	if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+		t.Fatal(err)
+	}
+	if len(authenticatedSafe) != 1 || !authenticatedSafe[0].ContentType.Equal(oidEncryptedDataContentType) {
+		t.Fatalf("got %d SafeContents, want a single encryptedData", len(authenticatedSafe))
+	}
+	encodedPassword, err := bmpStringZeroTerminated("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bags, _, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, nil, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bags) != 3 || !bags[2].Id.Equal(oidPKCS8ShroundedKeyBag) {
+		t.Errorf("got %d bags, want two cert bags and a shrouded key bag", len(bags))
+	}
+
+	decodedKey, decodedCert, caCerts, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(decodedKey) || !decodedCert.Equal(cert) || len(caCerts) != 1 || !caCerts[0].Equal(caCert) {
+		t.Error("decoded a different key or certificates")
+	}
+
+	// exported by .NET 8.0.20 on Linux (Debian 12) from an import of a
+	// file written by DotNet, with X509Certificate2Collection.Export(
+	// X509ContentType.Pfx, "password"): the key is in a plaintext
+	// SafeContents, and the certificates are encrypted with 3DES
+	pfxData, err = readFile("testdata/dotnet8-export.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedKey, decodedCert, caCerts, err = DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedKey == nil || decodedCert.Subject.CommonName != "leaf" || len(caCerts) != 1 || caCerts[0].Subject.CommonName != "ca" {
+		t.Error(".NET export: decoded a different key or certificates")
+	}
+	if err := publicKeyMatches(decodedKey, decodedCert); err != nil {
+		t.Errorf(".NET export: %v", err)
+	}
+}
+
+func TestEntryDisplayName(t *testing.T) {
+	key, cert := generateTestCertificate(t, "first", nil, nil)
+	_, windowsCert := generateTestCertificate(t, "second", nil, nil)
+	_, anonymousCert := generateTestCertificate(t, "third", nil, nil)
+	keyID := []byte{1, 2, 3, 4}
+
+	// the Windows friendly name property: a NUL-terminated UTF-16LE string
+	var utf16le []byte
+	for _, c := range "Windows name\x00" {
+		utf16le = append(utf16le, byte(c), 0)
+	}
+	value, err := asn1.Marshal(utf16le)
+	if err != nil {
+		t.Fatal(err)
+	}
+	windowsBag := testCertBag(t, windowsCert, nil, "")
+	windowsBag.Attributes = []pkcs12Attribute{{
+		Id:    oidMicrosoftFriendlyName,
+		Value: asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: value},
+	}}
+
+	pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{
+		testCertBag(t, cert, keyID, ""),
+		windowsBag,
+		testCertBag(t, anonymousCert, nil, ""),
+		testKeyBag(t, Modern2023, key, "password", keyID, "alias"),
+	})
+	entries, err := DecodeEntries(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	for i, want := range []string{"alias", "Windows name", "third"} {
+		if got := entries[i].DisplayName(); got != want {
+			t.Errorf("entry %d: got display name %q, want %q", i, got, want)
+		}
+	}
+
+	// the key entry has the attributes of both bags
+	for _, id := range []asn1.ObjectIdentifier{oidFriendlyName, oidLocalKeyID} {
+		if _, ok := entries[0].Attributes[id.String()]; !ok {
+			t.Errorf("key entry is missing attribute %v", id)
+		}
+	}
+	if got := entries[1].Attributes[oidMicrosoftFriendlyName.String()]; !bytes.Equal(got, value) {
+		t.Errorf("got Windows friendly name attribute %x, want %x", got, value)
+	}
+	if entries[2].Attributes != nil {
+		t.Errorf("got attributes %v, want none", entries[2].Attributes)
+	}
+}
+
+func TestWithMaxOutputSize(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+
+	pfxData, err := Modern2023.Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(pfxData)
+
+	if _, err := Modern2023.WithMaxOutputSize(size).Encode(key, cert, []*smx509.Certificate{caCert}, "password"); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+	_, err = Modern2023.WithMaxOutputSize(size-10).Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err == nil || !strings.Contains(err.Error(), "10 bytes over") {
+		t.Errorf("over the limit: got %v, want an error telling it is 10 bytes over", err)
+	}
+	// without the CA certificate, the file fits
+	if _, err := Modern2023.WithMaxOutputSize(size-10).Encode(key, cert, nil, "password"); err != nil {
+		t.Errorf("without the CA certificate: %v", err)
+	}
+
+	if _, err := Modern2023.WithMaxOutputSize(100).EncodeTrustStore([]*smx509.Certificate{caCert}, "password"); err == nil {
+		t.Error("trust store: expected an error")
+	}
+}
+
+func TestRSASSAPSSKey(t *testing.T) {
+	// produced by OpenSSL 3.0 with an RSA-PSS key restricted to SHA-256
+	p12data, err := readFile("testdata/rsassa-pss.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, certificate, err := Decode(p12data, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("got private key of type %T, want *rsa.PrivateKey", privateKey)
+	}
+	if err := key.Validate(); err != nil {
+		t.Error(err)
+	}
+	if certificate.Subject.CommonName != "pss.example.com" {
+		t.Errorf("got certificate %q", certificate.Subject)
+	}
+
+	_, _, _, info, err := DecodeChainWithInfo(p12data, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.KeyAlgorithm.Algorithm.Equal(oidRSASSAPSS) || len(info.KeyAlgorithm.Parameters.FullBytes) == 0 {
+		t.Errorf("got key algorithm %v, want id-RSASSA-PSS with parameters", info.KeyAlgorithm.Algorithm)
+	}
+	if info.KeyBits != 2048 {
+		t.Errorf("got %d key bits, want 2048", info.KeyBits)
+	}
+}
+
+// testSecretBag returns a secret bag of the given type holding value.
+func testSecretBag(t *testing.T, typeID asn1.ObjectIdentifier, value []byte, friendlyName string) safeBag {
+	t.Helper()
+	octetString, err := asn1.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(secretBag{SecretTypeID: typeID, SecretValue: asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: octetString}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bag := safeBag{Id: oidSecretBag, Attributes: testAttributes(t, nil, friendlyName)}
+	bag.Value = asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: der}
+	return bag
+}
+
+func TestDecodeAllSecrets(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	oidAES := asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1}
+	aesKey := bytes.Repeat([]byte{0x42}, 32)
+
+	// a secret key stored the way Java does
+	pkData, err := asn1.Marshal(pkcs8PrivateKeyInfo{Algo: pkix.AlgorithmIdentifier{Algorithm: oidAES}, PrivateKey: aesKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedPassword, err := bmpStringZeroTerminated("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey, err := Modern2023.encryptPkcs8(rand.Reader, pkData, encodedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oidPSK := asn1.ObjectIdentifier{1, 2, 3, 4}
+	pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{
+		testCertBag(t, cert, nil, ""),
+		testSecretBag(t, oidPKCS8ShroundedKeyBag, encryptedKey, "aes"),
+		testKeyBag(t, Modern2023, key, "password", nil, ""),
+		testSecretBag(t, oidPSK, []byte("pre-shared key"), "psk"),
+	})
+
+	secrets, err := DecodeAllSecrets(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 {
+		t.Fatalf("got %d secrets, want 2", len(secrets))
+	}
+	if s := secrets[0]; !s.TypeOID.Equal(oidAES) || !bytes.Equal(s.Value, aesKey) || s.FriendlyName != "aes" {
+		t.Errorf("got secret %v %x %q, want the AES key", s.TypeOID, s.Value, s.FriendlyName)
+	}
+	if s := secrets[1]; !s.TypeOID.Equal(oidPSK) || string(s.Value) != "pre-shared key" || s.FriendlyName != "psk" {
+		t.Errorf("got secret %v %q %q, want the pre-shared key", s.TypeOID, s.Value, s.FriendlyName)
+	}
+
+	if _, err := DecodeAllSecrets(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("got %v, want ErrIncorrectPassword", err)
+	}
+
+	pfxData, err = Modern2023.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets, err := DecodeAllSecrets(pfxData, "password"); err != nil || len(secrets) != 0 {
+		t.Errorf("got %d secrets and %v, want none", len(secrets), err)
+	}
+}
+
+func TestPBES2WithSM3PRF(t *testing.T) {
+	// generated with gmsm: the key with pkcs8.MarshalPrivateKey and the
+	// certificate SafeContents with pkcs.SM4CBC, both using PBES2 with
+	// PBKDF2-HMAC-SM3 and SM4-CBC
+	p12, err := readFile("testdata/sm4-sm3-pbes2.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, cert, _, err := DecodeChain(p12, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := priv.(*sm2.PrivateKey)
+	if !ok {
+		t.Fatalf("got key of type %T, want *sm2.PrivateKey", priv)
+	}
+	if cert.Subject.CommonName != "sm4-sm3.example.com" {
+		t.Errorf("got common name %q, want sm4-sm3.example.com", cert.Subject.CommonName)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		t.Error("public key doesn't match the certificate")
+	}
+
+	checkPBES2 := func(what string, alg pkix.AlgorithmIdentifier) {
+		t.Helper()
+		var params pbes2Params
+		if !alg.Algorithm.Equal(oidPBES2) {
+			t.Fatalf("%s: got algorithm %v, want PBES2", what, alg.Algorithm)
+		}
+		if err := unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			t.Fatal(err)
+		}
+		var kdfParams pbkdf2Params
+		if err := unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams); err != nil {
+			t.Fatal(err)
+		}
+		if !kdfParams.Prf.Algorithm.Equal(oidHmacWithSM3) || !params.EncryptionScheme.Algorithm.Equal(oidSM4CBC) {
+			t.Errorf("%s: got PRF %v and scheme %v, want hmacWithSM3 and SM4-CBC", what, kdfParams.Prf.Algorithm, params.EncryptionScheme.Algorithm)
+		}
+	}
+
+	pfxData, err := ShangMi2024.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := parsePFX(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafe []contentInfo
+	if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+		t.Fatal(err)
+	}
+	for _, ci := range authenticatedSafe {
+		if !ci.ContentType.Equal(oidEncryptedDataContentType) {
+			continue
+		}
+		var encryptedData encryptedData
+		if err := unmarshal(ci.Content.Bytes, &encryptedData); err != nil {
+			t.Fatal(err)
+		}
+		checkPBES2("certificates", encryptedData.EncryptedContentInfo.ContentEncryptionAlgorithm)
+	}
+	der, err := ExtractEncryptedKey(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encryptedKey encryptedPrivateKeyInfo
+	if err := unmarshal(der, &encryptedKey); err != nil {
+		t.Fatal(err)
+	}
+	checkPBES2("key", encryptedKey.AlgorithmIdentifier)
+
+	// the key must be readable by gmsm
+	gmKey, err := pkcs8.ParsePKCS8PrivateKey(der, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(gmKey) {
+		t.Error("gmsm decrypted a different key")
+	}
+
+	decodedKey, decodedCert, _, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(decodedKey) || !decodedCert.Equal(cert) {
+		t.Error("round trip returned a different key or certificate")
+	}
+}
+
+func TestWithLayout(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+
+	tests := []struct {
+		name   string
+		layout Layout
+		want   [][]asn1.ObjectIdentifier // bag types of each SafeContents
+	}{
+		{"OpenSSL", OpenSSLLayout, [][]asn1.ObjectIdentifier{{oidCertBag, oidCertBag}, {oidPKCS8ShroundedKeyBag}}},
+		{"Windows", WindowsLayout, [][]asn1.ObjectIdentifier{{oidPKCS8ShroundedKeyBag}, {oidCertBag, oidCertBag}}},
+		{"Java", JavaLayout, [][]asn1.ObjectIdentifier{{oidPKCS8ShroundedKeyBag}, {oidCertBag, oidCertBag}}},
+		{"plaintext CA certificates", Layout{
+			{Contents: LayoutLeafCert | LayoutKey, Encrypted: true},
+			{Contents: LayoutCACerts},
+		}, [][]asn1.ObjectIdentifier{{oidCertBag, oidPKCS8ShroundedKeyBag}, {oidCertBag}}},
+		{"split", Layout{
+			{Contents: LayoutCACerts, Encrypted: true},
+			{Contents: LayoutLeafCert, Encrypted: true},
+			{Contents: LayoutKey},
+		}, [][]asn1.ObjectIdentifier{{oidCertBag}, {oidCertBag}, {oidPKCS8ShroundedKeyBag}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pfxData, err := Modern2023.WithLayout(test.layout).Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pfx, err := parsePFX(pfxData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var authenticatedSafeBytes []byte
+			if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+				t.Fatal(err)
+			}
+			var authenticatedSafe []asn1.RawValue
+			if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+				t.Fatal(err)
+			}
+			if len(authenticatedSafe) != len(test.want) {
+				t.Fatalf("got %d SafeContents, want %d", len(authenticatedSafe), len(test.want))
+			}
+			for i, want := range test.want {
+				var ci contentInfo
+				if err := unmarshal(authenticatedSafe[i].FullBytes, &ci); err != nil {
+					t.Fatal(err)
+				}
+				if encrypted := ci.ContentType.Equal(oidEncryptedDataContentType); encrypted != test.layout[i].Encrypted {
+					t.Errorf("SafeContents #%d: got encrypted %v, want %v", i, encrypted, test.layout[i].Encrypted)
+				}
+				safeContents, err := DecryptContentInfo(authenticatedSafe[i].FullBytes, "password")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var bags []safeBag
+				if err := unmarshal(safeContents, &bags); err != nil {
+					t.Fatal(err)
+				}
+				if len(bags) != len(want) {
+					t.Fatalf("SafeContents #%d: got %d bags, want %d", i, len(bags), len(want))
+				}
+				for j := range want {
+					if !bags[j].Id.Equal(want[j]) {
+						t.Errorf("SafeContents #%d: got bag #%d of type %v, want %v", i, j, bags[j].Id, want[j])
+					}
+				}
+			}
+
+			decodedKey, decodedCert, caCerts, err := DecodeChain(pfxData, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.Equal(decodedKey) || !decodedCert.Equal(cert) || len(caCerts) != 1 || !caCerts[0].Equal(caCert) {
+				t.Error("decoded a different key or certificates")
+			}
+		})
+	}
+
+	// without CA certificates, their SafeContents is omitted
+	pfxData, err := Modern2023.WithLayout(Layout{
+		{Contents: LayoutLeafCert | LayoutKey, Encrypted: true},
+		{Contents: LayoutCACerts},
+	}).Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedPassword, _ := bmpStringZeroTerminated("password")
+	if _, _, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, nil, 1, 1); err != nil {
+		t.Errorf("without CA certificates: %v", err)
+	}
+
+	for _, layout := range []Layout{
+		nil,
+		{{Contents: LayoutKey | LayoutLeafCert}},
+		{{Contents: LayoutKey | LayoutLeafCert | LayoutCACerts}, {Contents: LayoutCACerts}},
+		{{Contents: LayoutKey | LayoutLeafCert | LayoutCACerts | 8}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("layout %v: expected a panic", layout)
+				}
+			}()
+			Modern2023.WithLayout(layout)
+		}()
+	}
+}
+
+func TestNonBMPFriendlyName(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	localKeyID := []byte{1, 2, 3, 4}
+
+	// These files are synthetic: this package encodes the friendlyName
+	// attributes with the string types that non-conforming producers use,
+	// and none of the files comes from such a producer.
+	for _, test := range []struct {
+		name  string
+		tag   int
+		alias string
+	}{
+		{"UTF8String", asn1.TagUTF8String, "clé serveur"},
+		{"IA5String", asn1.TagIA5String, "server key"},
+		{"PrintableString", asn1.TagPrintableString, "server key"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := asn1.Marshal(asn1.RawValue{Class: 0, Tag: test.tag, Bytes: []byte(test.alias)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			friendlyName := pkcs12Attribute{
+				Id:    oidFriendlyName,
+				Value: asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: value},
+			}
+			keyBag := testKeyBag(t, Modern2023, key, "password", localKeyID, "")
+			keyBag.Attributes = append(keyBag.Attributes, friendlyName)
+			certBag := testCertBag(t, cert, localKeyID, "")
+			certBag.Attributes = append(certBag.Attributes, friendlyName)
+			pfxData := encodeTestSafeContents(t, Modern2023, "password", [][]safeBag{{certBag}, {keyBag}})
+
+			entry, err := DecodeEntryByName(pfxData, "password", test.alias)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.FriendlyName != test.alias || !key.Equal(entry.PrivateKey) {
+				t.Errorf("got entry %q, want the key entry %q", entry.FriendlyName, test.alias)
+			}
+
+			blocks, err := ToPEM(pfxData, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, block := range blocks {
+				if block.Headers["friendlyName"] != test.alias {
+					t.Errorf("%s block: got friendlyName %q, want %q", block.Type, block.Headers["friendlyName"], test.alias)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxNestingDepth(t *testing.T) {
+	// a key and its certificate nested in 20 safeContentsBags
+	pfxData, err := readFile("testdata/deep-nesting.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := DecodeChain(pfxData, "password"); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("default limit: got %v, want a nesting error", err)
+	}
+	opts := &DecodeOptions{MaxNestingDepth: 19}
+	if _, _, _, err := opts.DecodeChain(pfxData, "password"); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("MaxNestingDepth 19: got %v, want a nesting error", err)
+	}
+	for _, depth := range []int{20, -1} {
+		opts := &DecodeOptions{MaxNestingDepth: depth}
+		privateKey, cert, _, err := opts.DecodeChain(pfxData, "password")
+		if err != nil {
+			t.Fatalf("MaxNestingDepth %d: %v", depth, err)
+		}
+		if cert.Subject.CommonName != "nested" {
+			t.Errorf("MaxNestingDepth %d: got certificate %q, want the nested one", depth, cert.Subject.CommonName)
+		}
+		if err := publicKeyMatches(privateKey, cert); err != nil {
+			t.Errorf("MaxNestingDepth %d: %v", depth, err)
+		}
+	}
+}
+
+func TestAppleConfigProfile(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "device", caCert, caKey)
+
+	pfxData, err := AppleConfigProfile.Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := parsePFX(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA1) || pfx.MacData.Iterations != 2048 {
+		t.Errorf("got MAC %v with %d iterations, want %v with 2048", pfx.MacData.Mac.Algorithm.Algorithm, pfx.MacData.Iterations, oidSHA1)
+	}
+	var authenticatedSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafe []contentInfo
+	if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+		t.Fatal(err)
+	}
+	var encryptedData encryptedData
+	if err := unmarshal(authenticatedSafe[0].Content.Bytes, &encryptedData); err != nil {
+		t.Fatal(err)
+	}
+	if alg := encryptedData.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm; !alg.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC) {
+		t.Errorf("got certificate encryption %v, want %v", alg, oidPBEWithSHAAnd3KeyTripleDESCBC)
+	}
+	der, err := ExtractEncryptedKey(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encryptedKey encryptedPrivateKeyInfo
+	if err := unmarshal(der, &encryptedKey); err != nil {
+		t.Fatal(err)
+	}
+	if alg := encryptedKey.AlgorithmIdentifier.Algorithm; !alg.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC) {
+		t.Errorf("got key encryption %v, want %v", alg, oidPBEWithSHAAnd3KeyTripleDESCBC)
+	}
+
+	decodedKey, decodedCert, caCerts, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(decodedKey) || !decodedCert.Equal(cert) || len(caCerts) != 1 || !caCerts[0].Equal(caCert) {
+		t.Error("decoded a different key or certificates")
+	}
+}
+
+func TestKeyBagDigest(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	localKeyID := sha1.Sum(cert.Raw)
+
+	var digests [][]byte
+	for i := 0; i < 2; i++ {
+		pfxData, err := Modern2023.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, info, err := DecodeChainWithInfo(pfxData, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := ExtractEncryptedKey(pfxData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sha256.Sum256(der)
+		digest := info.KeyBagDigest(localKeyID[:])
+		if !bytes.Equal(digest, want[:]) {
+			t.Errorf("got digest %x, want %x", digest, want)
+		}
+		if digest := info.KeyBagDigest([]byte("unknown")); digest != nil {
+			t.Errorf("unknown localKeyId: got digest %x, want nil", digest)
+		}
+		digests = append(digests, digest)
+	}
+	if bytes.Equal(digests[0], digests[1]) {
+		t.Error("two encodings of the same key have the same digest")
+	}
+}
+
+func TestWithComponentIterations(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+
+	iterations := func(alg pkix.AlgorithmIdentifier) int {
+		t.Helper()
+		if alg.Algorithm.Equal(oidPBES2) {
+			var params pbes2Params
+			if err := unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+				t.Fatal(err)
+			}
+			var kdfParams pbkdf2Params
+			if err := unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams); err != nil {
+				t.Fatal(err)
+			}
+			return kdfParams.Iterations
+		}
+		var params pbeParams
+		if err := unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			t.Fatal(err)
+		}
+		return params.Iterations
+	}
+
+	for _, enc := range []*Encoder{LegacyDES, Modern2023, ShangMi2024} {
+		pfxData, err := enc.WithComponentIterations(5000, 1000, 3000).Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pfx, err := parsePFX(pfxData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pfx.MacData.Iterations != 3000 {
+			t.Errorf("got %d MAC iterations, want 3000", pfx.MacData.Iterations)
+		}
+		var authenticatedSafeBytes []byte
+		if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+			t.Fatal(err)
+		}
+		var authenticatedSafe []contentInfo
+		if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+			t.Fatal(err)
+		}
+		var encryptedData encryptedData
+		if err := unmarshal(authenticatedSafe[0].Content.Bytes, &encryptedData); err != nil {
+			t.Fatal(err)
+		}
+		if n := iterations(encryptedData.EncryptedContentInfo.ContentEncryptionAlgorithm); n != 1000 {
+			t.Errorf("got %d certificate encryption iterations, want 1000", n)
+		}
+		der, err := ExtractEncryptedKey(pfxData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var encryptedKey encryptedPrivateKeyInfo
+		if err := unmarshal(der, &encryptedKey); err != nil {
+			t.Fatal(err)
+		}
+		if n := iterations(encryptedKey.AlgorithmIdentifier); n != 5000 {
+			t.Errorf("got %d key encryption iterations, want 5000", n)
+		}
+
+		decodedKey, decodedCert, _, err := DecodeChain(pfxData, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Equal(decodedKey) || !decodedCert.Equal(cert) {
+			t.Error("decoded a different key or certificate")
+		}
+	}
+
+	// WithIterations applies to all the components again
+	pfxData, err := Modern2023.WithComponentIterations(5000, 1000, 3000).WithIterations(2000).Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := ExtractEncryptedKey(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encryptedKey encryptedPrivateKeyInfo
+	if err := unmarshal(der, &encryptedKey); err != nil {
+		t.Fatal(err)
+	}
+	if n := iterations(encryptedKey.AlgorithmIdentifier); n != 2000 {
+		t.Errorf("after WithIterations: got %d key encryption iterations, want 2000", n)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for zero iterations")
+		}
+	}()
+	Modern2023.WithComponentIterations(1, 0, 1)
+}
+
+func TestDoubleEncryptedKey(t *testing.T) {
+	// a PBES2 shrouded key bag inside a SafeContents encrypted using PBE
+	// with 3DES, both with the same password
+	pfxData, err := readFile("testdata/double-encrypted-key.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, cert, _, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "double.example.com" {
+		t.Errorf("got certificate %q, want double.example.com", cert.Subject.CommonName)
+	}
+	if err := publicKeyMatches(privateKey, cert); err != nil {
+		t.Error(err)
+	}
+	if _, _, _, err := DecodeChain(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestGenerateSalt(t *testing.T) {
+	salt, err := GenerateSalt(constReader(7), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(salt, bytes.Repeat([]byte{7}, 16)) {
+		t.Errorf("got salt %x", salt)
+	}
+	if _, err := GenerateSalt(bytes.NewReader(make([]byte, 8)), 16); err == nil {
+		t.Error("short read: expected an error")
+	}
+	if _, err := GenerateSalt(rand.Reader, -1); err == nil {
+		t.Error("negative length: expected an error")
+	}
+
+	// a MAC computed from a generated salt matches the encoder's
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+	macSalt, err := GenerateSalt(rand.Reader, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData, err := Modern2023.WithFixedSalt(nil, macSalt, nil).Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := parsePFX(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	mac, err := ComputeMAC(oidSHA256, authenticatedSafeBytes, []byte("password"), macSalt, pfx.MacData.Iterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mac, pfx.MacData.Mac.Digest) {
+		t.Error("MAC computed from the generated salt doesn't match")
+	}
+}
+
+func TestDecodeAuto(t *testing.T) {
+	// a PEM certificate followed by the PKCS#12 file made by
+	// openssl pkcs12 -export from the same certificate
+	hybrid, err := readFile("testdata/hybrid-pem-pfx.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certBlock, pfxData := pem.Decode(hybrid)
+	if certBlock == nil {
+		t.Fatal("fixture doesn't start with a PEM block")
+	}
+	pfxData = bytes.TrimLeft(pfxData, "\n")
+	armored := pem.EncodeToMemory(&pem.Block{Type: "PKCS12", Bytes: pfxData})
+
+	for name, data := range map[string][]byte{
+		"hybrid": hybrid,
+		"DER":    pfxData,
+		"PEM":    armored,
+	} {
+		privateKey, cert, _, err := DecodeAuto(data, "password")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(cert.Raw, certBlock.Bytes) {
+			t.Errorf("%s: got certificate %q, want the PEM one", name, cert.Subject.CommonName)
+		}
+		if err := publicKeyMatches(privateKey, cert); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if _, _, _, err := DecodeAuto(pem.EncodeToMemory(certBlock), "password"); err == nil {
+		t.Error("PEM certificate only: expected an error")
+	}
+	if _, _, _, err := DecodeAuto(hybrid, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestSM3MACKeyLength(t *testing.T) {
+	// encoded with ShangMi2024, then MACed with a 16-byte HMAC-SM3 key
+	// given as the INTEGER parameters of the SM3 MAC algorithm
+	pfxData, err := readFile("testdata/sm3-mac-keylength.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, cert, _, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "sm3-mac.example.com" {
+		t.Errorf("got certificate %q, want sm3-mac.example.com", cert.Subject.CommonName)
+	}
+	if _, ok := privateKey.(*sm2.PrivateKey); !ok {
+		t.Errorf("got key of type %T, want *sm2.PrivateKey", privateKey)
+	}
+	if _, _, _, err := DecodeChain(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestStripPrivateKey(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+	pfxData, err := LegacyDES.WithMatchedNames(true).Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stripped, err := StripPrivateKey(rand.Reader, pfxData, "password", "new password", Modern2023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := DecodeChain(stripped, "new password"); err == nil || !strings.Contains(err.Error(), "private key missing") {
+		t.Errorf("got %v, want a missing private key error", err)
+	}
+	encodedPassword, _ := bmpStringZeroTerminated("new password")
+	bags, _, err := defaultDecodeOptions.getSafeContents(stripped, encodedPassword, nil, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bags) != 2 {
+		t.Fatalf("got %d bags, want the two certificates", len(bags))
+	}
+	for i, want := range []*smx509.Certificate{cert, caCert} {
+		certsData, err := decodeCertBag(bags[i].Value.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(certsData, want.Raw) {
+			t.Errorf("bag #%d: got another certificate than %q", i, want.Subject.CommonName)
+		}
+		if bags[i].localKeyID() != nil {
+			t.Errorf("bag #%d: localKeyId was kept", i)
+		}
+	}
+	if name, _ := bags[0].friendlyName(); name != "leaf" {
+		t.Errorf("got friendlyName %q, want leaf", name)
+	}
+
+	if _, err := StripPrivateKey(rand.Reader, pfxData, "wrong", "new password", Modern2023); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestWithExplicitNullParams(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+
+	prfParams := func(alg pkix.AlgorithmIdentifier) []byte {
+		t.Helper()
+		var params pbes2Params
+		if err := unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			t.Fatal(err)
+		}
+		var kdfParams pbkdf2Params
+		if err := unmarshal(params.Kdf.Parameters.FullBytes, &kdfParams); err != nil {
+			t.Fatal(err)
+		}
+		return kdfParams.Prf.Parameters.FullBytes
+	}
+
+	for _, null := range []bool{false, true} {
+		var want []byte
+		if null {
+			want = []byte{5, 0}
+		}
+		pfxData, err := Modern2023.WithExplicitNullParams(null).Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pfx, err := parsePFX(pfxData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pfx.MacData.Mac.Algorithm.Parameters.FullBytes; !bytes.Equal(got, want) {
+			t.Errorf("null %v: got MAC algorithm parameters %x, want %x", null, got, want)
+		}
+		var authenticatedSafeBytes []byte
+		if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+			t.Fatal(err)
+		}
+		var authenticatedSafe []contentInfo
+		if err := unmarshal(authenticatedSafeBytes, &authenticatedSafe); err != nil {
+			t.Fatal(err)
+		}
+		var encryptedData encryptedData
+		if err := unmarshal(authenticatedSafe[0].Content.Bytes, &encryptedData); err != nil {
+			t.Fatal(err)
+		}
+		if got := prfParams(encryptedData.EncryptedContentInfo.ContentEncryptionAlgorithm); !bytes.Equal(got, want) {
+			t.Errorf("null %v: got certificate PRF parameters %x, want %x", null, got, want)
+		}
+		der, err := ExtractEncryptedKey(pfxData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var encryptedKey encryptedPrivateKeyInfo
+		if err := unmarshal(der, &encryptedKey); err != nil {
+			t.Fatal(err)
+		}
+		if got := prfParams(encryptedKey.AlgorithmIdentifier); !bytes.Equal(got, want) {
+			t.Errorf("null %v: got key PRF parameters %x, want %x", null, got, want)
+		}
+
+		decodedKey, _, _, err := DecodeChain(pfxData, "password")
+		if err != nil {
+			t.Fatalf("null %v: %v", null, err)
+		}
+		if !key.Equal(decodedKey) {
+			t.Errorf("null %v: decoded a different key", null)
+		}
+	}
+}
+
+func TestWithMACParamsNull(t *testing.T) {
+	key, cert := generateTestCertificate(t, "leaf", nil, nil)
+
+	for _, test := range []struct {
+		name string
+		enc  *Encoder
+		want []byte
+	}{
+		{"default", Modern2023, nil},
+		{"null", Modern2023.WithMACParamsNull(true), []byte{5, 0}},
+		{"absent", Modern2023.WithMACParamsNull(false), nil},
+		{"absent overrides explicit null", Modern2023.WithExplicitNullParams(true).WithMACParamsNull(false), nil},
+		{"null with SHA-1", LegacyDES.WithMACParamsNull(true), []byte{5, 0}},
+	} {
+		pfxData, err := test.enc.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		pfx, err := parsePFX(pfxData)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := pfx.MacData.Mac.Algorithm.Parameters.FullBytes; !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got MAC algorithm parameters %x, want %x", test.name, got, test.want)
+		}
+		if _, _, _, err := DecodeChain(pfxData, "password"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	// The PRF keeps the NULL chosen by WithExplicitNullParams.
+	pfxData, err := Modern2023.WithExplicitNullParams(true).WithMACParamsNull(false).Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(pfxData, []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x02, 0x09, 0x05, 0x00}) {
+		t.Error("hmacWithSHA256 PRF doesn't have NULL parameters")
+	}
+
+	// PBMAC1 parameters are never NULL.
+	pfxData, err = Modern2023.WithMACAlgorithm(OIDMACPBMAC1).WithMACParamsNull(true).Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := DecodeChain(pfxData, "password"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSM2KeyAsECPublicKey(t *testing.T) {
+	// generated with OpenSSL, which stores SM2 keys under id-ecPublicKey
+	// with the SM2 named curve:
+	// openssl genpkey -algorithm SM2 ...
+	// openssl pkcs12 -export ...
+	pfxData, err := readFile("testdata/sm2-ecpublickey.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, cert, _, info, err := DecodeChainWithInfo(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := privateKey.(*sm2.PrivateKey)
+	if !ok {
+		t.Fatalf("got key of type %T, want *sm2.PrivateKey", privateKey)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		t.Error("public key doesn't match the certificate")
+	}
+	oidPublicKeyEC := asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	if !info.KeyAlgorithm.Algorithm.Equal(oidPublicKeyEC) || !info.KeyCurve.Equal(asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301}) {
+		t.Errorf("got key algorithm %v on curve %v, want id-ecPublicKey on SM2", info.KeyAlgorithm.Algorithm, info.KeyCurve)
+	}
+
+	// the curve may also be only in the ECPrivateKey
+	ecKey, err := smx509.MarshalSM2PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkData, err := asn1.Marshal(pkcs8PrivateKeyInfo{
+		Algo:       pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyEC},
+		PrivateKey: ecKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parsePkcs8PrivateKey(pkData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedKey, ok := parsed.(*sm2.PrivateKey); !ok || !parsedKey.Equal(key) {
+		t.Errorf("without algorithm parameters: got key of type %T, want the same *sm2.PrivateKey", parsed)
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	_, cert := generateTestCertificate(t, "parse-error.example.com", nil, nil)
+	certBag, err := makeCertBag(cert.Raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a SEQUENCE whose first element is an INTEGER rather than a bag type
+	malformed := asn1.RawValue{FullBytes: []byte{0x30, 0x03, 0x02, 0x01, 0x00}}
+	goodBag, err := asn1.Marshal(*certBag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformedSafeContents, err := asn1.Marshal([]asn1.RawValue{{FullBytes: goodBag}, {FullBytes: goodBag}, malformed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestedBag := safeBag{
+		Id:    oidSafeContentsBag,
+		Value: asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: malformedSafeContents},
+	}
+
+	encodedPassword, err := bmpStringZeroTerminated("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := Modern2023.makeSafeContents(rand.Reader, []safeBag{*certBag}, Modern2023.certAlgorithm, encodedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := Modern2023.makeSafeContents(rand.Reader, []safeBag{*certBag}, nil, encodedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Content.Bytes, err = asn1.Marshal(malformedSafeContents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData := encodeTestAuthenticatedSafe(t, Modern2023, "password", []contentInfo{encrypted, plain})
+	_, _, _, err = DecodeChain(pfxData, "password")
+	if err == nil || !strings.Contains(err.Error(), "failed to parse safe bag #3 in content #2: ") {
+		t.Errorf("malformed bag in plaintext content: got %v", err)
+	}
+
+	encrypted, err = Modern2023.makeSafeContents(rand.Reader, []safeBag{*certBag, nestedBag}, Modern2023.certAlgorithm, encodedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfxData = encodeTestAuthenticatedSafe(t, Modern2023, "password", []contentInfo{encrypted})
+	_, _, _, err = DecodeChain(pfxData, "password")
+	if err == nil || !strings.Contains(err.Error(), "failed to parse safe bag #3 in safe bag #2 in encrypted content #1: ") {
+		t.Errorf("malformed nested bag: got %v", err)
+	}
+
+	// a wrong password is still reported as such
+	if _, _, _, err := DecodeChain(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestAttributeCertificates(t *testing.T) {
+	// an attribute certificate with a role attribute, holder and issuer
+	// named by their distinguished names
+	attrCert, err := readFile("testdata/attribute-cert.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PKCS#12 assigns no certificate type to attribute certificates; use
+	// one under the documentation enterprise number of RFC 5612
+	certType := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 1}
+
+	pfxData, err := Modern2023.EncodeAttributeCertificates([][]byte{attrCert, attrCert}, certType, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrCerts, err := DecodeAttributeCertificates(pfxData, "password", certType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrCerts) != 2 || !bytes.Equal(attrCerts[0], attrCert) || !bytes.Equal(attrCerts[1], attrCert) {
+		t.Errorf("got %d attribute certificates, want the 2 encoded ones", len(attrCerts))
+	}
+
+	if attrCerts, err := DecodeAttributeCertificates(pfxData, "password", asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 2}); err != nil || len(attrCerts) != 0 {
+		t.Errorf("other certificate type: got %d attribute certificates, %v", len(attrCerts), err)
+	}
+
+	// X.509 certificates are not returned
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	if attrCerts, err := DecodeAttributeCertificates(p12, "", certType); err != nil || len(attrCerts) != 0 {
+		t.Errorf("file without attribute certificates: got %d attribute certificates, %v", len(attrCerts), err)
+	}
+
+	if _, err := Modern2023.EncodeAttributeCertificates([][]byte{attrCert}, oidCertTypeX509Certificate, "password"); err == nil {
+		t.Error("encoding with the X.509 certificate type: got no error")
+	}
+	if _, err := Modern2023.EncodeAttributeCertificates([][]byte{[]byte("not DER")}, certType, "password"); err == nil {
+		t.Error("encoding a malformed attribute certificate: got no error")
+	}
+}
+
+func TestIgnoreMAC(t *testing.T) {
+	// the MAC is computed with "lost MAC password", but the contents are
+	// encrypted with "content password"
+	pfxData, err := readFile("testdata/mac-password-mismatch.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := DecodeChain(pfxData, "content password"); err != ErrIncorrectPassword {
+		t.Errorf("without IgnoreMAC: got %v, want ErrIncorrectPassword", err)
+	}
+
+	opts := &DecodeOptions{IgnoreMAC: true}
+	privateKey, certificate, _, err := opts.DecodeChain(pfxData, "content password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Subject.CommonName != "mac-mismatch.example.com" {
+		t.Errorf("got certificate %q", certificate.Subject.CommonName)
+	}
+	if err := publicKeyMatches(privateKey, certificate); err != nil {
+		t.Error(err)
+	}
+
+	if _, _, _, err := opts.DecodeChain(pfxData, "lost MAC password"); err != ErrDecryption {
+		t.Errorf("wrong content password: got %v, want ErrDecryption", err)
+	}
+}
+
+func TestWithContentTypeOID(t *testing.T) {
+	key, cert := generateTestCertificate(t, "content-type.example.com", nil, nil)
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 7}
+	pfxData, err := Modern2023.WithContentTypeOID(oid).Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx, err := parsePFX(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var authenticatedSafeBytes []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafeBytes); err != nil {
+		t.Fatal(err)
+	}
+	authenticatedSafe, err := parseAuthenticatedSafe(authenticatedSafeBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authenticatedSafe) != 2 || !authenticatedSafe[0].ContentType.Equal(oidEncryptedDataContentType) || !authenticatedSafe[1].ContentType.Equal(oid) {
+		t.Fatalf("unexpected content types in the authenticated safe")
+	}
+
+	if _, _, _, err := DecodeChain(pfxData, "password"); err == nil {
+		t.Error("decoding without ContentTypeOID: got no error")
+	}
+	opts := &DecodeOptions{ContentTypeOID: oid}
+	decodedKey, decodedCert, _, err := opts.DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decodedCert.Equal(cert) {
+		t.Error("got another certificate")
+	}
+	if err := publicKeyMatches(decodedKey, decodedCert); err != nil {
+		t.Error(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("WithContentTypeOID(nil) didn't panic")
+		}
+	}()
+	Modern2023.WithContentTypeOID(nil)
+}
+
+// testPasswordProvider is a PasswordProvider that records its calls.
+type testPasswordProvider struct {
+	password []byte
+	calls    []string
+}
+
+func (p *testPasswordProvider) Password() ([]byte, error) {
+	p.calls = append(p.calls, "Password")
+	return append([]byte(nil), p.password...), nil
+}
+
+func (p *testPasswordProvider) Zero() {
+	p.calls = append(p.calls, "Zero")
+}
+
+func TestPasswordProvider(t *testing.T) {
+	key, cert := generateTestCertificate(t, "provider.example.com", nil, nil)
+
+	provider := &testPasswordProvider{password: []byte("pässword")}
+	pfxData, err := Modern2023.EncodeWithProvider(key, cert, nil, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(provider.calls, ","); got != "Password,Zero" {
+		t.Errorf("encoding: got calls %q", got)
+	}
+	if _, _, _, err := DecodeChain(pfxData, "pässword"); err != nil {
+		t.Errorf("decoding with the string password: %v", err)
+	}
+
+	pfxData, err = LegacyRC2.EncodeWithProvider(key, cert, nil, StringPassword("pässword"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.calls = nil
+	_, decodedCert, _, _, err := DecodeChainWithProvider(pfxData, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decodedCert.Equal(cert) {
+		t.Error("got another certificate")
+	}
+	if got := strings.Join(provider.calls, ","); got != "Password,Zero" {
+		t.Errorf("decoding: got calls %q", got)
+	}
+
+	if _, _, _, _, err := DecodeChainWithProvider(pfxData, StringPassword("wrong")); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+
+	// invalid UTF-8 is encoded byte by byte, like bmpStringZeroTerminated does
+	for _, password := range []string{"pässword", "\xff\xfe", ""} {
+		got, err := bmpStringZeroTerminatedBytes([]byte(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := bmpStringZeroTerminated(password)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q: got %x, want %x", password, got, want)
+		}
+	}
+}
+
+func TestPBMAC1OneIteration(t *testing.T) {
+	// written by Modern2023.WithMACAlgorithm(OIDMACPBMAC1).WithIterations(1)
+	pfxData, err := readFile("testdata/pbmac1-one-iteration.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, certificate, _, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Subject.CommonName != "pbmac1-one.example.com" {
+		t.Errorf("got certificate %q", certificate.Subject.CommonName)
+	}
+	if _, _, _, err := DecodeChain(pfxData, "wrong"); err != ErrIncorrectPassword {
+		t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestWithBagOrder(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, cert := generateTestCertificate(t, "leaf", caCert, caKey)
+	encodedPassword, err := bmpStringZeroTerminated("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		enc  *Encoder
+		want []asn1.ObjectIdentifier
+	}{
+		{"default", DotNet, []asn1.ObjectIdentifier{oidCertBag, oidCertBag, oidPKCS8ShroundedKeyBag}},
+		{"CertFirst", DotNet.WithBagOrder(CertFirst), []asn1.ObjectIdentifier{oidCertBag, oidCertBag, oidPKCS8ShroundedKeyBag}},
+		{"KeyFirst", DotNet.WithBagOrder(KeyFirst), []asn1.ObjectIdentifier{oidPKCS8ShroundedKeyBag, oidCertBag, oidCertBag}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pfxData, err := test.enc.Encode(key, cert, []*smx509.Certificate{caCert}, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bags, _, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, defaultDecodeOptions.newKeyDeriver(), 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bags) != len(test.want) {
+				t.Fatalf("got %d bags, want %d", len(bags), len(test.want))
+			}
+			for i, bag := range bags {
+				if !bag.Id.Equal(test.want[i]) {
+					t.Errorf("bag %d: got type %v, want %v", i, bag.Id, test.want[i])
+				}
+			}
+			_, decodedCert, caCerts, err := DecodeChain(pfxData, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !decodedCert.Equal(cert) || len(caCerts) != 1 || !caCerts[0].Equal(caCert) {
+				t.Error("got other certificates")
+			}
+		})
+	}
+}
+
+func TestCreateIdentity(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "root", nil, nil)
+	intermediateKey, intermediate := generateTestCertificate(t, "intermediate", root, rootKey)
+	ecKey, ecLeaf := generateTestCertificate(t, "ec.example.com", intermediate, intermediateKey)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &smx509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "rsa.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := smx509.CreateCertificate(rand.Reader, template, intermediate, rsaKey.Public(), intermediateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaLeaf, err := smx509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  interface{}
+		leaf *smx509.Certificate
+	}{
+		{"RSA", rsaKey, rsaLeaf},
+		{"EC", ecKey, ecLeaf},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the chain is given root first
+			pfxData, err := CreateIdentity(test.key, test.leaf, []*smx509.Certificate{root, intermediate}, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			privateKey, certificate, caCerts, err := DecodeChain(pfxData, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !certificate.Equal(test.leaf) {
+				t.Error("got another end-entity certificate")
+			}
+			if err := publicKeyMatches(privateKey, certificate); err != nil {
+				t.Error(err)
+			}
+			if len(caCerts) != 2 || !caCerts[0].Equal(intermediate) || !caCerts[1].Equal(root) {
+				t.Error("CA certificates are not ordered from the leaf to the root")
+			}
+		})
+	}
+
+	if _, err := CreateIdentity(rsaKey, ecLeaf, nil, "password"); err != ErrKeyCertMismatch {
+		t.Errorf("mismatched key: got %v, want ErrKeyCertMismatch", err)
+	}
+}
+
+func TestSM2PublicKeyInPKCS8(t *testing.T) {
+	// an SM2 key whose OneAsymmetricKey (version 2 of PKCS#8) carries the
+	// public key, next to the one in its ECPrivateKey
+	pfxData, err := readFile("testdata/sm2-pkcs8-publickey.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, cert, _, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := privateKey.(*sm2.PrivateKey)
+	if !ok {
+		t.Fatalf("got key of type %T, want *sm2.PrivateKey", privateKey)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		t.Error("public key doesn't match the certificate")
+	}
+
+	otherKey, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8WithPublicKey := func(publicKey []byte) []byte {
+		pkData, err := smx509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pkInfo oneAsymmetricKey
+		if _, err := asn1.Unmarshal(pkData, &pkInfo); err != nil {
+			t.Fatal(err)
+		}
+		pkInfo.Version = 1
+		pkInfo.PublicKey = asn1.BitString{Bytes: publicKey, BitLength: 8 * len(publicKey)}
+		if pkData, err = asn1.Marshal(pkInfo); err != nil {
+			t.Fatal(err)
+		}
+		return pkData
+	}
+	if _, err := parsePkcs8PrivateKey(pkcs8WithPublicKey(elliptic.MarshalCompressed(key.Curve, key.X, key.Y))); err != nil {
+		t.Errorf("compressed public key: %v", err)
+	}
+	if _, err := parsePkcs8PrivateKey(pkcs8WithPublicKey(elliptic.Marshal(key.Curve, otherKey.X, otherKey.Y))); err == nil {
+		t.Error("public key of another key: got no error")
+	}
+	if _, err := parsePkcs8PrivateKey(pkcs8WithPublicKey([]byte{4, 1, 2, 3})); err == nil {
+		t.Error("malformed public key: got no error")
+	}
+}
+
+func TestDecodeTrustStoreValidAt(t *testing.T) {
+	// "Valid Root CA" (2020-2040), "Expired Root CA" (2000-2010),
+	// "Future Root CA" (2090-2100) and "Other Valid Root CA" (2015-2045)
+	pfxData, err := readFile("testdata/mixed-validity-truststore.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	certs, invalid, err := DecodeTrustStoreValidAt(pfxData, "password", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].Subject.CommonName != "Valid Root CA" || certs[1].Subject.CommonName != "Other Valid Root CA" {
+		t.Errorf("got %d valid certificates, want the 2 valid roots", len(certs))
+	}
+	if len(invalid) != 2 {
+		t.Fatalf("got %d invalid certificates, want 2", len(invalid))
+	}
+	for i, want := range []string{"Expired Root CA", "Future Root CA"} {
+		var certErr x509.CertificateInvalidError
+		if !errors.As(invalid[i], &certErr) || certErr.Reason != x509.Expired || certErr.Cert.Subject.CommonName != want {
+			t.Errorf("invalid certificate %d: got %v, want %s to be expired", i, invalid[i], want)
+		}
+	}
+
+	// DecodeTrustStore still returns every certificate
+	if certs, err := DecodeTrustStore(pfxData, "password"); err != nil || len(certs) != 4 {
+		t.Errorf("DecodeTrustStore: got %d certificates, %v", len(certs), err)
+	}
+}
+
+func TestWithLocalKeyID(t *testing.T) {
+	key, cert := generateTestCertificate(t, "inventory.example.com", nil, nil)
+	id := []byte("6f1c2a9e-3b47-4d0e-9a55-0c8e2f1d7b34")
+	pfxData, err := Modern2023.WithLocalKeyID(id).Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := DecodeEntries(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].PrivateKey == nil {
+		t.Fatalf("got %d entries, want the key entry", len(entries))
+	}
+	if !bytes.Equal(entries[0].LocalKeyID, id) {
+		t.Errorf("got localKeyId %q, want %q", entries[0].LocalKeyID, id)
+	}
+	if _, decodedCert, _, err := DecodeChain(pfxData, "password"); err != nil || !decodedCert.Equal(cert) {
+		t.Errorf("DecodeChain: %v", err)
+	}
+
+	// the default is the fingerprint of the certificate
+	pfxData, err = Modern2023.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = DecodeEntries(pfxData, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := sha1.Sum(cert.Raw); !bytes.Equal(entries[0].LocalKeyID, fingerprint[:]) {
+		t.Errorf("got localKeyId %x, want the fingerprint of the certificate", entries[0].LocalKeyID)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("WithLocalKeyID(nil) didn't panic")
+		}
+	}()
+	Modern2023.WithLocalKeyID(nil)
+}
+
+func TestEncryptedDataVersion2(t *testing.T) {
+	// the certificates are in an EncryptedData of version 2, with CMS
+	// unprotected attributes
+	pfxData, err := readFile("testdata/encrypteddata-v2.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, certificate, _, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Subject.CommonName != "encrypteddata-v2.example.com" {
+		t.Errorf("got certificate %q", certificate.Subject.CommonName)
+	}
+	if err := publicKeyMatches(privateKey, certificate); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	hasWarning := func(warnings []string, substr string) bool {
+		for _, w := range warnings {
+			if strings.Contains(w, substr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, test := range []struct {
+		password string
+		minBits  float64
+		maxBits  float64
+		warning  string
+	}{
+		{"", 0, 0, "empty"},
+		{DefaultPassword, 0, 10, "common"},
+		{"PassWord", 0, 10, "common"},
+		{"aaaaaaaaaaaaaaaa", 0, 10, "repeats"},
+		{"kxqzv", 20, 30, "5 characters"},
+		{"tvmqbhzkwrpg", 55, 60, "single class"},
+	} {
+		bits, warnings := EstimatePasswordStrength(test.password)
+		if bits < test.minBits || bits > test.maxBits {
+			t.Errorf("%q: got %.1f bits, want between %.0f and %.0f", test.password, bits, test.minBits, test.maxBits)
+		}
+		if !hasWarning(warnings, test.warning) {
+			t.Errorf("%q: got warnings %q, want one about %q", test.password, warnings, test.warning)
+		}
+	}
+
+	bits, warnings := EstimatePasswordStrength("c0rrect-H0rse-Battery-$taple")
+	if bits < 128 {
+		t.Errorf("got %.1f bits for a long mixed password, want at least 128", bits)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("got warnings %q for a long mixed password, want none", warnings)
+	}
+}
+
+// concurrencyReader is a random number generator that records how many
+// goroutines read from it at the same time.
+type concurrencyReader struct {
+	active, max int32
+}
+
+func (r *concurrencyReader) Read(p []byte) (int, error) {
+	n := atomic.AddInt32(&r.active, 1)
+	defer atomic.AddInt32(&r.active, -1)
+	for {
+		max := atomic.LoadInt32(&r.max)
+		if n <= max || atomic.CompareAndSwapInt32(&r.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return rand.Read(p)
+}
+
+func TestEncodeBatch(t *testing.T) {
+	const numJobs, concurrency = 40, 4
+
+	key, cert := generateTestCertificate(t, "Batch Leaf", nil, nil)
+	reader := new(concurrencyReader)
+	enc := Modern2023.WithIterations(1).WithRand(reader)
+
+	jobs := make([]EncodeJob, numJobs)
+	for i := range jobs {
+		jobs[i] = EncodeJob{PrivateKey: key, Certificate: cert, Password: fmt.Sprintf("password %d", i)}
+	}
+	jobs[7].PrivateKey = "not a key"
+
+	pfxData, errs := EncodeBatch(enc, jobs, concurrency)
+	if len(pfxData) != numJobs || len(errs) != numJobs {
+		t.Fatalf("got %d results and %d errors, want %d", len(pfxData), len(errs), numJobs)
+	}
+	for i := range jobs {
+		if i == 7 {
+			if errs[i] == nil {
+				t.Errorf("job %d: expected an error for an invalid private key", i)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("job %d: %v", i, errs[i])
+			continue
+		}
+		if _, _, err := Decode(pfxData[i], jobs[i].Password); err != nil {
+			t.Errorf("job %d: can't decode with the job's password: %v", i, err)
+		}
+	}
+	if max := atomic.LoadInt32(&reader.max); max > concurrency {
+		t.Errorf("%d jobs ran at the same time, want at most %d", max, concurrency)
+	}
+}
+
+func TestPBEWithSHAAnd128BitRC2CBCContent(t *testing.T) {
+	// generated with OpenSSL's legacy provider:
+	// openssl pkcs12 -export -legacy -certpbe PBE-SHA1-RC2-128 -keypbe PBE-SHA1-3DES -macalg sha1 ...
+	p12, err := readFile("testdata/rc2-128-certbag.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, cert, caCerts, info, err := DecodeChainWithInfo(p12, "rc2-128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "RC2-128 Leaf" {
+		t.Errorf("got common name %q, want RC2-128 Leaf", cert.Subject.CommonName)
+	}
+	if len(caCerts) != 0 {
+		t.Errorf("got %d CA certificates, want none", len(caCerts))
+	}
+	if err := publicKeyMatches(priv, cert); err != nil {
+		t.Error(err)
+	}
+	found := false
+	for _, w := range info.Warnings {
+		if w.Kind == WarningLegacyPBES1 && strings.Contains(w.Message, OIDPBEWithSHAAnd128BitRC2CBC.String()) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got warnings %v, want one about pbeWithSHAAnd128BitRC2-CBC", info.Warnings)
+	}
+
+	if _, _, err := Decode(p12, "wrong password"); err == nil {
+		t.Error("expected an error with a wrong password")
+	}
+}
+
+func TestTrustStoreType(t *testing.T) {
+	_, root1 := generateTestCertificate(t, "Editable Root CA 1", nil, nil)
+	_, root2 := generateTestCertificate(t, "Editable Root CA 2", nil, nil)
+	_, root3 := generateTestCertificate(t, "Editable Root CA 3", nil, nil)
+
+	var ts TrustStore
+	if !ts.Add(root1, "root1") || !ts.Add(root2, "") || !ts.Add(root3, "root3") {
+		t.Fatal("Add returned false for a new certificate")
+	}
+	if ts.Add(root1, "root1 again") {
+		t.Error("Add returned true for a duplicate certificate")
+	}
+	fingerprint := sha256.Sum256(root2.Raw)
+	if !ts.Remove(fingerprint[:]) {
+		t.Error("Remove returned false for a certificate in the trust store")
+	}
+	if ts.Remove(fingerprint[:]) {
+		t.Error("Remove returned true for a removed certificate")
+	}
+	if got := ts.Certs(); len(got) != 2 || !got[0].Equal(root1) || !got[1].Equal(root3) {
+		t.Fatalf("got %d certificates, want root1 and root3", len(got))
+	}
+
+	pfxData, err := ts.Marshal(rand.Reader, "password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := DecodeTrustStoreEntries(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].FriendlyName != "root1" || entries[1].FriendlyName != "root3" {
+		t.Fatalf("got entries %v, want root1 and root3", entries)
+	}
+
+	loaded, err := LoadTrustStore(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Add(root2, "") {
+		t.Error("Add returned false for a certificate not in the loaded trust store")
+	}
+	if loaded.Add(root3, "") {
+		t.Error("Add returned true for a certificate of the loaded trust store")
+	}
+	pfxData, err = loaded.Marshal(nil, "", Passwordless)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = DecodeTrustStoreEntries(pfxData, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].FriendlyName != root2.Subject.String() {
+		t.Errorf("got entries %v, want root1, root3 and root2", entries)
+	}
+}
+
+func TestDoubleWrappedCertificate(t *testing.T) {
+	// The certificate is DER in an OCTET STRING in the certValue of the
+	// cert bag, as written by some non-conformant tools.
+	p12, err := readFile("testdata/double-wrapped-cert.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, cert, caCerts, err := DecodeChain(p12, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "Double Wrapped Leaf" {
+		t.Errorf("got common name %q, want Double Wrapped Leaf", cert.Subject.CommonName)
+	}
+	if len(caCerts) != 0 {
+		t.Errorf("got %d CA certificates, want none", len(caCerts))
+	}
+	if err := publicKeyMatches(priv, cert); err != nil {
+		t.Error(err)
+	}
+
+	der := cert.Raw
+	for i := 0; i < maxCertificateWrapping+1; i++ {
+		if der, err = asn1.Marshal(der); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if unwrapped := unwrapCertificate(der); bytes.Equal(unwrapped, cert.Raw) {
+		t.Errorf("removed more than %d OCTET STRINGs", maxCertificateWrapping)
+	}
+}
+
+func TestEncodePreservesKeyIdentifiers(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "SKI Root CA", nil, nil)
+	key, leaf := generateTestCertificate(t, "SKI Leaf", root, rootKey)
+	if len(root.SubjectKeyId) == 0 || !bytes.Equal(leaf.AuthorityKeyId, root.SubjectKeyId) {
+		t.Fatal("test certificates aren't linked by their key identifiers")
+	}
+
+	pfxData, err := Modern2023.Encode(key, leaf, []*smx509.Certificate{root}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cert, caCerts, err := DecodeChain(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caCerts) != 1 || !bytes.Equal(caCerts[0].SubjectKeyId, root.SubjectKeyId) {
+		t.Error("the CA certificate lost its subject key identifier")
+	}
+	if !bytes.Equal(cert.AuthorityKeyId, root.SubjectKeyId) {
+		t.Error("the leaf certificate lost its authority key identifier")
+	}
+
+	pfxData, err = Modern2023.EncodeTrustStore([]*smx509.Certificate{root}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := DecodeTrustStore(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !bytes.Equal(certs[0].SubjectKeyId, root.SubjectKeyId) {
+		t.Error("the trusted certificate lost its subject key identifier")
+	}
+}
+
+func TestEncodeDualPassword(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "Rotation Root CA", nil, nil)
+	key, leaf := generateTestCertificate(t, "Rotation Leaf", root, rootKey)
+
+	for _, enc := range []*Encoder{LegacyDES, Modern2023, ShangMi2024} {
+		pfxData, err := enc.EncodeDualPassword(key, leaf, []*smx509.Certificate{root}, "new password", "old password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		priv, cert, caCerts, err := DecodeChain(pfxData, "new password")
+		if err != nil {
+			t.Fatalf("new password: %v", err)
+		}
+		if !cert.Equal(leaf) || len(caCerts) != 1 || !caCerts[0].Equal(root) || !key.Equal(priv) {
+			t.Error("new password: decoded key or certificates don't match")
+		}
+
+		if _, _, _, err := DecodeChain(pfxData, "old password"); err != ErrIncorrectPassword {
+			t.Errorf("old password: got %v, want the MAC to fail", err)
+		}
+		opts := &DecodeOptions{IgnoreMAC: true}
+		priv, cert, _, err = opts.DecodeChain(pfxData, "old password")
+		if err != nil {
+			t.Fatalf("old password: %v", err)
+		}
+		if !cert.Equal(leaf) || !key.Equal(priv) {
+			t.Error("old password: decoded key or certificate doesn't match")
+		}
+
+		if _, _, _, err := opts.DecodeChain(pfxData, "other password"); err == nil {
+			t.Error("expected an error with a password that shrouds neither key bag")
+		}
+	}
+
+	if _, err := Passwordless.EncodeDualPassword(key, leaf, nil, "", ""); err == nil {
+		t.Error("expected an error from an encoder that doesn't encrypt private keys")
+	}
+
+	// a second key bag with the same localKeyId is only skipped as a copy
+	// if it doesn't decrypt to another key
+	otherKey, _ := generateTestCertificate(t, "Other Leaf", root, rootKey)
+	keyID := []byte{1}
+	for _, test := range []struct {
+		name    string
+		second  safeBag
+		wantErr bool
+	}{
+		{"same key", testKeyBag(t, Modern2023, key, "password", keyID, ""), false},
+		{"other password", testKeyBag(t, Modern2023, otherKey, "other password", keyID, ""), false},
+		{"other key", testKeyBag(t, Modern2023, otherKey, "password", keyID, ""), true},
+	} {
+		pfxData := encodeTestBags(t, Modern2023, "password", []safeBag{
+			testCertBag(t, leaf, keyID, ""),
+			testKeyBag(t, Modern2023, key, "password", keyID, ""),
+			test.second,
+		})
+		priv, _, _, err := DecodeChain(pfxData, "password")
+		switch {
+		case test.wantErr && (err == nil || !strings.Contains(err.Error(), "expected exactly one key bag")):
+			t.Errorf("%s: got %v, want expected exactly one key bag", test.name, err)
+		case !test.wantErr && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case !test.wantErr && !key.Equal(priv):
+			t.Errorf("%s: decoded another key", test.name)
+		}
+	}
+}
+
+func TestDecodeInfoString(t *testing.T) {
+	for _, test := range []struct {
+		file, password, want string
+	}{
+		{"testdata/rc2-128-certbag.p12", "rc2-128", "pbeWithSHAAnd128BitRC2-CBC, 2048 iterations; pbeWithSHAAnd3-KeyTripleDES-CBC, 2048 iterations; SHA1 MAC, 2048 iterations; RSA 2048-bit key; 3 warnings"},
+		{"testdata/pbmac1-one-iteration.p12", "password", "PBES2/PBKDF2-HMAC-SHA256/AES-256-CBC, 1 iteration; PBMAC1/PBKDF2-HMAC-SHA256/HMAC-SHA256 MAC, 1 iteration; EC P-256 key; 1 warning"},
+	} {
+		pfxData, err := readFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, info, err := DecodeChainWithInfo(pfxData, test.password)
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		if got := info.String(); got != test.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", test.file, got, test.want)
+		}
+	}
+
+	key, cert := generateTestCertificate(t, "Unverified", nil, nil)
+	pfxData, err := ShangMi2024.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, info, err := (&DecodeOptions{IgnoreMAC: true}).DecodeChainWithInfo(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.String(), "PBES2/PBKDF2-HMAC-SM3/SM4-CBC, 2048 iterations; MAC not verified; EC P-256 key"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	info = &DecodeInfo{KeyAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 2}}}
+	if got, want := info.String(), "1.3.6.1.4.1.32473.2 key"; got != want {
+		t.Errorf("got %s for an unnamed algorithm, want %s", got, want)
+	}
+}
+
+func TestDecodeLargeElements(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "Large Root CA", nil, nil)
+	key, leaf := generateTestCertificate(t, "Large Leaf", root, rootKey)
+	chain, err := Modern2023.Encode(key, leaf, []*smx509.Certificate{root}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustStore, err := LegacyRC2.EncodeTrustStore([]*smx509.Certificate{root, leaf}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parse every container as if it were too large for encoding/asn1.
+	defer func(n int) { maxASN1Length = n }(maxASN1Length)
+	maxASN1Length = -1
+
+	priv, cert, caCerts, err := DecodeChain(chain, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(priv) || !cert.Equal(leaf) || len(caCerts) != 1 || !caCerts[0].Equal(root) {
+		t.Error("decoded key or certificates don't match")
+	}
+	certs, err := DecodeTrustStore(trustStore, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(root) || !certs[1].Equal(leaf) {
+		t.Error("decoded trust store doesn't match")
+	}
+	if _, _, _, err := DecodeChain(chain, "wrong password"); err != ErrIncorrectPassword {
+		t.Errorf("got %v with a wrong password, want ErrIncorrectPassword", err)
+	}
+	if _, err := DecodeTrustStore(trustStore[:len(trustStore)-1], "password"); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+}
+
+func TestSM4WithGenericEncoders(t *testing.T) {
+	key, cert := generateTestCertificate(t, "SM4 Content", nil, nil)
+	for _, test := range []struct {
+		enc  *Encoder
+		want string
+	}{
+		{
+			Modern2023.WithKeyBagCipher(OIDCipherSM4CBC).WithCertBagCipher(OIDCipherSM4CBC),
+			"PBES2/PBKDF2-HMAC-SHA256/SM4-CBC, 2048 iterations; SHA256 MAC, 2048 iterations; EC P-256 key",
+		},
+		{
+			LegacyDES.WithCertBagCipher(OIDCipherSM4CBC),
+			"PBES2/PBKDF2-HMAC-SHA256/SM4-CBC, 2048 iterations; pbeWithSHAAnd3-KeyTripleDES-CBC, 2048 iterations; SHA1 MAC, 1 iteration; EC P-256 key",
+		},
+	} {
+		pfxData, err := test.enc.Encode(key, cert, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, decodedCert, _, info, err := DecodeChainWithInfo(pfxData, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Equal(priv) || !decodedCert.Equal(cert) {
+			t.Error("decoded key or certificate doesn't match")
+		}
+		if got := info.String(); !strings.HasPrefix(got, test.want) {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
+
+func TestDecodeChainDER(t *testing.T) {
+	rootKey, root := generateTestCertificate(t, "DER Root CA", nil, nil)
+	intermediateKey, intermediate := generateTestCertificate(t, "DER Intermediate CA", root, rootKey)
+	key, leaf := generateTestCertificate(t, "DER Leaf", intermediate, intermediateKey)
+	pfxData, err := Modern2023.Encode(key, leaf, []*smx509.Certificate{intermediate, root}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, chainDER, err := DecodeChainDER(pfxData, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := smx509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(priv) {
+		t.Error("decoded key doesn't match")
+	}
+	certs, err := smx509.ParseCertificates(chainDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 {
+		t.Fatalf("got %d certificates, want 3", len(certs))
+	}
+	for i, want := range []*smx509.Certificate{leaf, intermediate, root} {
+		if !certs[i].Equal(want) {
+			t.Errorf("certificate #%d is %s, want %s", i, certs[i].Subject.CommonName, want.Subject.CommonName)
+		}
+	}
+
+	if _, _, err := DecodeChainDER(pfxData, "wrong password"); err != ErrIncorrectPassword {
+		t.Errorf("got %v with a wrong password, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestTruncatedInput(t *testing.T) {
+	p12, _ := base64.StdEncoding.DecodeString(testdata["testing@example.com"])
+	for _, n := range []int{0, 1, 2, 3, 4, 100, len(p12) / 2, len(p12) - 1} {
+		_, _, _, err := DecodeChain(p12[:n], "")
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d of %d bytes: got %v, want ErrTruncated", n, len(p12), err)
+		}
+		if _, err := ExtractEncryptedKey(p12[:n]); !errors.Is(err, ErrTruncated) {
+			t.Errorf("ExtractEncryptedKey, %d of %d bytes: got %v, want ErrTruncated", n, len(p12), err)
+		}
+	}
+
+	if _, _, _, err := DecodeChain(p12, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := DecodeChain(append(p12[:len(p12):len(p12)], 0), ""); err == nil || errors.Is(err, ErrTruncated) {
+		t.Errorf("got %v with trailing data, want an error other than ErrTruncated", err)
+	}
+	if _, _, _, err := DecodeChain([]byte("-----BEGIN CERTIFICATE-----"), ""); err == nil || errors.Is(err, ErrTruncated) {
+		t.Errorf("got %v for PEM, want an error other than ErrTruncated", err)
+	}
+}
+
+func TestUnknownCriticalExtension(t *testing.T) {
+	// The trust anchor has the critical extension 1.3.6.1.4.1.32473.493,
+	// which no parser knows.
+	p12, err := readFile("testdata/unknown-critical-extension.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := DecodeTrustStoreStrict(p12, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("got %d certificates, want 1", len(certs))
+	}
+	want := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 493}
+	if unhandled := certs[0].UnhandledCriticalExtensions; len(unhandled) != 1 || !unhandled[0].Equal(want) {
+		t.Errorf("got unhandled critical extensions %v, want %v", unhandled, want)
+	}
+}
+
+func TestValidateForEncode(t *testing.T) {
+	key, cert := generateTestCertificate(t, "Policy Leaf", nil, nil)
+	otherKey, _ := generateTestCertificate(t, "Other Leaf", nil, nil)
+	weakKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const strong = "Tr0ub4dor&3-horse-staple"
+	strongEnc := Modern2023.WithIterations(MinMACIterations)
+
+	for _, test := range []struct {
+		name     string
+		enc      *Encoder
+		key      interface{}
+		password string
+		wantErr  string
+	}{
+		{"valid", strongEnc, key, strong, ""},
+		{"valid passwordless", Passwordless, key, "", ""},
+		{"unsupported key", strongEnc, "not a key", strong, "unsupported private key type"},
+		{"weak key", strongEnc, weakKey, strong, "EC key is 224 bits"},
+		{"mismatched key", strongEnc, otherKey, strong, ErrKeyCertMismatch.Error()},
+		{"unencrypted key", strongEnc.WithKeyBagCipher(nil), key, strong, "doesn't encrypt the private key"},
+		{"no MAC", strongEnc.WithMACAlgorithm(nil), key, strong, "doesn't authenticate"},
+		{"weak cipher", LegacyRC2, key, strong, "pbeWithSHAAnd40BitRC2-CBC"},
+		{"PBES1", LegacyDES.WithIterations(MinMACIterations), key, strong, "legacy algorithm"},
+		{"SHA-1 MAC", strongEnc.WithMACAlgorithm(oidSHA1), key, strong, "HMAC-SHA-1"},
+		{"default iterations", Modern2023, key, strong, "MAC key with 2048 iterations"},
+		{"low iterations", Modern2023.WithIterations(100), key, strong, "MAC key with 100 iterations"},
+		{"low key iterations", Modern2023.WithComponentIterations(100, MinMACIterations, MinMACIterations), key, strong, "key encryption key with 100 iterations"},
+		{"common password", strongEnc, key, DefaultPassword, "common password"},
+		{"short password", strongEnc, key, "kxqzv", "5 characters"},
+		{"passwordless with password", Passwordless, key, strong, "password must be empty"},
+	} {
+		err := test.enc.ValidateForEncode(test.key, cert, test.password)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestDecompressContent(t *testing.T) {
+	// The AuthenticatedSafe is gzip-compressed, and the MAC is computed
+	// over the compressed bytes.
+	p12, err := readFile("testdata/gzip-content.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := DecodeChain(p12, "password"); err == nil {
+		t.Fatal("expected an error without DecompressContent")
+	}
+	opts := &DecodeOptions{DecompressContent: true}
+	priv, cert, _, err := opts.DecodeChain(p12, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "Compressed Archive Leaf" {
+		t.Errorf("got common name %q, want Compressed Archive Leaf", cert.Subject.CommonName)
+	}
+	if err := publicKeyMatches(priv, cert); err != nil {
+		t.Error(err)
+	}
+	if _, _, _, err := opts.DecodeChain(p12, "wrong password"); err != ErrIncorrectPassword {
+		t.Errorf("got %v with a wrong password, want ErrIncorrectPassword", err)
+	}
+
+	// Uncompressed files are decoded as usual.
+	key, cert := generateTestCertificate(t, "Uncompressed Leaf", nil, nil)
+	pfxData, err := Modern2023.Encode(key, cert, nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := opts.DecodeChain(pfxData, "password"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := gunzip(append(gzipMagic[:2:2], "not gzip"...)); err == nil {
+		t.Error("expected an error for a malformed gzip stream")
+	}
+
+	// A small stream can't expand beyond the limit.
+	var bomb bytes.Buffer
+	w := gzip.NewWriter(&bomb)
+	if _, err := w.Write(make([]byte, minDecompressedLimit+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gunzip(bomb.Bytes()); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("got %v for a stream longer than the limit, want an error about the limit", err)
+	}
+}
+
+func TestCertOnlyAlias(t *testing.T) {
+	// The key bag of "server" has no attributes: the friendlyName and
+	// localKeyId are only on its certificate bag.  The key bag of "other"
+	// comes first and has both.
+	p12, err := readFile("testdata/cert-only-alias.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := DecodeEntryByName(p12, "password", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.PrivateKey == nil {
+		t.Fatal("no private key in the entry")
+	}
+	if entry.Certificate.Subject.CommonName != "Cert-Only Alias Leaf" {
+		t.Errorf("got common name %q, want Cert-Only Alias Leaf", entry.Certificate.Subject.CommonName)
+	}
+	if err := publicKeyMatches(entry.PrivateKey, entry.Certificate); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(entry.LocalKeyID, []byte{1}) {
+		t.Errorf("got localKeyId %x, want 01", entry.LocalKeyID)
+	}
+
+	entry, err = DecodeEntryByName(p12, "password", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Certificate.Subject.CommonName != "Other Leaf" || publicKeyMatches(entry.PrivateKey, entry.Certificate) != nil {
+		t.Error("wrong key or certificate for other")
+	}
+
+	entries, err := DecodeEntries(p12, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].PrivateKey != nil || entries[2].DisplayName() != "Alias Test CA" {
+		t.Errorf("got %d entries, want two key entries and the CA certificate", len(entries))
+	}
+}
+
+func TestDecodeTrustStoreSorted(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert := func(serial int64, cn string, notBefore, notAfter int) *smx509.Certificate {
+		t.Helper()
+		template := &smx509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Date(notBefore, 1, 1, 0, 0, 0, 0, time.UTC),
+			NotAfter:              time.Date(notAfter, 1, 1, 0, 0, 0, 0, time.UTC),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+		}
+		der, err := smx509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := smx509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	// Certificates 1 and 2 expire together, 1 and 3 start together, and 2
+	// and 4 have the same subject.
+	certs := []*smx509.Certificate{
+		newCert(1, "Zeta CA", 2010, 2030),
+		newCert(2, "Alpha CA", 2015, 2030),
+		newCert(3, "Mid CA", 2010, 2025),
+		newCert(4, "Alpha CA", 2012, 2040),
+	}
+	pfxData, err := Modern2023.EncodeTrustStore(certs, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		by   SortKey
+		want []int64
+	}{
+		{ByExpiry, []int64{3, 2, 1, 4}},
+		{BySubject, []int64{2, 4, 3, 1}},
+		{ByNotBefore, []int64{3, 1, 4, 2}},
+	} {
+		sorted, err := DecodeTrustStoreSorted(pfxData, "password", test.by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, cert := range sorted {
+			got = append(got, cert.SerialNumber.Int64())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("sort key %d: got serial numbers %v, want %v", test.by, got, test.want)
+		}
+	}
+
+	if _, err := DecodeTrustStoreSorted(pfxData, "password", SortKey(3)); err == nil {
+		t.Error("expected an error for an unknown sort key")
+	}
+}
+
+func TestBrowserClientCert(t *testing.T) {
+	caKey, caCert := generateTestCertificate(t, "ca", nil, nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &smx509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alice@example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []smx509.ExtKeyUsage{smx509.ExtKeyUsageClientAuth},
+	}
+	der, err := smx509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := smx509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const password = "correct horse battery staple 42"
+	strongEnc := BrowserClientCert.WithIterations(MinMACIterations)
+	if err := strongEnc.ValidateForEncode(key, cert, password); err != nil {
+		t.Error(err)
+	}
+	serverKey, serverCert := generateTestCertificate(t, "server", caCert, caKey)
+	if err := strongEnc.ValidateForEncode(serverKey, serverCert, password); err == nil || !strings.Contains(err.Error(), "clientAuth") {
+		t.Errorf("got %v, want an error for a certificate without the clientAuth extended key usage", err)
+	}
+	if err := Modern2023.WithIterations(MinMACIterations).ValidateForEncode(serverKey, serverCert, password); err != nil {
+		t.Errorf("Modern2023: %v", err)
+	}
+	if _, err := BrowserClientCert.Encode(serverKey, serverCert, nil, password); err == nil || !strings.Contains(err.Error(), "clientAuth") {
+		t.Errorf("Encode: got %v, want an error for a certificate without the clientAuth extended key usage", err)
+	}
+
+	pfxData, err := BrowserClientCert.Encode(key, cert, []*smx509.Certificate{caCert}, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := parsePFX(pfxData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA256) {
+		t.Errorf("got MAC algorithm %v, want SHA-256", pfx.MacData.Mac.Algorithm.Algorithm)
+	}
+
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bags, _, err := defaultDecodeOptions.getSafeContents(pfxData, encodedPassword, nil, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bags) != 3 || !bags[2].Id.Equal(oidPKCS8ShroundedKeyBag) {
+		t.Fatalf("got %d bags, want the leaf and CA certificates and the key", len(bags))
+	}
+	if id := bags[2].localKeyID(); len(id) == 0 || !bytes.Equal(id, bags[0].localKeyID()) {
+		t.Errorf("got localKeyId %x on the key bag and %x on the certificate bag, want the same", id, bags[0].localKeyID())
+	}
+	for _, i := range []int{0, 2} {
+		if name, err := bags[i].friendlyName(); err != nil || name != "alice@example.com" {
+			t.Errorf("bag %d: got friendlyName %q (%v), want alice@example.com", i, name, err)
+		}
+	}
+
+	priv, leaf, _, err := DecodeChain(pfxData, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(priv) || !leaf.Equal(cert) {
+		t.Error("decoded a different key or certificate")
+	}
+}
@@ -6,10 +6,14 @@
 package pkcs12
 
 import (
+	"crypto/elliptic"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"errors"
 	"io"
+	"math/big"
 
+	"github.com/emmansun/gmsm/sm2"
 	"github.com/emmansun/gmsm/smx509"
 )
 
@@ -19,53 +23,227 @@ var (
 	oidKeyBag                  = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 10, 1, 1})
 	oidPKCS8ShroundedKeyBag    = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 10, 1, 2})
 	oidCertBag                 = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 10, 1, 3})
+	oidSecretBag               = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 10, 1, 5})
+	oidSafeContentsBag         = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 10, 1, 6})
+
+	oidRSASSAPSS = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 1, 10}) // rfc8017#appendix-C
 )
 
+// pkcs8PrivateKeyInfo is a PKCS#8 PrivateKeyInfo (rfc5208#section-5),
+// without its optional attributes.
+type pkcs8PrivateKeyInfo struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
 type certBag struct {
 	Id   asn1.ObjectIdentifier
 	Data []byte `asn1:"tag:0,explicit"`
 }
 
-func decodePkcs8ShroudedKeyBag(asn1Data, password []byte) (privateKey interface{}, err error) {
+//	SecretBag ::= SEQUENCE {
+//		secretTypeId   BAG-TYPE.&id ({SecretTypes}),
+//		secretValue    [0] EXPLICIT BAG-TYPE.&Type ({SecretTypes}{@secretTypeId})
+//	}
+type secretBag struct {
+	SecretTypeID asn1.ObjectIdentifier
+	SecretValue  asn1.RawValue // the [0] EXPLICIT element
+}
+
+// decodeSecretBag returns the type and value of the secret bag asn1Data.
+// A secret stored the way Java stores secret keys, as an OCTET STRING
+// holding a PKCS#8 EncryptedPrivateKeyInfo of type pkcs8ShroudedKeyBag, is
+// decrypted with password; its type is then the algorithm of the
+// PrivateKeyInfo, and its value the privateKey.  Otherwise, the value is the
+// content of an OCTET STRING secretValue, or the DER encoding of any other
+// secretValue.
+func decodeSecretBag(asn1Data, password []byte, kd *keyDeriver) (typeID asn1.ObjectIdentifier, value []byte, err error) {
+	bag := new(secretBag)
+	if err := unmarshal(asn1Data, bag); err != nil {
+		return nil, nil, errors.New("pkcs12: error decoding secret bag: " + err.Error())
+	}
+	var secretValue asn1.RawValue
+	if bag.SecretValue.Class != asn1.ClassContextSpecific || bag.SecretValue.Tag != 0 {
+		return nil, nil, errors.New("pkcs12: error decoding secret bag: missing secretValue")
+	}
+	if err := unmarshal(bag.SecretValue.Bytes, &secretValue); err != nil {
+		return nil, nil, errors.New("pkcs12: error decoding secret bag: " + err.Error())
+	}
+	value = secretValue.FullBytes
+	if secretValue.Class == asn1.ClassUniversal && secretValue.Tag == asn1.TagOctetString {
+		value = secretValue.Bytes
+	}
+	if !bag.SecretTypeID.Equal(oidPKCS8ShroundedKeyBag) {
+		return bag.SecretTypeID, value, nil
+	}
+
+	pkData, err := decryptPkcs8ShroudedKeyBag(value, password, kd)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pkInfo pkcs8PrivateKeyInfo
+	if _, err := asn1.Unmarshal(pkData, &pkInfo); err != nil {
+		return nil, nil, errors.New("pkcs12: error decoding secret key: " + err.Error())
+	}
+	return pkInfo.Algo.Algorithm, pkInfo.PrivateKey, nil
+}
+
+func decodePkcs8ShroudedKeyBag(asn1Data, password []byte, kd *keyDeriver) (privateKey interface{}, err error) {
+	pkData, err := decryptPkcs8ShroudedKeyBag(asn1Data, password, kd)
+	if err != nil {
+		return nil, err
+	}
+	return parsePkcs8PrivateKey(pkData)
+}
+
+// decryptPkcs8ShroudedKeyBag returns the PKCS#8 PrivateKeyInfo in the
+// shrouded key bag asn1Data.
+func decryptPkcs8ShroudedKeyBag(asn1Data, password []byte, kd *keyDeriver) (pkData []byte, err error) {
 	pkinfo := new(encryptedPrivateKeyInfo)
 	if err = unmarshal(asn1Data, pkinfo); err != nil {
 		return nil, errors.New("pkcs12: error decoding PKCS#8 shrouded key bag: " + err.Error())
 	}
 
-	pkData, err := pbDecrypt(pkinfo, password)
-	if err != nil {
+	pkData, err = pbDecrypt(pkinfo, password, kd)
+	if err == ErrDecryption {
+		return nil, ErrDecryption
+	} else if err != nil {
 		return nil, errors.New("pkcs12: error decrypting PKCS#8 shrouded key bag: " + err.Error())
 	}
 
+	// A wrong password occasionally yields valid padding, so make sure
+	// that the plaintext at least looks like a single DER element.
 	ret := new(asn1.RawValue)
 	if err = unmarshal(pkData, ret); err != nil {
-		return nil, errors.New("pkcs12: error unmarshaling decrypted private key: " + err.Error())
+		return nil, ErrDecryption
 	}
 
+	return pkData, nil
+}
+
+func parsePkcs8PrivateKey(pkData []byte) (privateKey interface{}, err error) {
+	// RSA keys restricted to RSASSA-PSS hold a plain RSAPrivateKey, but
+	// smx509 only accepts them under rsaEncryption.
+	var pkInfo pkcs8PrivateKeyInfo
+	if _, err := asn1.Unmarshal(pkData, &pkInfo); err == nil && pkInfo.Algo.Algorithm.Equal(oidRSASSAPSS) {
+		if privateKey, err = smx509.ParsePKCS1PrivateKey(pkInfo.PrivateKey); err != nil {
+			return nil, errors.New("pkcs12: error parsing PKCS#8 RSASSA-PSS private key: " + err.Error())
+		}
+		return privateKey, nil
+	}
 	if privateKey, err = smx509.ParsePKCS8PrivateKey(pkData); err != nil {
 		return nil, errors.New("pkcs12: error parsing PKCS#8 private key: " + err.Error())
 	}
-
+	if key, ok := privateKey.(*sm2.PrivateKey); ok {
+		if err := checkSM2PublicKey(pkData, key); err != nil {
+			return nil, err
+		}
+	}
 	return privateKey, nil
 }
 
+// oneAsymmetricKey is a PKCS#8 OneAsymmetricKey (rfc5958#section-2), which
+// extends PrivateKeyInfo with an optional public key.
+type oneAsymmetricKey struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+	Attributes asn1.RawValue  `asn1:"optional,tag:0"`
+	PublicKey  asn1.BitString `asn1:"optional,tag:1"`
+}
+
+// ecPrivateKey is a SEC 1 ECPrivateKey (rfc5915#section-3).
+type ecPrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+// checkSM2PublicKey checks that the public keys embedded in pkData, the
+// PKCS#8 encoding of key, are that of key.  Some GM exports carry the public
+// key in the OneAsymmetricKey, others in the ECPrivateKey; smx509 ignores
+// both and derives the public key from the private scalar.
+func checkSM2PublicKey(pkData []byte, key *sm2.PrivateKey) error {
+	var publicKeys [][]byte
+	var pkInfo oneAsymmetricKey
+	if _, err := asn1.Unmarshal(pkData, &pkInfo); err != nil {
+		return nil
+	}
+	if len(pkInfo.PublicKey.Bytes) != 0 {
+		publicKeys = append(publicKeys, pkInfo.PublicKey.RightAlign())
+	}
+	var ecKey ecPrivateKey
+	if _, err := asn1.Unmarshal(pkInfo.PrivateKey, &ecKey); err == nil && len(ecKey.PublicKey.Bytes) != 0 {
+		publicKeys = append(publicKeys, ecKey.PublicKey.RightAlign())
+	}
+
+	for _, publicKey := range publicKeys {
+		var x, y *big.Int
+		if len(publicKey) != 0 && publicKey[0] == 4 {
+			if pub, err := sm2.NewPublicKey(publicKey); err == nil {
+				x, y = pub.X, pub.Y
+			}
+		} else {
+			x, y = elliptic.UnmarshalCompressed(key.Curve, publicKey)
+		}
+		if x == nil {
+			return errors.New("pkcs12: malformed SM2 public key in PKCS#8 private key")
+		}
+		if x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+			return errors.New("pkcs12: SM2 public key in PKCS#8 private key doesn't match the private key")
+		}
+	}
+	return nil
+}
+
+// pkcs8NamedCurve returns the named curve of the EC private key in the PKCS#8
+// PrivateKeyInfo pkData, or nil if it isn't an EC key with a named curve.
+// The curve is taken from the algorithm parameters or, if they are absent,
+// from the parameters of the ECPrivateKey (rfc5915#section-3).
+func pkcs8NamedCurve(pkData []byte) asn1.ObjectIdentifier {
+	var pkInfo pkcs8PrivateKeyInfo
+	if _, err := asn1.Unmarshal(pkData, &pkInfo); err != nil {
+		return nil
+	}
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(pkInfo.Algo.Parameters.FullBytes, &curve); err == nil {
+		return curve
+	}
+	var ecKey struct {
+		Version       int
+		PrivateKey    []byte
+		NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(pkInfo.PrivateKey, &ecKey); err != nil {
+		return nil
+	}
+	return ecKey.NamedCurveOID
+}
+
 func (encoder *Encoder) encodePkcs8ShroudedKeyBag(rand io.Reader, privateKey interface{}, password []byte) (asn1Data []byte, err error) {
 	var pkData []byte
 	if pkData, err = smx509.MarshalPKCS8PrivateKey(privateKey); err != nil {
 		return nil, errors.New("pkcs12: error encoding PKCS#8 private key: " + err.Error())
 	}
+	return encoder.encryptPkcs8(rand, pkData, password)
+}
 
-	randomSalt := make([]byte, encoder.saltLen)
-	if _, err = rand.Read(randomSalt); err != nil {
+// encryptPkcs8 encrypts the PKCS#8 PrivateKeyInfo pkData into an
+// EncryptedPrivateKeyInfo, using the key encryption algorithm of encoder.
+func (encoder *Encoder) encryptPkcs8(rand io.Reader, pkData, password []byte) (asn1Data []byte, err error) {
+	randomSalt, err := encoder.newSalt(rand)
+	if err != nil {
 		return nil, errors.New("pkcs12: error reading random salt: " + err.Error())
 	}
 	var paramBytes []byte
 	if encoder.keyAlgorithm.Equal(oidPBES2) {
-		if paramBytes, err = makePBES2Parameters(encoder.kdfPrf, encoder.encryptionScheme, rand, randomSalt, encoder.encryptionIterations); err != nil {
+		if paramBytes, err = makePBES2Parameters(encoder.kdfPrf, encoder.keyEncryptionScheme, encoder.ivSource(rand), randomSalt, encoder.keyEncryptionIterations(), encoder.explicitNullParams); err != nil {
 			return nil, errors.New("pkcs12: error encoding params: " + err.Error())
 		}
 	} else {
-		if paramBytes, err = asn1.Marshal(pbeParams{Salt: randomSalt, Iterations: encoder.encryptionIterations}); err != nil {
+		if paramBytes, err = asn1.Marshal(pbeParams{Salt: randomSalt, Iterations: encoder.keyEncryptionIterations()}); err != nil {
 			return nil, errors.New("pkcs12: error encoding params: " + err.Error())
 		}
 	}
@@ -85,6 +263,46 @@ func (encoder *Encoder) encodePkcs8ShroudedKeyBag(rand io.Reader, privateKey int
 	return asn1Data, nil
 }
 
+// RewrapPKCS8 decrypts der, a DER-encoded PKCS#8 EncryptedPrivateKeyInfo
+// protected with oldPassword, and encrypts the private key again with
+// newPassword, using the key encryption algorithm and parameters of enc.
+// The private key itself is not modified.  It returns the new
+// EncryptedPrivateKeyInfo, DER-encoded.
+//
+// This is useful to upgrade key files protected with a legacy PKCS#12 PBE
+// scheme to PBES2, e.g. with [Modern2023].
+func RewrapPKCS8(rand io.Reader, der []byte, oldPassword, newPassword string, enc *Encoder) ([]byte, error) {
+	if enc.keyAlgorithm == nil {
+		return nil, errors.New("pkcs12: encoder does not encrypt private keys")
+	}
+
+	encodedOldPassword, err := bmpStringZeroTerminated(oldPassword)
+	if err != nil {
+		return nil, err
+	}
+	encodedNewPassword, err := bmpStringZeroTerminated(newPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	pkinfo := new(encryptedPrivateKeyInfo)
+	if err := unmarshal(der, pkinfo); err != nil {
+		return nil, errors.New("pkcs12: error decoding PKCS#8 encrypted private key: " + err.Error())
+	}
+	pkData, err := pbDecrypt(pkinfo, encodedOldPassword, nil)
+	if err == ErrDecryption {
+		return nil, ErrIncorrectPassword
+	} else if err != nil {
+		return nil, errors.New("pkcs12: error decrypting PKCS#8 private key: " + err.Error())
+	}
+	// a wrong password can still yield valid padding
+	if _, err := parsePkcs8PrivateKey(pkData); err != nil {
+		return nil, ErrIncorrectPassword
+	}
+
+	return enc.encryptPkcs8(rand, pkData, encodedNewPassword)
+}
+
 func decodeCertBag(asn1Data []byte) (x509Certificates []byte, err error) {
 	bag := new(certBag)
 	if err := unmarshal(asn1Data, bag); err != nil {
@@ -93,7 +311,25 @@ func decodeCertBag(asn1Data []byte) (x509Certificates []byte, err error) {
 	if !bag.Id.Equal(oidCertTypeX509Certificate) {
 		return nil, NotImplementedError("only X509 certificates are supported")
 	}
-	return bag.Data, nil
+	return unwrapCertificate(bag.Data), nil
+}
+
+// maxCertificateWrapping is the number of nested OCTET STRINGs that
+// unwrapCertificate removes.
+const maxCertificateWrapping = 4
+
+// unwrapCertificate removes the OCTET STRINGs that some non-conformant
+// tools wrap a certificate in, in addition to the one of the cert bag.  A
+// certificate is a SEQUENCE, so it can't be mistaken for an OCTET STRING.
+func unwrapCertificate(der []byte) []byte {
+	for i := 0; i < maxCertificateWrapping; i++ {
+		var inner []byte
+		if err := unmarshal(der, &inner); err != nil {
+			break
+		}
+		der = inner
+	}
+	return der
 }
 
 func encodeCertBag(x509Certificates []byte) (asn1Data []byte, err error) {
@@ -0,0 +1,54 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+)
+
+// SelfTest checks that pfxData survives a round trip through this package:
+// it decodes pfxData with [DecodeChain], encodes the result again with
+// [Modern2023] and the same password, decodes that, and returns an error
+// describing the first difference between the two decodings, if any.  The
+// private keys must be equal, and the certificates must be identical and in
+// the same order.  It is meant to check generated files before they are
+// distributed.
+func SelfTest(pfxData []byte, password string) error {
+	privateKey, certificate, caCerts, err := DecodeChain(pfxData, password)
+	if err != nil {
+		return errors.New("pkcs12: self-test: decoding: " + err.Error())
+	}
+	reencoded, err := Modern2023.Encode(privateKey, certificate, caCerts, password)
+	if err != nil {
+		return errors.New("pkcs12: self-test: encoding: " + err.Error())
+	}
+	privateKey2, certificate2, caCerts2, err := DecodeChain(reencoded, password)
+	if err != nil {
+		return errors.New("pkcs12: self-test: decoding the re-encoded file: " + err.Error())
+	}
+
+	key, ok := privateKey.(interface{ Equal(crypto.PrivateKey) bool })
+	if !ok {
+		return NotImplementedError(fmt.Sprintf("self-test: unsupported private key type: %T", privateKey))
+	}
+	if !key.Equal(privateKey2) {
+		return errors.New("pkcs12: self-test: private key differs after re-encoding")
+	}
+	if !bytes.Equal(certificate.Raw, certificate2.Raw) {
+		return errors.New("pkcs12: self-test: certificate differs after re-encoding")
+	}
+	if len(caCerts) != len(caCerts2) {
+		return fmt.Errorf("pkcs12: self-test: %d CA certificates after re-encoding, want %d", len(caCerts2), len(caCerts))
+	}
+	for i := range caCerts {
+		if !bytes.Equal(caCerts[i].Raw, caCerts2[i].Raw) {
+			return fmt.Errorf("pkcs12: self-test: CA certificate #%d differs after re-encoding", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/emmansun/gmsm/pkcs7"
+	"github.com/emmansun/gmsm/sm2"
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// EncodeSigned is like [Encoder.Encode], but uses PKCS#12's public-key
+// integrity mode: instead of being authenticated with a MAC, the
+// AuthenticatedSafe is wrapped in a PKCS#7 signedData signed by signer,
+// whose certificate signerCert is included in the signedData.  The password
+// is still used to encrypt the contents.
+//
+// The signature uses SM3 if signerCert has an SM2 public key, and SHA-256
+// otherwise.  Decoding the result requires [DecodeOptions.SignerCertificate]
+// to verify the signature, or [DecodeOptions.IgnoreSignature].
+func (enc *Encoder) EncodeSigned(signer crypto.Signer, signerCert *smx509.Certificate, privateKey interface{}, certificate *smx509.Certificate, caCerts []*smx509.Certificate, password string) (pfxData []byte, err error) {
+	if enc.certAlgorithm == nil && enc.keyAlgorithm == nil && password != "" {
+		return nil, errors.New("password must be empty")
+	}
+
+	if err := checkPrivateKeyType(privateKey); err != nil {
+		return nil, err
+	}
+
+	encodedPassword, err := enc.encodePassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticatedSafe, err := enc.makeAuthenticatedSafe(privateKey, certificate, caCerts, encodedPassword, nil)
+	if err != nil {
+		return nil, err
+	}
+	authenticatedSafeBytes, err := asn1.Marshal(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	signedData, err := pkcs7.NewSignedData(authenticatedSafeBytes)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := signerCert.PublicKey.(*ecdsa.PublicKey); ok && pub.Curve == sm2.P256() {
+		signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSM3)
+	} else {
+		signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	}
+	if err = signedData.AddSigner(signerCert, signer, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, errors.New("pkcs12: error signing P12 data: " + err.Error())
+	}
+	signedBytes, err := signedData.Finish()
+	if err != nil {
+		return nil, errors.New("pkcs12: error signing P12 data: " + err.Error())
+	}
+
+	var pfx pfxPdu
+	pfx.Version = 3
+	if err = unmarshal(signedBytes, &pfx.AuthSafe); err != nil {
+		return nil, err
+	}
+
+	if pfxData, err = asn1.Marshal(pfx); err != nil {
+		return nil, errors.New("pkcs12: error writing P12 data: " + err.Error())
+	}
+	if err = enc.checkOutputSize(pfxData); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// verifySignedData returns the AuthenticatedSafe encapsulated in the
+// signedData authSafe, after verifying its signature against
+// opts.SignerCertificate, unless opts.IgnoreSignature is set and there is
+// no SignerCertificate.
+func (opts *DecodeOptions) verifySignedData(authSafe contentInfo) ([]byte, error) {
+	der, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, errors.New("pkcs12: error reading signedData: " + err.Error())
+	}
+	if opts.SignerCertificate == nil && !opts.IgnoreSignature {
+		return nil, fmt.Errorf("%w: no SignerCertificate to verify it with", ErrInvalidSignature)
+	}
+	if opts.SignerCertificate != nil {
+		if len(p7.Signers) != 1 {
+			return nil, ErrInvalidSignature
+		}
+		// Look up the signer in the expected certificate first, so that a
+		// certificate embedded in the signedData can't take its place.
+		p7.Certificates = append([]*smx509.Certificate{opts.SignerCertificate}, p7.Certificates...)
+		if signer := p7.GetOnlySigner(); signer == nil || !signer.Equal(opts.SignerCertificate) {
+			return nil, ErrInvalidSignature
+		}
+		if err := p7.Verify(); err != nil {
+			return nil, ErrInvalidSignature
+		}
+	}
+	return p7.Content, nil
+}
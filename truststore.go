@@ -0,0 +1,532 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// A TrustStore is a mutable set of trusted CA certificates that can be
+// loaded from and marshaled to a PKCS#12 trust store, to edit trust stores
+// without handling their entries directly.  The zero value is an empty
+// TrustStore ready to use.  A TrustStore isn't safe for concurrent use.
+type TrustStore struct {
+	entries []TrustStoreEntry
+}
+
+// LoadTrustStore decodes a trust store, as [DecodeTrustStoreEntries] does,
+// into a TrustStore.  If a certificate appears more than once, only its
+// first entry is kept.
+func LoadTrustStore(pfxData []byte, password string) (*TrustStore, error) {
+	return defaultDecodeOptions.LoadTrustStore(pfxData, password)
+}
+
+// LoadTrustStore is like the package-level [LoadTrustStore], but uses the options in opts.
+func (opts *DecodeOptions) LoadTrustStore(pfxData []byte, password string) (*TrustStore, error) {
+	entries, err := opts.DecodeTrustStoreEntries(pfxData, password)
+	if err != nil {
+		return nil, err
+	}
+	ts := new(TrustStore)
+	for _, entry := range entries {
+		ts.add(entry)
+	}
+	return ts, nil
+}
+
+// Add adds cert to ts with the given friendly name, or with the Subject of
+// cert if friendlyName is empty, as [Encoder.EncodeTrustStore] does.  The
+// certificate is trusted for any extended key usage.  Add reports whether
+// cert was added: if ts already contains the same certificate, it's left
+// unchanged.
+func (ts *TrustStore) Add(cert *smx509.Certificate, friendlyName string) bool {
+	if friendlyName == "" {
+		friendlyName = cert.Subject.String()
+	}
+	return ts.add(TrustStoreEntry{Cert: cert, FriendlyName: friendlyName})
+}
+
+func (ts *TrustStore) add(entry TrustStoreEntry) bool {
+	if ts.index(sha256.Sum256(entry.Cert.Raw)) >= 0 {
+		return false
+	}
+	ts.entries = append(ts.entries, entry)
+	return true
+}
+
+// Remove removes the certificate whose SHA-256 fingerprint, i.e. the
+// SHA-256 digest of its DER encoding, is fingerprint.  It reports whether
+// there was such a certificate.
+func (ts *TrustStore) Remove(fingerprint []byte) bool {
+	if len(fingerprint) != sha256.Size {
+		return false
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], fingerprint)
+	i := ts.index(digest)
+	if i < 0 {
+		return false
+	}
+	ts.entries = append(ts.entries[:i], ts.entries[i+1:]...)
+	return true
+}
+
+// index returns the index of the entry whose certificate has the SHA-256
+// fingerprint digest, or -1.
+func (ts *TrustStore) index(digest [sha256.Size]byte) int {
+	for i, entry := range ts.entries {
+		if sha256.Sum256(entry.Cert.Raw) == digest {
+			return i
+		}
+	}
+	return -1
+}
+
+// Certs returns the certificates of ts, in the order in which they were
+// added.
+func (ts *TrustStore) Certs() []*smx509.Certificate {
+	return trustStoreCertificates(ts.entries)
+}
+
+// Marshal encodes ts with enc.EncodeTrustStoreEntries, reading random
+// numbers from rand if it isn't nil.  If enc is nil, [Modern2023] is used.
+func (ts *TrustStore) Marshal(rand io.Reader, password string, enc *Encoder) (pfxData []byte, err error) {
+	if enc == nil {
+		enc = Modern2023
+	}
+	if rand != nil {
+		enc = enc.WithRand(rand)
+	}
+	return enc.EncodeTrustStoreEntries(ts.entries, password)
+}
+
+// DecodeTrustStore extracts the certificates from pfxData, which must be a DER-encoded
+// PKCS#12 file containing exclusively certificates with attribute 2.16.840.1.113894.746875.1.1,
+// which is used by Java to designate a trust anchor.
+//
+// If the password argument is empty, DecodeTrustStore will decode either password-less
+// PKCS#12 files (i.e. those without encryption) or files with a literal empty password.
+//
+// Certificates that can't be parsed are skipped, so that a single corrupt
+// certificate doesn't prevent the others from being used.  To find out which
+// certificates were skipped, use [DecodeTrustStoreWithWarnings]; to fail
+// instead, use [DecodeTrustStoreStrict].  Certificates with critical
+// extensions that smx509 doesn't handle are not skipped: they parse, and
+// list these extensions in UnhandledCriticalExtensions, which the caller
+// should check before trusting them.
+func DecodeTrustStore(pfxData []byte, password string) (certs []*smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeTrustStore(pfxData, password)
+}
+
+// DecodeTrustStore is like the package-level [DecodeTrustStore], but uses the options in opts.
+func (opts *DecodeOptions) DecodeTrustStore(pfxData []byte, password string) (certs []*smx509.Certificate, err error) {
+	entries, _, err := opts.decodeTrustStore(pfxData, password, false)
+	return trustStoreCertificates(entries), err
+}
+
+// DecodeTrustStoreWithWarnings is like [DecodeTrustStore], but also returns a
+// warning of kind [WarningUnparseableCertificate] for every certificate that
+// was skipped, one of kind [WarningUnparseableFriendlyName] for every
+// friendly name that was ignored, and warnings about weak protection of the file, such as
+// [WarningLowMACIterations].
+func DecodeTrustStoreWithWarnings(pfxData []byte, password string) (certs []*smx509.Certificate, warnings []Warning, err error) {
+	return defaultDecodeOptions.DecodeTrustStoreWithWarnings(pfxData, password)
+}
+
+// DecodeTrustStoreWithWarnings is like the package-level [DecodeTrustStoreWithWarnings], but uses the options in opts.
+func (opts *DecodeOptions) DecodeTrustStoreWithWarnings(pfxData []byte, password string) (certs []*smx509.Certificate, warnings []Warning, err error) {
+	entries, warnings, err := opts.decodeTrustStore(pfxData, password, false)
+	return trustStoreCertificates(entries), warnings, err
+}
+
+// DecodeTrustStoreStrict is like [DecodeTrustStore], but returns an error if
+// any of the certificates or of their friendly names can't be parsed.
+func DecodeTrustStoreStrict(pfxData []byte, password string) (certs []*smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeTrustStoreStrict(pfxData, password)
+}
+
+// DecodeTrustStoreStrict is like the package-level [DecodeTrustStoreStrict], but uses the options in opts.
+func (opts *DecodeOptions) DecodeTrustStoreStrict(pfxData []byte, password string) (certs []*smx509.Certificate, err error) {
+	entries, _, err := opts.decodeTrustStore(pfxData, password, true)
+	return trustStoreCertificates(entries), err
+}
+
+// DecodeTrustStoreValidAt is like [DecodeTrustStore], but only returns the
+// certificates that are valid at t, e.g. to prune stale CAs on import.  For
+// every other certificate, invalid lists an [x509.CertificateInvalidError]
+// with reason [x509.Expired], which tells whether t is before or after its
+// validity period.  Certificates that can't be parsed are skipped, as with
+// DecodeTrustStore.
+func DecodeTrustStoreValidAt(pfxData []byte, password string, t time.Time) (certs []*smx509.Certificate, invalid []error, err error) {
+	return defaultDecodeOptions.DecodeTrustStoreValidAt(pfxData, password, t)
+}
+
+// DecodeTrustStoreValidAt is like the package-level [DecodeTrustStoreValidAt], but uses the options in opts.
+func (opts *DecodeOptions) DecodeTrustStoreValidAt(pfxData []byte, password string, t time.Time) (certs []*smx509.Certificate, invalid []error, err error) {
+	entries, _, err := opts.decodeTrustStore(pfxData, password, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, cert := range trustStoreCertificates(entries) {
+		switch {
+		case t.Before(cert.NotBefore):
+			invalid = append(invalid, x509.CertificateInvalidError{
+				Cert:   cert.ToX509(),
+				Reason: x509.Expired,
+				Detail: fmt.Sprintf("%s is before %s", t.Format(time.RFC3339), cert.NotBefore.Format(time.RFC3339)),
+			})
+		case t.After(cert.NotAfter):
+			invalid = append(invalid, x509.CertificateInvalidError{
+				Cert:   cert.ToX509(),
+				Reason: x509.Expired,
+				Detail: fmt.Sprintf("%s is after %s", t.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339)),
+			})
+		default:
+			certs = append(certs, cert)
+		}
+	}
+	return certs, invalid, nil
+}
+
+// A SortKey is an order of the certificates returned by
+// [DecodeTrustStoreSorted].
+type SortKey int
+
+const (
+	// ByExpiry sorts the certificates by NotAfter, soonest-expiring first.
+	ByExpiry SortKey = iota
+	// BySubject sorts the certificates by the string form of their
+	// Subject, as returned by [pkix.Name.String].
+	BySubject
+	// ByNotBefore sorts the certificates by NotBefore, oldest first.
+	ByNotBefore
+)
+
+// DecodeTrustStoreSorted is like [DecodeTrustStore], but returns the
+// certificates sorted by the given key, e.g. to list the soonest-expiring
+// CAs first.  Certificates with equal dates are sorted by subject, and
+// those with equal subjects keep the order in which they appear in pfxData.
+func DecodeTrustStoreSorted(pfxData []byte, password string, by SortKey) (certs []*smx509.Certificate, err error) {
+	return defaultDecodeOptions.DecodeTrustStoreSorted(pfxData, password, by)
+}
+
+// DecodeTrustStoreSorted is like the package-level [DecodeTrustStoreSorted], but uses the options in opts.
+func (opts *DecodeOptions) DecodeTrustStoreSorted(pfxData []byte, password string, by SortKey) (certs []*smx509.Certificate, err error) {
+	if by < ByExpiry || by > ByNotBefore {
+		return nil, fmt.Errorf("pkcs12: unknown sort key %d", by)
+	}
+	if certs, err = opts.DecodeTrustStore(pfxData, password); err != nil {
+		return nil, err
+	}
+
+	subjects := make(map[*smx509.Certificate]string, len(certs))
+	for _, cert := range certs {
+		subjects[cert] = cert.Subject.String()
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		a, b := certs[i], certs[j]
+		switch by {
+		case ByExpiry:
+			if !a.NotAfter.Equal(b.NotAfter) {
+				return a.NotAfter.Before(b.NotAfter)
+			}
+		case ByNotBefore:
+			if !a.NotBefore.Equal(b.NotBefore) {
+				return a.NotBefore.Before(b.NotBefore)
+			}
+		}
+		return subjects[a] < subjects[b]
+	})
+	return certs, nil
+}
+
+// DecodeTrustStoreEntries is like [DecodeTrustStore], but returns the
+// Friendly Name (Alias) and the trusted extended key usages of every
+// certificate along with it.
+func DecodeTrustStoreEntries(pfxData []byte, password string) (entries []TrustStoreEntry, err error) {
+	return defaultDecodeOptions.DecodeTrustStoreEntries(pfxData, password)
+}
+
+// DecodeTrustStoreEntries is like the package-level [DecodeTrustStoreEntries], but uses the options in opts.
+func (opts *DecodeOptions) DecodeTrustStoreEntries(pfxData []byte, password string) (entries []TrustStoreEntry, err error) {
+	entries, _, err = opts.decodeTrustStore(pfxData, password, false)
+	return
+}
+
+func trustStoreCertificates(entries []TrustStoreEntry) []*smx509.Certificate {
+	var certs []*smx509.Certificate
+	for _, entry := range entries {
+		certs = append(certs, entry.Cert)
+	}
+	return certs
+}
+
+func (opts *DecodeOptions) decodeTrustStore(pfxData []byte, password string, strict bool) (entries []TrustStoreEntry, warnings []Warning, err error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, nil, opts.passwordError(pfxData, err)
+	}
+
+	kd := opts.newKeyDeriverFor(password)
+	bags, _, err := opts.getSafeContents(pfxData, encodedPassword, kd, 1, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings = kd.warnings
+
+	for i, bag := range bags {
+		switch {
+		case bag.Id.Equal(oidCertBag):
+			if !bag.hasAttribute(oidJavaTrustStore) {
+				return nil, nil, errors.New("pkcs12: trust store contains a certificate that is not marked as trusted")
+			}
+			certsData, err := decodeCertBag(bag.Value.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			parsedCerts, err := smx509.ParseCertificates(certsData)
+			if err == nil && len(parsedCerts) != 1 {
+				err = errors.New("pkcs12: expected exactly one certificate in the certBag")
+			}
+			if err != nil {
+				if strict {
+					return nil, nil, err
+				}
+				warnings = append(warnings, Warning{
+					Kind:    WarningUnparseableCertificate,
+					Message: fmt.Sprintf("skipped certificate bag #%d: %v", i, err),
+				})
+				continue
+			}
+
+			entry := TrustStoreEntry{Cert: parsedCerts[0]}
+			if entry.FriendlyName, err = bag.friendlyName(); err != nil {
+				if strict {
+					return nil, nil, err
+				}
+				warnings = append(warnings, Warning{
+					Kind:    WarningUnparseableFriendlyName,
+					Message: fmt.Sprintf("ignored the friendly name of certificate bag #%d: %v", i, err),
+				})
+			}
+			if entry.TrustedKeyUsage, err = bag.trustedKeyUsage(); err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, entry)
+
+		default:
+			return nil, nil, errors.New("pkcs12: expected only certificate bags")
+		}
+	}
+
+	return
+}
+
+// ListSubjects returns the subject of every certificate in pfxData, in the
+// order in which they appear.  Only the subject is parsed out of each
+// certificate, which is faster than [DecodeChain] or [DecodeTrustStore] and
+// accepts certificates with extensions that [smx509.ParseCertificate]
+// rejects.  Private keys are skipped without being decrypted.
+func ListSubjects(pfxData []byte, password string) (subjects []pkix.Name, err error) {
+	return defaultDecodeOptions.ListSubjects(pfxData, password)
+}
+
+// ListSubjects is like the package-level [ListSubjects], but uses the options in opts.
+func (opts *DecodeOptions) ListSubjects(pfxData []byte, password string) (subjects []pkix.Name, err error) {
+	encodedPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, opts.passwordError(pfxData, err)
+	}
+
+	bags, _, err := opts.getSafeContents(pfxData, encodedPassword, opts.newKeyDeriverFor(password), 1, opts.maxContentInfos())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bag := range bags {
+		if !bag.Id.Equal(oidCertBag) {
+			continue
+		}
+		certsData, err := decodeCertBag(bag.Value.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		subject, err := parseCertificateSubject(certsData)
+		if err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, subject)
+	}
+
+	return subjects, nil
+}
+
+// certificateSubject is the prefix of a Certificate (rfc5280#section-4.1) up
+// to the subject of its tbsCertificate.  The fields that follow are ignored.
+type certificateSubject struct {
+	TBSCertificate struct {
+		Version            int `asn1:"optional,explicit,default:0,tag:0"`
+		SerialNumber       asn1.RawValue
+		SignatureAlgorithm asn1.RawValue
+		Issuer             asn1.RawValue
+		Validity           asn1.RawValue
+		Subject            pkix.RDNSequence
+	}
+}
+
+// parseCertificateSubject returns the subject of the DER-encoded certificate der.
+func parseCertificateSubject(der []byte) (pkix.Name, error) {
+	var cert certificateSubject
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return pkix.Name{}, errors.New("pkcs12: error reading certificate subject: " + err.Error())
+	}
+	var subject pkix.Name
+	subject.FillFromRDNSequence(&cert.TBSCertificate.Subject)
+	return subject, nil
+}
+
+// EncodeTrustStore is equivalent to LegacyRC2.WithRand(rand).EncodeTrustStore.
+// See [Encoder.EncodeTrustStore] and [LegacyRC2] for details.
+//
+// Deprecated: for the same behavior, use LegacyRC2.EncodeTrustStore; to generate passwordless trust stores,
+// use Passwordless.EncodeTrustStore.
+func EncodeTrustStore(rand io.Reader, certs []*smx509.Certificate, password string) (pfxData []byte, err error) {
+	return LegacyRC2.WithRand(rand).EncodeTrustStore(certs, password)
+}
+
+// EncodeTrustStore produces pfxData containing any number of CA certificates
+// (certs) to be trusted. The certificates will be marked with a special OID that
+// allow it to be used as a Java TrustStore in Java 1.8 and newer.
+//
+// EncodeTrustStore creates a single SafeContents that's optionally encrypted
+// and contains the certificates.  If certs is empty, the SafeContents is
+// empty, and [DecodeTrustStore] reads the result back as no certificates.
+//
+// The Subject of the certificates are used as the Friendly Names (Aliases)
+// within the resulting pfxData. If certificates share a Subject, then the
+// resulting Friendly Names (Aliases) will be identical, which Java may treat as
+// the same entry when used as a Java TrustStore, e.g. with `keytool`.  To
+// customize the Friendly Names, use [EncodeTrustStoreEntries].
+func (enc *Encoder) EncodeTrustStore(certs []*smx509.Certificate, password string) (pfxData []byte, err error) {
+	var certsWithFriendlyNames []TrustStoreEntry
+	for _, cert := range certs {
+		certsWithFriendlyNames = append(certsWithFriendlyNames, TrustStoreEntry{
+			Cert:         cert,
+			FriendlyName: cert.Subject.String(),
+		})
+	}
+	return enc.EncodeTrustStoreEntries(certsWithFriendlyNames, password)
+}
+
+// TrustStoreEntry represents an entry in a Java TrustStore.
+type TrustStoreEntry struct {
+	Cert         *smx509.Certificate
+	FriendlyName string
+
+	// TrustedKeyUsage lists the extended key usages for which Java trusts
+	// the certificate.  If it is empty, [EncodeTrustStoreEntries] trusts
+	// the certificate for any extended key usage.
+	TrustedKeyUsage []asn1.ObjectIdentifier
+}
+
+// EncodeTrustStoreEntries is equivalent to LegacyRC2.WithRand(rand).EncodeTrustStoreEntries.
+// See [Encoder.EncodeTrustStoreEntries] and [LegacyRC2] for details.
+//
+// Deprecated: for the same behavior, use LegacyRC2.EncodeTrustStoreEntries; to generate passwordless trust stores,
+// use Passwordless.EncodeTrustStoreEntries.
+func EncodeTrustStoreEntries(rand io.Reader, entries []TrustStoreEntry, password string) (pfxData []byte, err error) {
+	return LegacyRC2.WithRand(rand).EncodeTrustStoreEntries(entries, password)
+}
+
+// EncodeTrustStoreEntries produces pfxData containing any number of CA
+// certificates (entries) to be trusted. The certificates will be marked with a
+// special OID that allow it to be used as a Java TrustStore in Java 1.8 and newer.
+//
+// This is identical to [Encoder.EncodeTrustStore], but also allows for setting specific
+// Friendly Names (Aliases) to be used per certificate, by specifying a slice
+// of TrustStoreEntry.
+//
+// If the same Friendly Name is used for more than one certificate, then the
+// resulting Friendly Names (Aliases) in the pfxData will be identical, which Java
+// may treat as the same entry when used as a Java TrustStore, e.g. with `keytool`.
+//
+// EncodeTrustStoreEntries creates a single SafeContents that's optionally
+// encrypted and contains the certificates.
+func (enc *Encoder) EncodeTrustStoreEntries(entries []TrustStoreEntry, password string) (pfxData []byte, err error) {
+	if enc.macAlgorithm == nil && enc.certAlgorithm == nil && password != "" {
+		return nil, errors.New("password must be empty")
+	}
+
+	encodedPassword, err := enc.encodePassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	for _, entry := range entries {
+
+		trustedKeyUsage, err := makeTrustedKeyUsageAttribute(entry.TrustedKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+
+		friendlyName, err := makeFriendlyNameAttribute(entry.FriendlyName)
+		if err != nil {
+			return nil, err
+		}
+
+		certBag, err := makeCertBag(entry.Cert.Raw, []pkcs12Attribute{trustedKeyUsage, friendlyName})
+		if err != nil {
+			return nil, err
+		}
+		certBags = append(certBags, *certBag)
+	}
+
+	return enc.encodeCertBags(certBags, encodedPassword)
+}
+
+// encodeCertBags encodes a PFX whose authenticated safe has a single
+// SafeContents, which contains certBags.
+func (enc *Encoder) encodeCertBags(certBags []safeBag, encodedPassword []byte) (pfxData []byte, err error) {
+	var pfx pfxPdu
+	pfx.Version = 3
+
+	var newMac func() (hash.Hash, error)
+	if enc.macAlgorithm != nil {
+		if newMac, err = enc.startMacData(&pfx.MacData, encodedPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	// Construct an authenticated safe with one SafeContent.
+	// The SafeContents is contains the cert bags.
+	var authenticatedSafe [1]contentInfo
+	if authenticatedSafe[0], err = enc.makeSafeContents(enc.rand, certBags, enc.certAlgorithm, encodedPassword); err != nil {
+		return nil, err
+	}
+
+	if err = setAuthSafe(&pfx, authenticatedSafe[:], newMac); err != nil {
+		return nil, err
+	}
+
+	if pfxData, err = asn1.Marshal(pfx); err != nil {
+		return nil, errors.New("pkcs12: error writing P12 data: " + err.Error())
+	}
+	if err = enc.checkOutputSize(pfxData); err != nil {
+		return nil, err
+	}
+	return
+}
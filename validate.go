@@ -0,0 +1,130 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emmansun/gmsm/smx509"
+)
+
+// Minimums enforced by [Encoder.ValidateForEncode], in addition to
+// [MinMACIterations].
+const (
+	MinRSAKeyBits       = 2048
+	MinECKeyBits        = 256
+	MinPasswordStrength = 50 // bits, as estimated by EstimatePasswordStrength
+)
+
+// ValidateForEncode checks key, cert and password against a fixed policy
+// without encoding them, so that e.g. a user interface can report problems
+// before producing a file, and returns the first violation, or nil.  It
+// checks, in this order, that:
+//
+//   - key is of a type that [Encoder.Encode] supports, and is an RSA key of
+//     at least [MinRSAKeyBits] bits, an EC key of at least [MinECKeyBits]
+//     bits, or an SM2 or Ed25519 key;
+//   - key belongs to cert, or else it returns [ErrKeyCertMismatch];
+//   - cert has the clientAuth extended key usage, if enc is derived from
+//     [BrowserClientCert];
+//   - enc both encrypts the private key and authenticates the contents with
+//     a MAC, unless it does neither, like [Passwordless];
+//   - enc encrypts with PBES2 rather than with a legacy scheme, which
+//     decoding reports as [WarningLegacyPBES1], and doesn't use HMAC-SHA-1
+//     for the MAC;
+//   - enc derives its keys with at least [MinMACIterations] iterations, the
+//     threshold of [WarningLowMACIterations];
+//   - password is empty if enc does neither, and has otherwise an estimated
+//     strength of at least [MinPasswordStrength] bits; see
+//     [EstimatePasswordStrength].
+//
+// The encoders of this package derive their keys with fewer iterations, so
+// they only pass this policy with more, e.g.
+// Modern2023.WithIterations(MinMACIterations); encoders such as [LegacyRC2]
+// that target old software don't pass it at all.  Encode itself doesn't
+// enforce it.
+func (enc *Encoder) ValidateForEncode(key interface{}, cert *smx509.Certificate, password string) error {
+	if err := checkPrivateKeyType(key); err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if bits := k.N.BitLen(); bits < MinRSAKeyBits {
+			return fmt.Errorf("pkcs12: the RSA key is %d bits long, less than %d", bits, MinRSAKeyBits)
+		}
+	case *ecdsa.PrivateKey:
+		if bits := k.Curve.Params().BitSize; bits < MinECKeyBits {
+			return fmt.Errorf("pkcs12: the EC key is %d bits long, less than %d", bits, MinECKeyBits)
+		}
+	}
+	if cert == nil {
+		return errors.New("pkcs12: no certificate")
+	}
+	if err := publicKeyMatches(key, cert); err != nil {
+		return err
+	}
+	if enc.clientAuth && !hasClientAuth(cert) {
+		return errors.New("pkcs12: the certificate doesn't have the clientAuth extended key usage")
+	}
+
+	if enc.macAlgorithm == nil && enc.certAlgorithm == nil && enc.keyAlgorithm == nil {
+		if password != "" {
+			return errors.New("password must be empty")
+		}
+		return nil
+	}
+	if enc.keyAlgorithm == nil {
+		return errors.New("pkcs12: the encoder doesn't encrypt the private key")
+	}
+	if enc.macAlgorithm == nil {
+		return errors.New("pkcs12: the encoder doesn't authenticate the contents with a MAC")
+	}
+	if enc.keyAlgorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC) || enc.certAlgorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC) {
+		return errors.New("pkcs12: the encoder uses the weak cipher pbeWithSHAAnd40BitRC2-CBC")
+	}
+	if !enc.keyAlgorithm.Equal(oidPBES2) {
+		return errors.New("pkcs12: the encoder encrypts the private key with legacy algorithm " + enc.keyAlgorithm.String())
+	}
+	if enc.certAlgorithm != nil && !enc.certAlgorithm.Equal(oidPBES2) {
+		return errors.New("pkcs12: the encoder encrypts the certificates with legacy algorithm " + enc.certAlgorithm.String())
+	}
+	if enc.macAlgorithm.Equal(oidSHA1) {
+		return errors.New("pkcs12: the encoder uses HMAC-SHA-1 for the MAC")
+	}
+	if enc.macIterations < MinMACIterations {
+		return fmt.Errorf("pkcs12: the encoder derives the MAC key with %d iterations, less than %d", enc.macIterations, MinMACIterations)
+	}
+	if iterations := enc.keyEncryptionIterations(); iterations < MinMACIterations {
+		return fmt.Errorf("pkcs12: the encoder derives the key encryption key with %d iterations, less than %d", iterations, MinMACIterations)
+	}
+	if enc.certAlgorithm != nil && enc.encryptionIterations < MinMACIterations {
+		return fmt.Errorf("pkcs12: the encoder derives the certificate encryption key with %d iterations, less than %d", enc.encryptionIterations, MinMACIterations)
+	}
+
+	if bits, warnings := EstimatePasswordStrength(password); bits < MinPasswordStrength {
+		if len(warnings) != 0 {
+			return errors.New("pkcs12: weak password: " + strings.Join(warnings, "; "))
+		}
+		return fmt.Errorf("pkcs12: weak password: its estimated strength is %.0f bits, less than %d", bits, MinPasswordStrength)
+	}
+	return nil
+}
+
+// hasClientAuth reports whether cert may be used for TLS client
+// authentication according to its extended key usages.  Unlike
+// certificate verification, it requires the extension to be present, as
+// browsers do when they list client certificates.
+func hasClientAuth(cert *smx509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == smx509.ExtKeyUsageClientAuth || usage == smx509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
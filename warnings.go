@@ -0,0 +1,52 @@
+// Copyright 2026 The go-pkcs12 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+// A WarningKind identifies the kind of problem reported by a [Warning].
+type WarningKind int
+
+const (
+	// WarningUnparseableCertificate reports a certificate bag that was
+	// skipped because its certificate couldn't be parsed.
+	WarningUnparseableCertificate WarningKind = iota + 1
+
+	// WarningWeakMACSalt reports a MAC salt shorter than 8 bytes, the
+	// minimum recommended by NIST SP 800-132.
+	WarningWeakMACSalt
+
+	// WarningLowMACIterations reports a MAC key derived with fewer than
+	// 100000 iterations.
+	WarningLowMACIterations
+
+	// WarningLegacyPBES1 reports contents encrypted with a password-based
+	// encryption scheme older than PBES2: PBES1 (rfc8018#section-6.1) or
+	// one of the PKCS#12 PBE algorithms (rfc7292#appendix-C).  It is
+	// reported once per algorithm.
+	WarningLegacyPBES1
+
+	// WarningUnparseableFriendlyName reports a trust store entry whose
+	// friendlyName attribute couldn't be decoded, and whose FriendlyName
+	// was left empty.
+	WarningUnparseableFriendlyName
+)
+
+// Thresholds below which [WarningWeakMACSalt] and [WarningLowMACIterations]
+// are reported.  [Encoder.ValidateForEncode] also requires MinMACIterations
+// for every key that the encoder derives.
+const (
+	MinMACSaltLen    = 8
+	MinMACIterations = 100000
+)
+
+// A Warning reports a problem that was tolerated while decoding a PKCS#12
+// file.
+type Warning struct {
+	Kind    WarningKind
+	Message string
+}
+
+func (w Warning) String() string {
+	return "pkcs12: " + w.Message
+}